@@ -0,0 +1,49 @@
+//! Stamps the binary with the commit and date it was built from, for
+//! `niko version`. Both are left unset when git or the clock can't say.
+
+use std::path::Path;
+use std::process::Command;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+#[allow(dead_code)]
+#[path = "src/date.rs"]
+mod date;
+
+fn main() {
+    if let Some(commit) = output("git", &["rev-parse", "--short=12", "HEAD"]) {
+        println!("cargo:rustc-env=NIKO_COMMIT={}", commit);
+    }
+    if let Some(date) = build_date() {
+        println!("cargo:rustc-env=NIKO_BUILD_DATE={}", date);
+    }
+    let rustc = std::env::var("RUSTC").unwrap_or_else(|_| "rustc".into());
+    if let Some(version) = output(&rustc, &["--version"]) {
+        println!("cargo:rustc-env=NIKO_RUSTC_VERSION={}", version);
+    }
+
+    // Watching a path that doesn't exist (a source tarball) would rerun
+    // this on every build
+    for path in [".git/HEAD", ".git/refs"] {
+        if Path::new(path).exists() {
+            println!("cargo:rerun-if-changed={}", path);
+        }
+    }
+    println!("cargo:rerun-if-env-changed=SOURCE_DATE_EPOCH");
+}
+
+fn output(program: &str, args: &[&str]) -> Option<String> {
+    let out = Command::new(program).args(args).output().ok()?;
+    let text = String::from_utf8(out.stdout).ok()?.trim().to_string();
+    (out.status.success() && !text.is_empty()).then_some(text)
+}
+
+/// Today as YYYY-MM-DD (UTC), or `SOURCE_DATE_EPOCH`'s day for
+/// reproducible builds
+fn build_date() -> Option<String> {
+    let secs = match std::env::var("SOURCE_DATE_EPOCH") {
+        Ok(epoch) => epoch.trim().parse::<u64>().ok()?,
+        Err(_) => SystemTime::now().duration_since(UNIX_EPOCH).ok()?.as_secs(),
+    };
+    let (y, m, d) = date::civil_from_days((secs / date::SECS_PER_DAY) as i64);
+    Some(format!("{:04}-{:02}-{:02}", y, m, d))
+}
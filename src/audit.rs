@@ -0,0 +1,115 @@
+use std::io::Write;
+use std::path::{Path, PathBuf};
+
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+
+use crate::config;
+use crate::history;
+use crate::safety::RiskLevel;
+
+/// How a safety stop was got past
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Override {
+    /// `--force` retried a request the model had refused
+    Force,
+    /// `--yes` answered the confirmation for a dangerous command
+    Yes,
+    /// A critical command was typed back (`safety.retype_critical`)
+    Retyped,
+    /// A critical command was confirmed with y
+    Confirmed,
+}
+
+/// One overridden safety stop, appended as a JSON line to
+/// `~/.niko/audit.jsonl`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Entry {
+    /// Unix timestamp (seconds)
+    pub timestamp: u64,
+    pub command: String,
+    pub risk: RiskLevel,
+    #[serde(rename = "override")]
+    pub mechanism: Override,
+    /// Login name of whoever ran niko, from `$USER` (or `%USERNAME%`)
+    pub user: String,
+}
+
+impl Entry {
+    pub fn new(command: &str, risk: RiskLevel, mechanism: Override) -> Self {
+        Entry {
+            timestamp: history::now_unix(),
+            command: command.to_string(),
+            risk,
+            mechanism,
+            user: std::env::var("USER")
+                .or_else(|_| std::env::var("USERNAME"))
+                .unwrap_or_default(),
+        }
+    }
+}
+
+pub fn audit_path() -> PathBuf {
+    config::config_dir().join("audit.jsonl")
+}
+
+/// Append an entry to the audit log. Tests never write the real one.
+pub fn record(entry: &Entry) -> Result<()> {
+    if cfg!(test) {
+        return Ok(());
+    }
+    record_to(&audit_path(), entry)
+}
+
+fn record_to(path: &Path, entry: &Entry) -> Result<()> {
+    if let Some(dir) = path.parent() {
+        config::create_private_dir(dir)?;
+    }
+
+    let line = serde_json::to_string(entry).context("Failed to serialize audit entry")?;
+    let mut file = config::open_private(path, true)?;
+    writeln!(file, "{}", line)
+        .with_context(|| format!("Failed to write audit log: {}", path.display()))?;
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn entries_name_the_override() {
+        let mut entry = Entry::new("rm -rf ./build", RiskLevel::Dangerous, Override::Yes);
+        entry.timestamp = 1;
+        entry.user = "ci".into();
+        assert_eq!(
+            serde_json::to_string(&entry).unwrap(),
+            r#"{"timestamp":1,"command":"rm -rf ./build","risk":"dangerous","override":"yes","user":"ci"}"#
+        );
+    }
+
+    #[test]
+    fn entries_are_appended_one_per_line() {
+        let dir = std::env::temp_dir().join(format!("niko-audit-{}", std::process::id()));
+        let path = dir.join("audit.jsonl");
+        let _ = std::fs::remove_dir_all(&dir);
+
+        for mechanism in [Override::Force, Override::Retyped] {
+            record_to(
+                &path,
+                &Entry::new("rm -rf ./build", RiskLevel::Dangerous, mechanism),
+            )
+            .unwrap();
+        }
+        let log = std::fs::read_to_string(&path).unwrap();
+        let overrides: Vec<Override> = log
+            .lines()
+            .map(|line| serde_json::from_str::<Entry>(line).unwrap().mechanism)
+            .collect();
+        assert_eq!(overrides, vec![Override::Force, Override::Retyped]);
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
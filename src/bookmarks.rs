@@ -0,0 +1,80 @@
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::PathBuf;
+
+use anyhow::{bail, Context, Result};
+use serde::{Deserialize, Serialize};
+
+use crate::config;
+
+/// A command kept under a name in `~/.niko/bookmarks.yaml`
+#[derive(Debug, Clone, Serialize, Deserialize, Default, PartialEq)]
+#[serde(default)]
+pub struct Bookmark {
+    pub command: String,
+    /// The query that generated it, if any
+    #[serde(skip_serializing_if = "String::is_empty")]
+    pub query: String,
+    /// Unix timestamp (seconds)
+    pub saved_at: u64,
+}
+
+pub fn bookmarks_path() -> PathBuf {
+    config::config_dir().join("bookmarks.yaml")
+}
+
+/// All bookmarks by name; none when the file doesn't exist yet
+pub fn load() -> Result<BTreeMap<String, Bookmark>> {
+    let path = bookmarks_path();
+    if !path.exists() {
+        return Ok(BTreeMap::new());
+    }
+    let content = fs::read_to_string(&path)
+        .with_context(|| format!("Failed to read bookmarks: {}", path.display()))?;
+    if content.trim().is_empty() {
+        return Ok(BTreeMap::new());
+    }
+    serde_yaml::from_str(&content)
+        .with_context(|| format!("Failed to parse bookmarks: {}", path.display()))
+}
+
+/// Replace the bookmarks file with `bookmarks`
+pub fn store(bookmarks: &BTreeMap<String, Bookmark>) -> Result<()> {
+    let path = bookmarks_path();
+    if let Some(dir) = path.parent() {
+        config::create_private_dir(dir)?;
+    }
+    let yaml = serde_yaml::to_string(bookmarks).context("Failed to serialize bookmarks")?;
+    config::write_private(&path, yaml.as_bytes())
+}
+
+/// Names are typed on the command line, so keep them to one plain word
+pub fn validate_name(name: &str) -> Result<()> {
+    if name.is_empty() {
+        bail!("A bookmark needs a name");
+    }
+    if !name
+        .chars()
+        .all(|c| c.is_alphanumeric() || matches!(c, '-' | '_' | '.'))
+    {
+        bail!(
+            "Invalid bookmark name '{}': use letters, digits, '-', '_' or '.'",
+            name
+        );
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn names_are_single_words() {
+        assert!(validate_name("deploy").is_ok());
+        assert!(validate_name("disk-usage_v2.1").is_ok());
+        assert!(validate_name("").is_err());
+        assert!(validate_name("two words").is_err());
+        assert!(validate_name("a/b").is_err());
+    }
+}
@@ -0,0 +1,187 @@
+use std::io::{self, IsTerminal};
+use std::panic;
+use std::sync::{mpsc, Mutex, Once};
+use std::thread;
+use std::time::Duration;
+
+use crossterm::event::{self, Event, KeyCode, KeyEvent, KeyEventKind, KeyModifiers};
+use crossterm::terminal;
+
+use crate::progress;
+
+/// Exit status for an interrupted run, as a shell would report SIGINT
+const EXIT_CANCELLED: i32 = 130;
+
+const POLL_INTERVAL: Duration = Duration::from_millis(50);
+
+/// What to say instead of "cancelled", set by work that has more to tell
+static NOTE: Mutex<Option<&'static str>> = Mutex::new(None);
+
+/// Say `note` instead of "cancelled" if the run is interrupted while the
+/// returned guard is alive, e.g. to tell the user a download can resume.
+/// The previous note comes back when the guard is dropped.
+pub fn note_on_cancel(note: &'static str) -> NoteGuard {
+    NoteGuard {
+        previous: lock_note().replace(note),
+    }
+}
+
+pub struct NoteGuard {
+    previous: Option<&'static str>,
+}
+
+impl Drop for NoteGuard {
+    fn drop(&mut self) {
+        *lock_note() = self.previous;
+    }
+}
+
+fn lock_note() -> std::sync::MutexGuard<'static, Option<&'static str>> {
+    NOTE.lock().unwrap_or_else(|e| e.into_inner())
+}
+
+/// Run `work` on a background thread and return its result, exiting with
+/// "cancelled" if the user presses Ctrl+C (or Esc) first.
+///
+/// Blocking HTTP requests can't be interrupted in place, so cancellation
+/// exits the process instead: the connection is dropped, which also makes
+/// Ollama stop generating. Without a terminal on stdin this just runs
+/// `work` inline and leaves Ctrl+C to the default signal handling.
+pub fn run_cancellable<T, F>(work: F) -> T
+where
+    T: Send + 'static,
+    F: FnOnce() -> T + Send + 'static,
+{
+    if !io::stdin().is_terminal() {
+        return work();
+    }
+    let Some(mut raw) = RawMode::enable() else {
+        return work();
+    };
+
+    let (tx, rx) = mpsc::channel();
+    thread::spawn(move || {
+        let _ = tx.send(work());
+    });
+
+    loop {
+        match rx.recv_timeout(POLL_INTERVAL) {
+            Ok(result) => return result,
+            Err(mpsc::RecvTimeoutError::Disconnected) => {
+                // The worker panicked; its message is already on stderr
+                raw.restore();
+                std::process::exit(1);
+            }
+            Err(mpsc::RecvTimeoutError::Timeout) => {}
+        }
+
+        // In raw mode Ctrl+C arrives as a key press rather than SIGINT
+        if event::poll(Duration::ZERO).unwrap_or(false) {
+            if let Ok(Event::Key(key)) = event::read() {
+                if is_interrupt(&key) {
+                    raw.restore();
+                    // Keep a partial command on screen, for seeing what went wrong
+                    if progress::is_drawing() {
+                        eprintln!();
+                    }
+                    eprintln!("{}", lock_note().unwrap_or("cancelled"));
+                    std::process::exit(EXIT_CANCELLED);
+                }
+            }
+        }
+    }
+}
+
+/// Raw mode that is switched off again however we leave — normal return,
+/// early exit or panic. `restore` is idempotent, so calling it before
+/// `process::exit` (which skips destructors) and then dropping is safe.
+struct RawMode {
+    active: bool,
+}
+
+impl RawMode {
+    fn enable() -> Option<Self> {
+        terminal::enable_raw_mode().ok()?;
+
+        // A panic on any thread would otherwise leave the terminal with no
+        // echo; restore first, then report as usual. Installed once, so
+        // repeated runs don't wrap the hook again and again.
+        static HOOK: Once = Once::new();
+        HOOK.call_once(|| {
+            let default_hook = panic::take_hook();
+            panic::set_hook(Box::new(move |info| {
+                let _ = terminal::disable_raw_mode();
+                default_hook(info);
+            }));
+        });
+
+        Some(Self { active: true })
+    }
+
+    fn restore(&mut self) {
+        if self.active {
+            let _ = terminal::disable_raw_mode();
+            self.active = false;
+        }
+    }
+}
+
+impl Drop for RawMode {
+    fn drop(&mut self) {
+        self.restore();
+    }
+}
+
+/// Ctrl+C or a bare Esc. crossterm decodes escape sequences, so arrow and
+/// function keys arrive as their own codes and are ignored rather than
+/// being mistaken for Esc.
+fn is_interrupt(key: &KeyEvent) -> bool {
+    if key.kind != KeyEventKind::Press {
+        return false;
+    }
+    match key.code {
+        KeyCode::Esc => true,
+        KeyCode::Char('c') => key.modifiers.contains(KeyModifiers::CONTROL),
+        _ => false,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn key(code: KeyCode, modifiers: KeyModifiers) -> KeyEvent {
+        KeyEvent::new(code, modifiers)
+    }
+
+    #[test]
+    fn ctrl_c_and_bare_esc_interrupt() {
+        assert!(is_interrupt(&key(
+            KeyCode::Char('c'),
+            KeyModifiers::CONTROL
+        )));
+        assert!(is_interrupt(&key(KeyCode::Esc, KeyModifiers::NONE)));
+    }
+
+    #[test]
+    fn notes_nest_and_restore() {
+        assert_eq!(*lock_note(), None);
+        {
+            let _outer = note_on_cancel("download cancelled");
+            {
+                let _inner = note_on_cancel("inner");
+                assert_eq!(*lock_note(), Some("inner"));
+            }
+            assert_eq!(*lock_note(), Some("download cancelled"));
+        }
+        assert_eq!(*lock_note(), None);
+    }
+
+    #[test]
+    fn arrows_and_plain_keys_are_ignored() {
+        for code in [KeyCode::Up, KeyCode::Down, KeyCode::Left, KeyCode::Right] {
+            assert!(!is_interrupt(&key(code, KeyModifiers::NONE)));
+        }
+        assert!(!is_interrupt(&key(KeyCode::Char('c'), KeyModifiers::NONE)));
+    }
+}
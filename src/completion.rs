@@ -0,0 +1,247 @@
+use std::collections::HashSet;
+
+use clap::{Command, ValueEnum};
+
+use crate::bookmarks;
+use crate::config;
+
+/// Shells `niko completion` can emit a script for
+#[derive(Debug, Clone, Copy, PartialEq, Eq, ValueEnum)]
+pub enum Shell {
+    Bash,
+    Zsh,
+    Fish,
+}
+
+/// Settings that aren't per-provider, as `niko settings set` accepts them
+const GLOBAL_SETTINGS: &[&str] = &[
+    "active_provider",
+    "prompt.context_tools",
+    "prompt.gnu_coreutils",
+    "prompt.example_top_k",
+    "prompt.embedding_model",
+    "prompt.system_template",
+    "prompt.expand_provider",
+    "prompt.max_tools",
+    "safety.strip_sudo",
+    "safety.require_confirm_dangerous",
+    "safety.check_paths",
+    "safety.max_command_length",
+    "safety.retype_critical",
+    "safety.print_only",
+    "generation.max_concurrent",
+    "hooks.post_generate",
+    "hooks.assess",
+    "ui.color",
+    "ui.verbose",
+    "ui.tool_check",
+    "ui.known_commands",
+    "ui.tool_check_shell",
+    "ui.interactive_tools",
+];
+
+/// Fields every provider has, plus the options the backends read
+const PROVIDER_FIELDS: &[&str] = &[
+    "model",
+    "base_url",
+    "api_key",
+    "kind",
+    "temperature",
+    "system_template",
+    "structured_output",
+];
+const OLLAMA_FIELDS: &[&str] = &[
+    "keep_alive",
+    "num_ctx",
+    "seed",
+    "api_mode",
+    "auto_install",
+    "fallback_model",
+    "min_model",
+];
+
+/// Completion script for `shell`. Each one asks `niko __complete` for
+/// candidates, so configured providers and new flags show up without
+/// regenerating the script.
+pub fn script(shell: Shell) -> &'static str {
+    match shell {
+        Shell::Bash => {
+            r#"_niko() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local IFS=$'\n'
+    COMPREPLY=($(compgen -W "$(niko __complete -- "${COMP_WORDS[@]:1:COMP_CWORD-1}" 2>/dev/null)" -- "$cur"))
+}
+complete -o default -F _niko niko
+"#
+        }
+        Shell::Zsh => {
+            r#"#compdef niko
+_niko() {
+    local -a candidates
+    candidates=("${(@f)$(niko __complete -- "${(@)words[2,CURRENT-1]}" 2>/dev/null)}")
+    compadd -a candidates
+}
+compdef _niko niko
+"#
+        }
+        Shell::Fish => {
+            r#"function __niko_complete
+    set -l tokens (commandline -opc)
+    niko __complete -- $tokens[2..-1] 2>/dev/null
+end
+complete -c niko -f -a '(__niko_complete)'
+"#
+        }
+    }
+}
+
+/// Candidates for the word after `words` (the arguments typed so far,
+/// without the program name). The shell filters them by prefix.
+pub fn candidates(cli: &Command, words: &[String]) -> Vec<String> {
+    let words: Vec<&str> = words.iter().map(String::as_str).collect();
+
+    match words.as_slice() {
+        [.., "-p" | "--provider"] => return provider_names(),
+        ["settings", "set"] => return setting_keys(),
+        ["settings", "set", "active_provider" | "provider"] => return provider_names(),
+        ["run"] => return saved_names(),
+        _ => {}
+    }
+
+    // Walk down to the subcommand being typed
+    let mut command = cli;
+    for word in &words {
+        if let Some(sub) = command.find_subcommand(word) {
+            command = sub;
+        }
+    }
+
+    // A flag's own values, e.g. `--output <TAB>`
+    if let Some(flag) = words.last().and_then(|w| w.strip_prefix("--")) {
+        if let Some(arg) = command.get_arguments().find(|a| a.get_long() == Some(flag)) {
+            let values: Vec<String> = arg
+                .get_possible_values()
+                .iter()
+                .filter(|v| !v.is_hide_set())
+                .map(|v| v.get_name().to_string())
+                .collect();
+            if !values.is_empty() {
+                return values;
+            }
+        }
+    }
+
+    let subcommands = command
+        .get_subcommands()
+        .filter(|c| !c.is_hide_set())
+        .map(|c| c.get_name().to_string());
+    let flags = command
+        .get_arguments()
+        .chain(cli.get_arguments().filter(|a| a.is_global_set()))
+        .filter(|a| !a.is_hide_set())
+        .filter_map(|a| a.get_long().map(|l| format!("--{}", l)));
+
+    // Globals are listed both on `cli` and, once built, on every subcommand
+    let mut seen = HashSet::new();
+    subcommands
+        .chain(flags)
+        .filter(|c| seen.insert(c.clone()))
+        .collect()
+}
+
+/// Configured providers first, then the well-known ones not yet set up
+fn provider_names() -> Vec<String> {
+    let mut names: Vec<String> = config::load()
+        .map(|cfg| cfg.providers.into_keys().collect())
+        .unwrap_or_default();
+    names.sort();
+    for (name, _, _, _) in config::known_provider_templates() {
+        if !names.iter().any(|n| n == name) {
+            names.push(name.to_string());
+        }
+    }
+    names
+}
+
+fn saved_names() -> Vec<String> {
+    bookmarks::load()
+        .map(|all| all.into_keys().collect())
+        .unwrap_or_default()
+}
+
+fn setting_keys() -> Vec<String> {
+    let mut keys: Vec<String> = GLOBAL_SETTINGS.iter().map(|k| k.to_string()).collect();
+    for name in provider_names() {
+        keys.extend(PROVIDER_FIELDS.iter().map(|f| format!("{}.{}", name, f)));
+        if name == "ollama" {
+            keys.extend(OLLAMA_FIELDS.iter().map(|f| format!("{}.{}", name, f)));
+        }
+    }
+    keys
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use clap::{Arg, ArgAction};
+
+    fn cli() -> Command {
+        Command::new("niko")
+            .arg(
+                Arg::new("verbose")
+                    .long("verbose")
+                    .global(true)
+                    .action(ArgAction::SetTrue),
+            )
+            .arg(
+                Arg::new("output")
+                    .long("output")
+                    .value_parser(["text", "json"]),
+            )
+            .subcommand(
+                Command::new("settings")
+                    .subcommand(Command::new("show"))
+                    .subcommand(
+                        Command::new("set")
+                            .arg(Arg::new("key"))
+                            .arg(Arg::new("value")),
+                    ),
+            )
+            .subcommand(Command::new("__complete").hide(true))
+    }
+
+    fn words(words: &[&str]) -> Vec<String> {
+        words.iter().map(|w| w.to_string()).collect()
+    }
+
+    #[test]
+    fn top_level_offers_visible_subcommands_and_flags() {
+        let got = candidates(&cli(), &[]);
+        assert!(got.contains(&"settings".to_string()));
+        assert!(got.contains(&"--output".to_string()));
+        assert!(!got.iter().any(|c| c == "__complete"));
+    }
+
+    #[test]
+    fn nested_subcommands_keep_global_flags() {
+        let got = candidates(&cli(), &words(&["settings"]));
+        assert!(got.contains(&"show".to_string()));
+        assert!(got.contains(&"--verbose".to_string()));
+        assert!(!got.contains(&"--output".to_string()));
+    }
+
+    #[test]
+    fn flag_values_come_from_possible_values() {
+        assert_eq!(
+            candidates(&cli(), &words(&["--output"])),
+            vec!["text", "json"]
+        );
+    }
+
+    #[test]
+    fn scripts_call_back_into_niko() {
+        for shell in [Shell::Bash, Shell::Zsh, Shell::Fish] {
+            assert!(script(shell).contains("niko __complete --"));
+        }
+    }
+}
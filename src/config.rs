@@ -1,6 +1,7 @@
-use std::collections::HashMap;
+use std::collections::{BTreeMap, HashMap};
 use std::fs;
-use std::path::PathBuf;
+use std::io::Write;
+use std::path::{Path, PathBuf};
 use std::sync::OnceLock;
 
 use anyhow::{Context, Result};
@@ -8,6 +9,7 @@ use serde::{Deserialize, Serialize};
 use sysinfo::System;
 
 static CONFIG: OnceLock<Config> = OnceLock::new();
+static CONFIG_PATH_OVERRIDE: OnceLock<PathBuf> = OnceLock::new();
 
 /// Top-level config — fully dynamic, no hardcoded providers or models
 #[derive(Debug, Clone, Serialize, Deserialize, Default)]
@@ -24,6 +26,18 @@ pub struct Config {
 
     /// UI preferences
     pub ui: UiConfig,
+
+    /// What goes into the generation prompt
+    pub prompt: PromptConfig,
+
+    /// How requests are made
+    pub generation: GenerationConfig,
+
+    /// External programs run at points in the pipeline
+    pub hooks: HooksConfig,
+
+    /// Remote hosts that `--ssh` targets
+    pub ssh: SshConfig,
 }
 
 /// A single provider configuration — fully dynamic
@@ -33,7 +47,8 @@ pub struct ProviderConfig {
     /// Provider kind: "ollama", "openai_compat", "anthropic"
     pub kind: String,
 
-    /// API key (empty for local providers)
+    /// API key (empty for local providers). `file:/path` reads the key from
+    /// that file when the config is loaded.
     pub api_key: String,
 
     /// Base URL for the API
@@ -44,13 +59,54 @@ pub struct ProviderConfig {
 
     /// Additional provider-specific options
     pub options: HashMap<String, String>,
+
+    /// Extra HTTP headers sent with every request, for API gateways that
+    /// want e.g. a tenant header on top of the API key
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    pub headers: BTreeMap<String, String>,
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
 #[serde(default)]
 pub struct SafetyConfig {
+    /// Ask before `--exec` runs a dangerous command. Critical commands
+    /// always ask, whatever this says.
     pub require_confirm_dangerous: bool,
     pub blocked_commands: Vec<String>,
+    /// Drop a leading `sudo` from generated commands
+    pub strip_sudo: bool,
+    /// `pattern -> replacement` regex rewrites applied to every generated command
+    pub rewrite: Vec<String>,
+    /// Warn when `rm`/`mv`-style commands name relative paths that don't
+    /// exist in the working directory
+    pub check_paths: bool,
+    /// Longest command accepted from a model, in characters (0 = no limit);
+    /// anything longer is a wall of text rather than a command
+    pub max_command_length: usize,
+    /// Under `--exec`, make critical commands be typed back exactly instead
+    /// of taking a y/N, so a reflexive "y" can't run them
+    pub retype_critical: bool,
+    /// Never run anything: `--exec` and the chat's `/run` only report that
+    /// execution is disabled, making niko a pure translator
+    pub print_only: bool,
+    /// Stricter (or looser) settings for hosts matching a name pattern such
+    /// as `prod-*`, merged in when the config is loaded
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    pub by_host: BTreeMap<String, HostSafety>,
+}
+
+/// `safety.by_host.<pattern>`: overrides for hosts whose name matches
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+#[serde(default)]
+pub struct HostSafety {
+    /// Blocked in addition to `safety.blocked_commands`
+    pub blocked_commands: Vec<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub require_confirm_dangerous: Option<bool>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub strip_sudo: Option<bool>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub check_paths: Option<bool>,
 }
 
 impl Default for SafetyConfig {
@@ -66,6 +122,13 @@ impl Default for SafetyConfig {
                 "> /dev/sda".into(),
                 "chmod -R 777 /".into(),
             ],
+            strip_sudo: false,
+            rewrite: Vec::new(),
+            check_paths: true,
+            max_command_length: 2000,
+            retype_critical: false,
+            print_only: false,
+            by_host: BTreeMap::new(),
         }
     }
 }
@@ -75,17 +138,146 @@ impl Default for SafetyConfig {
 pub struct UiConfig {
     pub color: bool,
     pub verbose: bool,
+    /// Note when a generated command uses a program that isn't on PATH
+    pub tool_check: bool,
+    /// Names that check counts as installed though `which` can't find
+    /// them, such as your shell functions and aliases
+    pub known_commands: Vec<String>,
+    /// Before noting a missing program, ask your interactive bash or zsh
+    /// whether it defines it (loads the shell's startup files)
+    pub tool_check_shell: bool,
+    /// Programs that need a terminal: run under `--exec` without one, they
+    /// get a warning that they may hang or fail
+    pub interactive_tools: Vec<String>,
 }
 
+/// Full-screen or prompting programs that misbehave without a terminal
+const DEFAULT_INTERACTIVE_TOOLS: &[&str] = &[
+    "vim", "vi", "nvim", "nano", "emacs", "less", "more", "man", "top", "htop", "btop", "tmux",
+    "screen", "watch", "fzf",
+];
+
 impl Default for UiConfig {
     fn default() -> Self {
         Self {
             color: true,
             verbose: false,
+            tool_check: true,
+            known_commands: Vec::new(),
+            tool_check_shell: false,
+            interactive_tools: DEFAULT_INTERACTIVE_TOOLS
+                .iter()
+                .map(|t| t.to_string())
+                .collect(),
         }
     }
 }
 
+#[derive(Debug, Clone, Serialize, Deserialize, Default)]
+#[serde(default)]
+pub struct PromptConfig {
+    /// If non-empty, only these detected tools are advertised to the model
+    pub context_tools: Vec<String>,
+    /// On macOS, ask for GNU-style commands when Homebrew coreutils are installed
+    pub gnu_coreutils: bool,
+    /// Query → command, answered without calling a provider. Queries match
+    /// exactly, ignoring case and surrounding whitespace.
+    pub aliases: HashMap<String, String>,
+    /// Worked examples shown to the model in the command prompt
+    pub examples: Vec<Example>,
+    /// With more examples than this, include only the N most similar to the
+    /// query, ranked by Ollama embeddings. 0 includes them all.
+    pub example_top_k: usize,
+    /// Ollama model for ranking examples (default `nomic-embed-text`)
+    pub embedding_model: String,
+    /// Replaces the built-in command prompt; `{os}`, `{arch}`, `{shell}`,
+    /// `{cwd}` and `{tools}` are filled in. A provider's own
+    /// `system_template` option takes precedence.
+    pub system_template: String,
+    /// Provider that rewrites terse queries under `--expand`, typically a
+    /// cheap one; empty uses the provider generating the command
+    pub expand_provider: String,
+    /// List at most this many tools in the prompt, those the query names
+    /// first. 0 lists them all.
+    pub max_tools: usize,
+}
+
+/// A request and the command it should become
+#[derive(Debug, Clone, Serialize, Deserialize, Default, PartialEq)]
+#[serde(default)]
+pub struct Example {
+    pub query: String,
+    pub command: String,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(default)]
+pub struct GenerationConfig {
+    /// Upper bound on in-flight requests when generating several candidates
+    /// (`-n`), to stay clear of cloud rate limits
+    pub max_concurrent: usize,
+}
+
+impl Default for GenerationConfig {
+    fn default() -> Self {
+        Self { max_concurrent: 2 }
+    }
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, Default)]
+#[serde(default)]
+pub struct HooksConfig {
+    /// Executable that gets each generated command on stdin and prints the
+    /// command to use (nothing = unchanged); a non-zero exit vetoes it
+    pub post_generate: String,
+    /// Executable that gets each command on stdin and may print a stricter
+    /// risk assessment as JSON (`{"level": ..., "reasons": [...]}`)
+    pub assess: String,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, Default)]
+#[serde(default)]
+pub struct SshConfig {
+    /// What to tell the model about hosts whose name matches the pattern
+    /// (`*` and `?` wildcards), since it can't be detected from here
+    pub by_host: BTreeMap<String, RemoteHost>,
+}
+
+/// `ssh.by_host.<pattern>`: a remote host's system, for the prompt
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+#[serde(default)]
+pub struct RemoteHost {
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub os: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub arch: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub shell: Option<String>,
+    /// Tools installed there, listed to the model
+    pub tools: Vec<String>,
+}
+
+/// What `ssh.by_host` says about the host in `destination` (`user@host`),
+/// merged over every matching pattern in sorted order so later ones win
+pub fn remote_host(cfg: &Config, destination: &str) -> RemoteHost {
+    let host = destination.rsplit('@').next().unwrap_or(destination);
+    let mut merged = RemoteHost::default();
+    for (_, remote) in cfg
+        .ssh
+        .by_host
+        .iter()
+        .filter(|(pattern, _)| host_matches(pattern, host))
+    {
+        merged.os = remote.os.clone().or(merged.os);
+        merged.arch = remote.arch.clone().or(merged.arch);
+        merged.shell = remote.shell.clone().or(merged.shell);
+        if !remote.tools.is_empty() {
+            merged.tools = remote.tools.clone();
+        }
+    }
+    merged
+}
+
 // ─── Well-known provider templates ──────────────────────────────────────────
 
 /// Returns a list of well-known provider templates for the setup wizard
@@ -144,6 +336,22 @@ pub fn known_provider_templates() -> Vec<(&'static str, &'static str, &'static s
     ]
 }
 
+/// When a well-known provider is pointed at another well-known provider's
+/// endpoint (say `openai.base_url` set to DeepSeek's), the name of the
+/// provider that endpoint belongs to. Requests would still go out, but
+/// under the wrong name, defaults and API key.
+pub fn endpoint_owner(name: &str, base_url: &str) -> Option<&'static str> {
+    let templates = known_provider_templates();
+    if !templates.iter().any(|(known, _, _, _)| *known == name) {
+        return None;
+    }
+    let url = normalize_base_url(base_url).ok()?;
+    templates
+        .into_iter()
+        .find(|(other, _, default_url, _)| *other != name && *default_url == url)
+        .map(|(other, _, _, _)| other)
+}
+
 // ─── Paths ──────────────────────────────────────────────────────────────────
 
 pub fn config_dir() -> PathBuf {
@@ -151,8 +359,204 @@ pub fn config_dir() -> PathBuf {
     home.join(".niko")
 }
 
+/// Override the config file path for this process (the `--config` flag).
+/// Must be called before the config is first loaded.
+pub fn set_path_override(path: PathBuf) {
+    let _ = CONFIG_PATH_OVERRIDE.set(path);
+}
+
+/// Config file path: `--config` > `$NIKO_CONFIG` > `~/.niko/config.yaml`
 pub fn config_path() -> PathBuf {
-    config_dir().join("config.yaml")
+    if let Some(path) = CONFIG_PATH_OVERRIDE.get() {
+        return path.clone();
+    }
+    match std::env::var("NIKO_CONFIG") {
+        Ok(path) if !path.is_empty() => PathBuf::from(path),
+        _ => config_dir().join("config.yaml"),
+    }
+}
+
+// ─── Private files ──────────────────────────────────────────────────────────
+
+/// Create a directory (and parents) only the user can enter (0700 on Unix).
+/// An existing `~/.niko` is tightened too; other existing directories (one
+/// holding a `--config` file, say) are left as the user set them.
+pub fn create_private_dir(dir: &Path) -> Result<()> {
+    let mut builder = fs::DirBuilder::new();
+    builder.recursive(true);
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::DirBuilderExt;
+        builder.mode(0o700);
+    }
+    builder
+        .create(dir)
+        .with_context(|| format!("Failed to create directory: {}", dir.display()))?;
+
+    #[cfg(unix)]
+    if dir.starts_with(config_dir()) {
+        restrict_dir(dir)?;
+    }
+    Ok(())
+}
+
+/// `DirBuilder::mode` only applies to directories it creates
+#[cfg(unix)]
+fn restrict_dir(dir: &Path) -> Result<()> {
+    use std::os::unix::fs::PermissionsExt;
+    fs::set_permissions(dir, fs::Permissions::from_mode(0o700))
+        .with_context(|| format!("Failed to restrict permissions on {}", dir.display()))
+}
+
+/// `O_NOFOLLOW`, which std doesn't export
+#[cfg(all(
+    any(target_os = "linux", target_os = "android"),
+    any(
+        target_arch = "aarch64",
+        target_arch = "arm",
+        target_arch = "powerpc",
+        target_arch = "powerpc64"
+    )
+))]
+const O_NOFOLLOW: i32 = 0o100000;
+#[cfg(all(
+    any(target_os = "linux", target_os = "android"),
+    not(any(
+        target_arch = "aarch64",
+        target_arch = "arm",
+        target_arch = "powerpc",
+        target_arch = "powerpc64"
+    ))
+))]
+const O_NOFOLLOW: i32 = 0o400000;
+#[cfg(all(unix, not(any(target_os = "linux", target_os = "android"))))]
+const O_NOFOLLOW: i32 = 0x0100;
+
+/// Open one of niko's files for writing, readable only by the user (0600
+/// on Unix): the config holds API keys and the history every command run.
+/// A symlink is only followed if it stays inside the file's directory, so
+/// a planted link can't redirect writes to somewhere like `~/.ssh`; its
+/// target is then opened without following links, so one swapped in after
+/// the check makes the open fail instead.
+pub fn open_private(path: &Path, append: bool) -> Result<fs::File> {
+    let target = resolve_symlink(path)?;
+
+    let mut options = fs::OpenOptions::new();
+    options.create(true);
+    if append {
+        options.append(true);
+    } else {
+        options.write(true).truncate(true);
+    }
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::OpenOptionsExt;
+        options.mode(0o600).custom_flags(O_NOFOLLOW);
+    }
+    let file = options
+        .open(&target)
+        .with_context(|| format!("Failed to open {}", path.display()))?;
+
+    // `mode` only applies to new files; tighten ones older versions wrote
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        file.set_permissions(fs::Permissions::from_mode(0o600))
+            .with_context(|| format!("Failed to restrict permissions on {}", path.display()))?;
+    }
+    Ok(file)
+}
+
+/// Replace a file's contents through [`open_private`]
+pub fn write_private(path: &Path, contents: &[u8]) -> Result<()> {
+    open_private(path, false)?
+        .write_all(contents)
+        .with_context(|| format!("Failed to write {}", path.display()))
+}
+
+/// A new directory under the system temp dir that only the user can
+/// enter, for scratch files such as the editor buffer; the caller removes
+/// it. An existing path is never reused, so nothing planted there under a
+/// predictable name (a symlink, say) is written through.
+pub fn private_temp_dir(prefix: &str) -> Result<PathBuf> {
+    use std::sync::atomic::{AtomicUsize, Ordering};
+    static NEXT: AtomicUsize = AtomicUsize::new(0);
+
+    let nanos = std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)
+        .map_or(0, |d| d.subsec_nanos());
+    let mut builder = fs::DirBuilder::new();
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::DirBuilderExt;
+        builder.mode(0o700);
+    }
+    for _ in 0..100 {
+        let dir = std::env::temp_dir().join(format!(
+            "{}-{}-{}-{}",
+            prefix,
+            std::process::id(),
+            NEXT.fetch_add(1, Ordering::SeqCst),
+            nanos
+        ));
+        match builder.create(&dir) {
+            Ok(()) => return Ok(dir),
+            Err(e) if e.kind() == std::io::ErrorKind::AlreadyExists => continue,
+            Err(e) => {
+                return Err(e)
+                    .with_context(|| format!("Failed to create directory: {}", dir.display()))
+            }
+        }
+    }
+    anyhow::bail!("Failed to create a temporary directory for {}", prefix)
+}
+
+/// Write a file that must not exist yet, readable only by the user, e.g.
+/// inside a [`private_temp_dir`]
+pub fn create_private(path: &Path, contents: &[u8]) -> Result<()> {
+    let mut options = fs::OpenOptions::new();
+    options.write(true).create_new(true);
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::OpenOptionsExt;
+        options.mode(0o600);
+    }
+    options
+        .open(path)
+        .and_then(|mut file| file.write_all(contents))
+        .with_context(|| format!("Failed to create {}", path.display()))
+}
+
+/// The file a write to `path` should open: `path` itself, or where its
+/// symlink points when that stays inside the directory
+fn resolve_symlink(path: &Path) -> Result<PathBuf> {
+    let is_link = fs::symlink_metadata(path)
+        .map(|m| m.file_type().is_symlink())
+        .unwrap_or(false);
+    if !is_link {
+        return Ok(path.to_path_buf());
+    }
+
+    let dir = path.parent().unwrap_or(Path::new("."));
+    let dir = fs::canonicalize(dir).unwrap_or_else(|_| dir.to_path_buf());
+    let target = dir.join(fs::read_link(path)?);
+    // A dangling link resolves through its parent directory
+    let resolved = fs::canonicalize(&target).unwrap_or_else(|_| {
+        match (target.parent().map(fs::canonicalize), target.file_name()) {
+            (Some(Ok(parent)), Some(name)) => parent.join(name),
+            _ => target.clone(),
+        }
+    });
+
+    if !resolved.starts_with(&dir) {
+        anyhow::bail!(
+            "Refusing to write {}: it is a symlink to {}, outside {}",
+            path.display(),
+            resolved.display(),
+            dir.display()
+        );
+    }
+    Ok(resolved)
 }
 
 // ─── System info ────────────────────────────────────────────────────────────
@@ -195,6 +599,7 @@ pub fn default_config() -> Config {
             base_url: "http://127.0.0.1:11434".into(),
             model: String::new(), // will be selected dynamically
             options: HashMap::new(),
+            headers: BTreeMap::new(),
         },
     );
 
@@ -203,17 +608,257 @@ pub fn default_config() -> Config {
         providers,
         safety: SafetyConfig::default(),
         ui: UiConfig::default(),
+        prompt: PromptConfig::default(),
+        generation: GenerationConfig::default(),
+        hooks: HooksConfig::default(),
+        ssh: SshConfig::default(),
     }
 }
 
 // ─── Load / Save ────────────────────────────────────────────────────────────
 
+/// Load config with env-var keys overlaid and `file:` keys resolved
 pub fn load() -> Result<Config> {
+    let mut cfg = read_config()?;
+    apply_env_keys(&mut cfg, |var| std::env::var(var).ok());
+    apply_env_overrides(&mut cfg, |var| std::env::var(var).ok());
+    if let Some(host) = System::host_name() {
+        apply_host_safety(&mut cfg.safety, &host);
+    }
+    resolve_api_key_files(&mut cfg)?;
+
+    Ok(cfg)
+}
+
+/// Give known providers without an API key the one from their
+/// environment variable (`OPENAI_API_KEY` and the like)
+fn apply_env_keys(cfg: &mut Config, lookup: impl Fn(&str) -> Option<String>) {
+    for (name, _, _, env_var) in known_provider_templates() {
+        if env_var.is_empty() {
+            continue;
+        }
+        if let (Some(key), Some(p)) = (lookup(env_var), cfg.providers.get_mut(name)) {
+            if p.api_key.is_empty() {
+                p.api_key = key;
+            }
+        }
+    }
+}
+
+/// A resolved setting, as `niko settings show --sources` lists it
+pub struct Sourced {
+    /// Dotted path, e.g. `providers.openai.model`
+    pub key: String,
+    pub value: serde_json::Value,
+    /// `default`, `file`, the environment variable that set it,
+    /// `safety.by_host`, or `api_key file` for a key read from a file
+    pub source: String,
+}
+
+/// Every setting `load` resolves, with where its value came from
+pub fn sources() -> Result<Vec<Sourced>> {
+    let raw = match fs::read_to_string(config_path()) {
+        Ok(content) => serde_yaml::from_str(&content).unwrap_or_default(),
+        Err(_) => serde_json::Value::Null,
+    };
+    sources_from(
+        &raw,
+        read_config()?,
+        |var| std::env::var(var).ok(),
+        System::host_name().as_deref(),
+    )
+}
+
+/// `sources` for the file's contents `raw` (parsed as `cfg`), the
+/// environment `lookup` and `host`. Replays `load` one layer at a time,
+/// each environment variable separately, crediting every value a layer
+/// changes to that layer.
+fn sources_from(
+    raw: &serde_json::Value,
+    mut cfg: Config,
+    lookup: impl Fn(&str) -> Option<String>,
+    host: Option<&str>,
+) -> Result<Vec<Sourced>> {
+    let mut found = BTreeMap::new();
+    for (path, value) in flatten(&serde_json::to_value(&cfg)?) {
+        let in_file = path
+            .iter()
+            .try_fold(raw, |node, key| node.get(key))
+            .is_some();
+        let source = if in_file { "file" } else { "default" };
+        found.insert(path, (value, source.to_string()));
+    }
+
+    // The environment with nothing set but `wanted`
+    let only = |wanted: &str| {
+        let (wanted, value) = (wanted.to_string(), lookup(wanted));
+        move |var: &str| value.clone().filter(|_| var == wanted)
+    };
+    for (_, _, _, var) in known_provider_templates() {
+        if !var.is_empty() {
+            layer(&mut cfg, &mut found, var, |c| {
+                apply_env_keys(c, only(var));
+                Ok(())
+            })?;
+        }
+    }
+
+    let mut names: Vec<&String> = cfg.providers.keys().collect();
+    names.sort();
+    let mut vars = vec!["NIKO_PROVIDER".to_string()];
+    vars.extend(
+        names
+            .iter()
+            .map(|name| format!("NIKO_{}_MODEL", name.to_uppercase().replace('-', "_"))),
+    );
+    vars.push("NIKO_MODEL".to_string());
+    for var in &vars {
+        layer(&mut cfg, &mut found, var, |c| {
+            apply_env_overrides(c, only(var));
+            Ok(())
+        })?;
+    }
+
+    if let Some(host) = host {
+        layer(&mut cfg, &mut found, "safety.by_host", |c| {
+            apply_host_safety(&mut c.safety, host);
+            Ok(())
+        })?;
+    }
+    layer(&mut cfg, &mut found, "api_key file", resolve_api_key_files)?;
+
+    Ok(found
+        .into_iter()
+        .map(|(path, (value, source))| Sourced {
+            key: path.join("."),
+            value,
+            source,
+        })
+        .collect())
+}
+
+/// Apply one layer to `cfg`, crediting whatever it changes in `found` to
+/// `source`
+fn layer(
+    cfg: &mut Config,
+    found: &mut BTreeMap<Vec<String>, (serde_json::Value, String)>,
+    source: &str,
+    apply: impl FnOnce(&mut Config) -> Result<()>,
+) -> Result<()> {
+    apply(cfg)?;
+    for (path, value) in flatten(&serde_json::to_value(&*cfg)?) {
+        match found.get(&path) {
+            Some((old, _)) if *old == value => {}
+            _ => {
+                found.insert(path, (value, source.to_string()));
+            }
+        }
+    }
+    Ok(())
+}
+
+/// The leaves of `value` with their paths; lists count as one value
+fn flatten(value: &serde_json::Value) -> Vec<(Vec<String>, serde_json::Value)> {
+    let mut out = Vec::new();
+    let mut stack = vec![(Vec::new(), value)];
+    while let Some((path, value)) = stack.pop() {
+        match value.as_object() {
+            Some(object) => {
+                for (key, child) in object {
+                    let mut child_path = path.clone();
+                    child_path.push(key.clone());
+                    stack.push((child_path, child));
+                }
+            }
+            None => out.push((path, value.clone())),
+        }
+    }
+    out
+}
+
+/// Merge every `safety.by_host` entry whose pattern matches `host`, in
+/// sorted pattern order (so `*` comes before `prod-*`): block lists add up,
+/// and later settings win
+fn apply_host_safety(safety: &mut SafetyConfig, host: &str) {
+    let matching: Vec<HostSafety> = safety
+        .by_host
+        .iter()
+        .filter(|(pattern, _)| host_matches(pattern, host))
+        .map(|(_, overrides)| overrides.clone())
+        .collect();
+
+    for overrides in matching {
+        for blocked in overrides.blocked_commands {
+            if !safety.blocked_commands.contains(&blocked) {
+                safety.blocked_commands.push(blocked);
+            }
+        }
+        if let Some(confirm) = overrides.require_confirm_dangerous {
+            safety.require_confirm_dangerous = confirm;
+        }
+        if let Some(strip) = overrides.strip_sudo {
+            safety.strip_sudo = strip;
+        }
+        if let Some(check) = overrides.check_paths {
+            safety.check_paths = check;
+        }
+    }
+}
+
+/// Case-insensitive match of a hostname against a pattern where `*` is
+/// any run of characters and `?` is one character
+fn host_matches(pattern: &str, host: &str) -> bool {
+    fn matches(pattern: &[char], host: &[char]) -> bool {
+        match pattern.split_first() {
+            None => host.is_empty(),
+            Some(('*', rest)) => (0..=host.len()).any(|i| matches(rest, &host[i..])),
+            Some((&p, rest)) => host
+                .split_first()
+                .is_some_and(|(&h, tail)| (p == '?' || p == h) && matches(rest, tail)),
+        }
+    }
+    let pattern: Vec<char> = pattern.trim().to_lowercase().chars().collect();
+    let host: Vec<char> = host.trim().to_lowercase().chars().collect();
+    matches(&pattern, &host)
+}
+
+/// Per-shell overrides that never touch the file:
+/// `NIKO_PROVIDER` picks the active provider, `NIKO_<PROVIDER>_MODEL`
+/// (e.g. `NIKO_OPENAI_MODEL`) sets that provider's model, and `NIKO_MODEL`
+/// sets the active provider's model, winning over the per-provider variable.
+/// `--provider` still beats `NIKO_PROVIDER`, since it is applied later.
+fn apply_env_overrides(cfg: &mut Config, lookup: impl Fn(&str) -> Option<String>) {
+    let lookup = |var: &str| {
+        lookup(var)
+            .map(|v| v.trim().to_string())
+            .filter(|v| !v.is_empty())
+    };
+
+    if let Some(provider) = lookup("NIKO_PROVIDER") {
+        cfg.active_provider = provider;
+    }
+
+    for (name, pcfg) in cfg.providers.iter_mut() {
+        let var = format!("NIKO_{}_MODEL", name.to_uppercase().replace('-', "_"));
+        if let Some(model) = lookup(&var) {
+            pcfg.model = model;
+        }
+    }
+
+    if let Some(model) = lookup("NIKO_MODEL") {
+        if let Some(pcfg) = cfg.providers.get_mut(&cfg.active_provider) {
+            pcfg.model = model;
+        }
+    }
+}
+
+/// Read the config file as written, creating it with defaults if missing.
+/// Mutators use this so resolved secrets are never saved back.
+fn read_config() -> Result<Config> {
     let path = config_path();
-    let dir = config_dir();
+    let dir = path.parent().map(PathBuf::from).unwrap_or_else(config_dir);
 
-    fs::create_dir_all(&dir)
-        .with_context(|| format!("Failed to create config directory: {}", dir.display()))?;
+    create_private_dir(&dir)?;
 
     if !path.exists() {
         let cfg = default_config();
@@ -224,50 +869,173 @@ pub fn load() -> Result<Config> {
     let content = fs::read_to_string(&path)
         .with_context(|| format!("Failed to read config: {}", path.display()))?;
 
-    let mut cfg: Config =
-        serde_yaml::from_str(&content).with_context(|| "Failed to parse config YAML")?;
+    serde_yaml::from_str(&content).with_context(|| "Failed to parse config YAML")
+}
 
-    // Overlay env vars on matching providers
-    for (name, _, _, env_var) in known_provider_templates() {
-        if !env_var.is_empty() {
-            if let Ok(key) = std::env::var(env_var) {
-                if let Some(p) = cfg.providers.get_mut(name) {
-                    if p.api_key.is_empty() {
-                        p.api_key = key;
-                    }
-                }
-            }
+/// Replace `file:/path` API keys with the trimmed contents of that file
+fn resolve_api_key_files(cfg: &mut Config) -> Result<()> {
+    for (name, p) in cfg.providers.iter_mut() {
+        let Some(path) = p.api_key.strip_prefix("file:") else {
+            continue;
+        };
+        let path = path.trim();
+        let key = fs::read_to_string(path)
+            .with_context(|| format!("Failed to read API key for '{}' from {}", name, path))?;
+        let key = key.trim();
+        if key.is_empty() {
+            anyhow::bail!("API key file for '{}' is empty: {}", name, path);
         }
+        p.api_key = key.to_string();
     }
-
-    Ok(cfg)
+    Ok(())
 }
 
 pub fn save(cfg: &Config) -> Result<()> {
     let path = config_path();
-    let dir = config_dir();
+    let dir = path.parent().map(PathBuf::from).unwrap_or_else(config_dir);
 
-    fs::create_dir_all(&dir)
-        .with_context(|| format!("Failed to create config directory: {}", dir.display()))?;
+    create_private_dir(&dir)?;
 
     let yaml = serde_yaml::to_string(cfg).with_context(|| "Failed to serialize config")?;
 
-    fs::write(&path, yaml)
+    write_private(&path, yaml.as_bytes())
         .with_context(|| format!("Failed to write config: {}", path.display()))?;
 
     Ok(())
 }
 
+/// Rewrite the config file with every field spelled out: whatever the file
+/// leaves out (say, options added since it was written) gets its default,
+/// and everything it does set, API keys included, is kept. The previous
+/// file is saved next to it as `config.yaml.bak`, since comments don't
+/// survive the rewrite. Returns the keys that were added.
+pub fn upgrade() -> Result<Vec<String>> {
+    let path = config_path();
+    if !path.exists() {
+        read_config()?;
+        return Ok(Vec::new());
+    }
+
+    let content = fs::read_to_string(&path)
+        .with_context(|| format!("Failed to read config: {}", path.display()))?;
+    let before: serde_json::Value =
+        serde_yaml::from_str(&content).with_context(|| "Failed to parse config YAML")?;
+    let mut cfg: Config =
+        serde_yaml::from_str(&content).with_context(|| "Failed to parse config YAML")?;
+    fill_defaults(&mut cfg);
+
+    let after = serde_json::to_value(&cfg).with_context(|| "Failed to serialize config")?;
+    let mut added = Vec::new();
+    missing_keys(&before, &after, "", &mut added);
+    if added.is_empty() {
+        return Ok(added);
+    }
+
+    let backup = path.with_extension("yaml.bak");
+    write_private(&backup, content.as_bytes())
+        .with_context(|| format!("Failed to write backup: {}", backup.display()))?;
+    save(&cfg)?;
+    Ok(added)
+}
+
+/// Defaults that serde can't supply field by field: the active provider,
+/// the default providers when none are set up, and the kind and endpoint
+/// of well-known providers
+fn fill_defaults(cfg: &mut Config) {
+    let defaults = default_config();
+    if cfg.active_provider.is_empty() {
+        cfg.active_provider = defaults.active_provider;
+    }
+    if cfg.providers.is_empty() {
+        cfg.providers = defaults.providers;
+    }
+    for (name, kind, base_url, _) in known_provider_templates() {
+        if let Some(p) = cfg.providers.get_mut(name) {
+            if p.kind.is_empty() {
+                p.kind = kind.into();
+            }
+            if p.base_url.is_empty() {
+                p.base_url = base_url.into();
+            }
+        }
+    }
+}
+
+/// Dotted paths of the keys in `after` that `before` lacks or leaves empty
+fn missing_keys(
+    before: &serde_json::Value,
+    after: &serde_json::Value,
+    prefix: &str,
+    out: &mut Vec<String>,
+) {
+    let Some(after) = after.as_object() else {
+        return;
+    };
+    for (key, value) in after {
+        let path = if prefix.is_empty() {
+            key.clone()
+        } else {
+            format!("{}.{}", prefix, key)
+        };
+        match before.get(key) {
+            Some(old) if value.is_object() && old.is_object() => {
+                missing_keys(old, value, &path, out)
+            }
+            Some(old) if old == value => {}
+            Some(old) if !is_blank(old) => {}
+            _ => out.push(path),
+        }
+    }
+}
+
+fn is_blank(value: &serde_json::Value) -> bool {
+    match value {
+        serde_json::Value::Null => true,
+        serde_json::Value::String(s) => s.is_empty(),
+        _ => false,
+    }
+}
+
 /// Cached global config
 pub fn get() -> &'static Config {
     CONFIG.get_or_init(|| load().unwrap_or_else(|_| default_config()))
 }
 
+/// The command prompt template for `provider`: its `system_template`
+/// option, else `prompt.system_template`. `None` means the built-in prompt.
+pub fn system_template(cfg: &Config, provider: &str) -> Option<String> {
+    cfg.providers
+        .get(provider)
+        .and_then(|p| p.options.get("system_template"))
+        .filter(|t| !t.trim().is_empty())
+        .or_else(|| Some(&cfg.prompt.system_template).filter(|t| !t.trim().is_empty()))
+        .cloned()
+}
+
+/// Whether niko may download and run the Ollama installer: the
+/// `ollama.auto_install` option (default true), unless
+/// `$NIKO_NO_AUTO_INSTALL` is set. `env` looks up environment variables.
+pub fn auto_install_allowed(cfg: &Config, env: impl Fn(&str) -> Option<String>) -> bool {
+    let vetoed =
+        env("NIKO_NO_AUTO_INSTALL").is_some_and(|v| !matches!(v.trim(), "" | "0" | "false"));
+    let configured = cfg
+        .providers
+        .get("ollama")
+        .and_then(|p| p.options.get("auto_install"))
+        .is_none_or(|v| {
+            !matches!(
+                v.trim().to_lowercase().as_str(),
+                "false" | "0" | "no" | "off"
+            )
+        });
+    configured && !vetoed
+}
+
 // ─── Mutators ───────────────────────────────────────────────────────────────
 
 /// Set the active provider
 pub fn set_active_provider(name: &str) -> Result<()> {
-    let mut cfg = load()?;
+    let mut cfg = read_config()?;
     if !cfg.providers.contains_key(name) {
         anyhow::bail!(
             "Provider '{}' not configured.\nRun 'niko settings configure' to add it.",
@@ -280,29 +1048,251 @@ pub fn set_active_provider(name: &str) -> Result<()> {
 
 /// Add or update a provider
 pub fn upsert_provider(name: &str, pcfg: ProviderConfig) -> Result<()> {
-    let mut cfg = load()?;
+    let mut cfg = read_config()?;
     cfg.providers.insert(name.to_string(), pcfg);
     save(&cfg)
 }
 
 /// Set a specific field on a provider
 pub fn set_provider_field(provider: &str, field: &str, value: &str) -> Result<()> {
-    let mut cfg = load()?;
+    let mut cfg = read_config()?;
     let p = cfg.providers.entry(provider.to_string()).or_default();
 
     match field {
         "api_key" => p.api_key = value.into(),
-        "base_url" => p.base_url = value.into(),
+        "base_url" => p.base_url = normalize_base_url(value)?,
         "model" => p.model = value.into(),
         "kind" => p.kind = value.into(),
         _ => {
-            p.options.insert(field.to_string(), value.to_string());
+            if let Some(name) = field.strip_prefix("headers.") {
+                set_header(&mut p.headers, name, value)?;
+            } else {
+                p.options.insert(field.to_string(), value.to_string());
+            }
         }
     }
 
     save(&cfg)
 }
 
+/// Set one of a provider's `headers`, replacing it whatever case it was
+/// written in (header names are case-insensitive); an empty value removes it
+fn set_header(headers: &mut BTreeMap<String, String>, name: &str, value: &str) -> Result<()> {
+    let name = name.trim();
+    if name.is_empty() {
+        anyhow::bail!("Missing header name (e.g. openai.headers.X-Tenant)");
+    }
+    headers.retain(|existing, _| !existing.eq_ignore_ascii_case(name));
+    if !value.trim().is_empty() {
+        headers.insert(name.to_string(), value.trim().to_string());
+    }
+    Ok(())
+}
+
+/// Change `provider`'s model from `from` to `to`, only if the file still
+/// names `from`. Returns whether it did.
+pub fn replace_provider_model(provider: &str, from: &str, to: &str) -> Result<bool> {
+    let mut cfg = read_config()?;
+    match cfg.providers.get_mut(provider) {
+        Some(p) if p.model == from => p.model = to.to_string(),
+        _ => return Ok(false),
+    }
+    save(&cfg)?;
+    Ok(true)
+}
+
+/// Set a `safety.<field>` value. `rewrite` and `blocked_commands` are lists
+/// whose entries may contain commas, so they're edited in the YAML directly.
+pub fn set_safety_field(field: &str, value: &str) -> Result<()> {
+    let mut cfg = read_config()?;
+
+    match field {
+        "strip_sudo" => cfg.safety.strip_sudo = parse_bool(field, value)?,
+        "require_confirm_dangerous" => {
+            cfg.safety.require_confirm_dangerous = parse_bool(field, value)?
+        }
+        "check_paths" => cfg.safety.check_paths = parse_bool(field, value)?,
+        "retype_critical" => cfg.safety.retype_critical = parse_bool(field, value)?,
+        "print_only" => cfg.safety.print_only = parse_bool(field, value)?,
+        "max_command_length" => {
+            cfg.safety.max_command_length = value.trim().parse().map_err(|_| {
+                anyhow::anyhow!("max_command_length must be a number (0 = no limit)")
+            })?;
+        }
+        _ => anyhow::bail!(
+            "Unknown safety setting: {}\nAvailable: strip_sudo, require_confirm_dangerous, \
+             check_paths, max_command_length, retype_critical, print_only",
+            field
+        ),
+    }
+
+    save(&cfg)
+}
+
+/// Set a `ui.<field>` value
+pub fn set_ui_field(field: &str, value: &str) -> Result<()> {
+    let mut cfg = read_config()?;
+
+    match field {
+        "color" => cfg.ui.color = parse_bool(field, value)?,
+        "verbose" => cfg.ui.verbose = parse_bool(field, value)?,
+        "tool_check" => cfg.ui.tool_check = parse_bool(field, value)?,
+        "interactive_tools" => {
+            cfg.ui.interactive_tools = edit_list(&cfg.ui.interactive_tools, value)
+        }
+        "known_commands" => cfg.ui.known_commands = edit_list(&cfg.ui.known_commands, value),
+        "tool_check_shell" => cfg.ui.tool_check_shell = parse_bool(field, value)?,
+        _ => anyhow::bail!(
+            "Unknown ui setting: {}\nAvailable: color, verbose, tool_check, known_commands, \
+             tool_check_shell, interactive_tools",
+            field
+        ),
+    }
+
+    save(&cfg)
+}
+
+/// Set a `prompt.<field>` value
+pub fn set_prompt_field(field: &str, value: &str) -> Result<()> {
+    let mut cfg = read_config()?;
+
+    match field {
+        "context_tools" => cfg.prompt.context_tools = split_list(value),
+        "gnu_coreutils" => cfg.prompt.gnu_coreutils = parse_bool(field, value)?,
+        "example_top_k" => {
+            cfg.prompt.example_top_k = value
+                .trim()
+                .parse()
+                .map_err(|_| anyhow::anyhow!("example_top_k must be a number (0 = all)"))?;
+        }
+        "embedding_model" => cfg.prompt.embedding_model = value.trim().to_string(),
+        "system_template" => cfg.prompt.system_template = value.to_string(),
+        "expand_provider" => cfg.prompt.expand_provider = value.trim().to_string(),
+        "max_tools" => {
+            cfg.prompt.max_tools = value
+                .trim()
+                .parse()
+                .map_err(|_| anyhow::anyhow!("max_tools must be a number (0 = all)"))?;
+        }
+        _ => anyhow::bail!(
+            "Unknown prompt setting: {}\nAvailable: context_tools, gnu_coreutils, \
+             example_top_k, embedding_model, system_template, expand_provider, max_tools",
+            field
+        ),
+    }
+
+    save(&cfg)
+}
+
+/// Set a `generation.<field>` value
+pub fn set_generation_field(field: &str, value: &str) -> Result<()> {
+    let mut cfg = read_config()?;
+
+    match field {
+        "max_concurrent" => {
+            cfg.generation.max_concurrent = value
+                .trim()
+                .parse()
+                .ok()
+                .filter(|n| *n > 0)
+                .ok_or_else(|| anyhow::anyhow!("max_concurrent must be a positive number"))?;
+        }
+        _ => anyhow::bail!(
+            "Unknown generation setting: {}\nAvailable: max_concurrent",
+            field
+        ),
+    }
+
+    save(&cfg)
+}
+
+/// Set a `hooks.<field>` value; an empty value removes the hook
+pub fn set_hooks_field(field: &str, value: &str) -> Result<()> {
+    let mut cfg = read_config()?;
+
+    match field {
+        "post_generate" => cfg.hooks.post_generate = value.trim().to_string(),
+        "assess" => cfg.hooks.assess = value.trim().to_string(),
+        _ => anyhow::bail!(
+            "Unknown hooks setting: {}\nAvailable: post_generate, assess",
+            field
+        ),
+    }
+
+    save(&cfg)
+}
+
+/// Tidy a provider URL so `base_url + "/api/chat"` is always well formed:
+/// `localhost:11434/` becomes `http://localhost:11434`. Rejects anything
+/// without a usable host, a non-numeric port or a scheme other than http(s).
+pub fn normalize_base_url(value: &str) -> Result<String> {
+    let value = value.trim();
+    if value.is_empty() {
+        anyhow::bail!("URL is empty");
+    }
+
+    let url = if value.contains("://") {
+        value.to_string()
+    } else {
+        format!("http://{}", value)
+    };
+    let url = url.trim_end_matches('/').to_string();
+
+    let (scheme, rest) = url.split_once("://").unwrap_or_default();
+    if !matches!(scheme.to_lowercase().as_str(), "http" | "https") {
+        anyhow::bail!("Invalid URL '{}': scheme must be http or https", value);
+    }
+
+    // IPv6 literals ([::1]:11434) are passed through without a port check
+    let authority = rest.split('/').next().unwrap_or_default();
+    let (host, port) = match authority.rsplit_once(':') {
+        Some((host, port)) if !authority.starts_with('[') => (host, Some(port)),
+        _ => (authority, None),
+    };
+    if host.is_empty() || host.contains(char::is_whitespace) {
+        anyhow::bail!("Invalid URL '{}': missing or malformed host", value);
+    }
+    if port.is_some_and(|p| p.parse::<u16>().is_err()) {
+        anyhow::bail!("Invalid URL '{}': port must be a number", value);
+    }
+
+    Ok(url)
+}
+
+/// Parse an on/off setting value
+pub fn parse_bool(field: &str, value: &str) -> Result<bool> {
+    match value.trim() {
+        "true" | "on" | "yes" | "1" => Ok(true),
+        "false" | "off" | "no" | "0" => Ok(false),
+        _ => anyhow::bail!("{} must be true or false", field),
+    }
+}
+
+/// Split a comma-separated setting into trimmed, non-empty items
+pub fn split_list(value: &str) -> Vec<String> {
+    value
+        .split(',')
+        .map(str::trim)
+        .filter(|s| !s.is_empty())
+        .map(String::from)
+        .collect()
+}
+
+/// A list setting after `value`: a leading `+` adds its items to `current`
+/// (`+ssh,mc`), anything else replaces the list
+fn edit_list(current: &[String], value: &str) -> Vec<String> {
+    let Some(extra) = value.trim().strip_prefix('+') else {
+        return split_list(value);
+    };
+    let mut list = current.to_vec();
+    for item in split_list(extra) {
+        if !list.contains(&item) {
+            list.push(item);
+        }
+    }
+    list
+}
+
 /// Get the active provider config
 pub fn active_provider() -> Result<(String, ProviderConfig)> {
     let cfg = load()?;
@@ -330,4 +1320,404 @@ mod tests {
         assert_eq!(ollama.kind, "ollama");
         assert_eq!(ollama.base_url, "http://127.0.0.1:11434");
     }
+
+    #[test]
+    fn base_urls_are_normalized() {
+        assert_eq!(
+            normalize_base_url("http://localhost:11434/").unwrap(),
+            "http://localhost:11434"
+        );
+        assert_eq!(
+            normalize_base_url(" 127.0.0.1:11434 ").unwrap(),
+            "http://127.0.0.1:11434"
+        );
+        assert_eq!(
+            normalize_base_url("https://api.example.com/v1/").unwrap(),
+            "https://api.example.com/v1"
+        );
+    }
+
+    #[test]
+    fn bad_base_urls_are_rejected() {
+        for bad in [
+            "",
+            "ftp://host",
+            "http://",
+            "http://host:port",
+            "http://my host",
+        ] {
+            assert!(
+                normalize_base_url(bad).is_err(),
+                "{:?} should be rejected",
+                bad
+            );
+        }
+    }
+
+    #[test]
+    fn env_overrides_provider_and_models() {
+        let mut cfg = default_config();
+        cfg.providers.insert(
+            "openai".into(),
+            ProviderConfig {
+                kind: "openai_compat".into(),
+                model: "gpt-4o-mini".into(),
+                ..Default::default()
+            },
+        );
+
+        let env: HashMap<&str, &str> = [
+            ("NIKO_PROVIDER", "openai"),
+            ("NIKO_MODEL", "gpt-4o"),
+            ("NIKO_OLLAMA_MODEL", "llama3.2:1b"),
+        ]
+        .into();
+        apply_env_overrides(&mut cfg, |var| env.get(var).map(|v| v.to_string()));
+
+        assert_eq!(cfg.active_provider, "openai");
+        assert_eq!(cfg.providers["openai"].model, "gpt-4o");
+        assert_eq!(cfg.providers["ollama"].model, "llama3.2:1b");
+    }
+
+    #[test]
+    fn remote_host_merges_matching_patterns() {
+        let mut cfg = default_config();
+        cfg.ssh.by_host.insert(
+            "*".into(),
+            RemoteHost {
+                os: Some("linux".into()),
+                shell: Some("bash".into()),
+                ..Default::default()
+            },
+        );
+        cfg.ssh.by_host.insert(
+            "mac-*".into(),
+            RemoteHost {
+                os: Some("macos".into()),
+                tools: vec!["brew".into()],
+                ..Default::default()
+            },
+        );
+
+        let mac = remote_host(&cfg, "me@mac-mini");
+        assert_eq!(mac.os.as_deref(), Some("macos"));
+        assert_eq!(mac.shell.as_deref(), Some("bash"));
+        assert_eq!(mac.tools, vec!["brew"]);
+
+        let web = remote_host(&cfg, "web1");
+        assert_eq!(web.os.as_deref(), Some("linux"));
+        assert!(web.tools.is_empty());
+    }
+
+    #[test]
+    fn sources_credit_the_layer_that_set_each_value() {
+        let mut cfg = default_config();
+        cfg.providers.insert(
+            "openai".into(),
+            ProviderConfig {
+                kind: "openai_compat".into(),
+                model: "gpt-4o-mini".into(),
+                ..Default::default()
+            },
+        );
+        let raw = serde_json::json!({
+            "active_provider": "ollama",
+            "providers": { "openai": { "kind": "openai_compat", "model": "gpt-4o-mini" } }
+        });
+        let env: HashMap<&str, &str> = [
+            ("NIKO_PROVIDER", "openai"),
+            ("NIKO_MODEL", "gpt-4o"),
+            ("OPENAI_API_KEY", "sk-env"),
+        ]
+        .into();
+
+        let sources =
+            sources_from(&raw, cfg, |var| env.get(var).map(|v| v.to_string()), None).unwrap();
+        let source = |key: &str| {
+            let found = sources.iter().find(|s| s.key == key).unwrap();
+            (found.value.clone(), found.source.as_str())
+        };
+        assert_eq!(
+            source("active_provider"),
+            ("openai".into(), "NIKO_PROVIDER")
+        );
+        assert_eq!(
+            source("providers.openai.model"),
+            ("gpt-4o".into(), "NIKO_MODEL")
+        );
+        assert_eq!(
+            source("providers.openai.api_key"),
+            ("sk-env".into(), "OPENAI_API_KEY")
+        );
+        assert_eq!(source("providers.openai.kind").1, "file");
+        assert_eq!(source("providers.ollama.base_url").1, "default");
+        assert_eq!(source("safety.strip_sudo").1, "default");
+    }
+
+    #[test]
+    fn empty_env_overrides_are_ignored() {
+        let mut cfg = default_config();
+        apply_env_overrides(&mut cfg, |_| Some("  ".to_string()));
+        assert_eq!(cfg.active_provider, "ollama");
+    }
+
+    #[test]
+    fn host_patterns_match_case_insensitively() {
+        assert!(host_matches("prod-*", "prod-web-01"));
+        assert!(host_matches("PROD-*", "prod-db"));
+        assert!(host_matches("db-?", "db-3"));
+        assert!(host_matches("*", "laptop"));
+        assert!(!host_matches("prod-*", "staging-prod-1"));
+        assert!(!host_matches("db-?", "db-10"));
+    }
+
+    #[test]
+    fn matching_host_overrides_extend_the_block_list() {
+        let mut safety = SafetyConfig {
+            blocked_commands: vec!["rm -rf /".into()],
+            ..Default::default()
+        };
+        safety.by_host.insert(
+            "prod-*".into(),
+            HostSafety {
+                blocked_commands: vec!["kubectl delete".into()],
+                strip_sudo: Some(true),
+                ..Default::default()
+            },
+        );
+        safety.by_host.insert(
+            "*".into(),
+            HostSafety {
+                check_paths: Some(false),
+                ..Default::default()
+            },
+        );
+        let mut laptop = safety.clone();
+
+        apply_host_safety(&mut safety, "prod-web-01");
+        assert_eq!(safety.blocked_commands, vec!["rm -rf /", "kubectl delete"]);
+        assert!(safety.strip_sudo);
+        assert!(!safety.check_paths);
+
+        apply_host_safety(&mut laptop, "my-laptop");
+        assert_eq!(laptop.blocked_commands, vec!["rm -rf /"]);
+        assert!(!laptop.strip_sudo);
+        assert!(!laptop.check_paths);
+    }
+
+    #[test]
+    fn auto_install_can_be_turned_off_by_config_or_env() {
+        let mut cfg = default_config();
+        assert!(auto_install_allowed(&cfg, |_| None));
+        assert!(auto_install_allowed(&cfg, |_| Some("0".into())));
+        assert!(!auto_install_allowed(&cfg, |_| Some("1".into())));
+
+        cfg.providers
+            .get_mut("ollama")
+            .unwrap()
+            .options
+            .insert("auto_install".into(), "False".into());
+        assert!(!auto_install_allowed(&cfg, |_| None));
+    }
+
+    #[test]
+    fn list_settings_are_split_and_trimmed() {
+        assert_eq!(split_list(" git, rg,,fd "), vec!["git", "rg", "fd"]);
+        assert!(split_list("").is_empty());
+    }
+
+    #[test]
+    fn file_api_keys_are_read_and_trimmed() {
+        let path = std::env::temp_dir().join(format!("niko-key-{}", std::process::id()));
+        fs::write(&path, "sk-test-123\n").unwrap();
+
+        let mut cfg = default_config();
+        cfg.providers.insert(
+            "openai".into(),
+            ProviderConfig {
+                api_key: format!("file:{}", path.display()),
+                ..Default::default()
+            },
+        );
+        resolve_api_key_files(&mut cfg).unwrap();
+        let _ = fs::remove_file(&path);
+
+        assert_eq!(cfg.providers["openai"].api_key, "sk-test-123");
+    }
+
+    #[test]
+    fn missing_api_key_file_is_an_error() {
+        let mut cfg = default_config();
+        cfg.providers.insert(
+            "openai".into(),
+            ProviderConfig {
+                api_key: "file:/nonexistent/niko/secret".into(),
+                ..Default::default()
+            },
+        );
+        let err = resolve_api_key_files(&mut cfg).unwrap_err();
+        assert!(format!("{:#}", err).contains("/nonexistent/niko/secret"));
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn private_files_are_0600_and_refuse_escaping_symlinks() {
+        use std::os::unix::fs::{symlink, PermissionsExt};
+
+        let root = std::env::temp_dir().join(format!("niko-private-{}", std::process::id()));
+        let dir = root.join("niko");
+        create_private_dir(&dir).unwrap();
+        let mode = |p: &Path| fs::metadata(p).unwrap().permissions().mode() & 0o777;
+        assert_eq!(mode(&dir), 0o700);
+
+        let config = dir.join("config.yaml");
+        fs::write(&config, "old").unwrap();
+        fs::set_permissions(&config, fs::Permissions::from_mode(0o644)).unwrap();
+        write_private(&config, b"api_key: secret").unwrap();
+        assert_eq!(mode(&config), 0o600);
+
+        // A link within the directory is fine, one leaving it is not
+        symlink("config.yaml", dir.join("inside")).unwrap();
+        write_private(&dir.join("inside"), b"x").unwrap();
+        symlink(root.join("outside"), dir.join("escape")).unwrap();
+        let err = write_private(&dir.join("escape"), b"x").unwrap_err();
+        assert!(err.to_string().contains("Refusing to write"));
+        assert!(!root.join("outside").exists());
+
+        // The open itself never follows a link, even one planted late
+        use std::os::unix::fs::OpenOptionsExt;
+        let late = fs::OpenOptions::new()
+            .write(true)
+            .custom_flags(O_NOFOLLOW)
+            .open(dir.join("inside"));
+        assert!(late.is_err());
+
+        // An existing directory is tightened, not just a new one
+        fs::set_permissions(&dir, fs::Permissions::from_mode(0o755)).unwrap();
+        restrict_dir(&dir).unwrap();
+        assert_eq!(mode(&dir), 0o700);
+
+        fs::remove_dir_all(&root).unwrap();
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn temp_files_are_private_and_never_reused() {
+        use std::os::unix::fs::PermissionsExt;
+
+        let mode = |p: &Path| fs::metadata(p).unwrap().permissions().mode() & 0o777;
+        let (a, b) = (
+            private_temp_dir("niko-test").unwrap(),
+            private_temp_dir("niko-test").unwrap(),
+        );
+        assert_ne!(a, b);
+        assert_eq!(mode(&a), 0o700);
+
+        let buffer = a.join("buffer.sh");
+        create_private(&buffer, b"ls\n").unwrap();
+        assert_eq!(mode(&buffer), 0o600);
+        assert!(create_private(&buffer, b"rm -rf ~\n").is_err());
+        assert_eq!(fs::read_to_string(&buffer).unwrap(), "ls\n");
+
+        fs::remove_dir_all(&a).unwrap();
+        fs::remove_dir_all(&b).unwrap();
+    }
+
+    #[test]
+    fn provider_system_template_wins_over_the_global_one() {
+        let mut cfg = default_config();
+        assert_eq!(system_template(&cfg, "ollama"), None);
+
+        cfg.prompt.system_template = "global {os}".into();
+        assert_eq!(
+            system_template(&cfg, "ollama").as_deref(),
+            Some("global {os}")
+        );
+
+        cfg.providers
+            .entry("ollama".into())
+            .or_default()
+            .options
+            .insert("system_template".into(), "terse {shell}".into());
+        assert_eq!(
+            system_template(&cfg, "ollama").as_deref(),
+            Some("terse {shell}")
+        );
+        assert_eq!(
+            system_template(&cfg, "openai").as_deref(),
+            Some("global {os}")
+        );
+    }
+
+    #[test]
+    fn flags_known_providers_pointed_at_each_other() {
+        assert_eq!(
+            endpoint_owner("openai", "https://api.deepseek.com/v1/"),
+            Some("deepseek")
+        );
+        assert_eq!(endpoint_owner("openai", "https://api.openai.com/v1"), None);
+        assert_eq!(endpoint_owner("openai", "https://llm.internal/v1"), None);
+        // Custom names may proxy anything
+        assert_eq!(endpoint_owner("work", "https://api.deepseek.com/v1"), None);
+    }
+
+    #[test]
+    fn upgrade_fills_defaults_and_keeps_what_is_set() {
+        let before = serde_json::json!({
+            "active_provider": "openai",
+            "providers": {"openai": {"api_key": "sk-test", "model": "gpt-4o"}},
+            "safety": {"strip_sudo": true},
+        });
+        let mut cfg: Config = serde_json::from_value(before.clone()).unwrap();
+        fill_defaults(&mut cfg);
+
+        let openai = &cfg.providers["openai"];
+        assert_eq!(openai.api_key, "sk-test");
+        assert_eq!(openai.kind, "openai_compat");
+        assert_eq!(openai.base_url, "https://api.openai.com/v1");
+        assert!(cfg.safety.strip_sudo);
+        assert_eq!(cfg.safety.max_command_length, 2000);
+
+        let mut added = Vec::new();
+        missing_keys(
+            &before,
+            &serde_json::to_value(&cfg).unwrap(),
+            "",
+            &mut added,
+        );
+        for key in [
+            "providers.openai.kind",
+            "safety.max_command_length",
+            "hooks",
+        ] {
+            assert!(added.iter().any(|k| k == key), "{} not added", key);
+        }
+        assert!(!added.iter().any(|k| k == "providers.openai.api_key"));
+        assert!(!added.iter().any(|k| k == "safety.strip_sudo"));
+        assert!(!added.iter().any(|k| k == "active_provider"));
+    }
+
+    #[test]
+    fn headers_are_replaced_case_insensitively_and_removed_when_empty() {
+        let mut headers = BTreeMap::new();
+        set_header(&mut headers, "X-Tenant", "acme").unwrap();
+        set_header(&mut headers, "x-tenant", "globex").unwrap();
+        assert_eq!(headers.len(), 1);
+        assert_eq!(headers["x-tenant"], "globex");
+
+        set_header(&mut headers, "X-TENANT", "").unwrap();
+        assert!(headers.is_empty());
+        assert!(set_header(&mut headers, " ", "v").is_err());
+    }
+
+    #[test]
+    fn list_settings_add_with_a_plus_and_replace_otherwise() {
+        let current = vec!["vim".to_string(), "less".to_string()];
+        assert_eq!(
+            edit_list(&current, "+ssh, less,mc"),
+            ["vim", "less", "ssh", "mc"]
+        );
+        assert_eq!(edit_list(&current, "htop"), ["htop"]);
+        assert!(edit_list(&current, "").is_empty());
+    }
 }
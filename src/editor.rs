@@ -0,0 +1,57 @@
+use std::env;
+use std::fs;
+use std::process::Command;
+
+use anyhow::{bail, Context, Result};
+
+use crate::config;
+
+/// Open `initial` in the user's editor and return the saved buffer.
+///
+/// The editor is taken from $VISUAL, then $EDITOR, falling back to
+/// notepad on Windows and vi elsewhere. Values with arguments such as
+/// `code --wait` are supported.
+pub fn edit_text(initial: &str, suffix: &str) -> Result<String> {
+    let dir = config::private_temp_dir("niko-edit")?;
+    let path = dir.join(format!("buffer{}", suffix));
+    if let Err(e) = config::create_private(&path, initial.as_bytes()) {
+        let _ = fs::remove_dir_all(&dir);
+        return Err(e);
+    }
+
+    let editor = editor_command();
+    let mut parts = editor.split_whitespace();
+    let program = parts.next().unwrap_or("vi");
+
+    let status = Command::new(program)
+        .args(parts)
+        .arg(&path)
+        .status()
+        .with_context(|| format!("Failed to launch editor '{}'", editor));
+
+    let content = fs::read_to_string(&path);
+    let _ = fs::remove_dir_all(&dir);
+
+    let status = status?;
+    if !status.success() {
+        bail!("Editor '{}' exited with {}", editor, status);
+    }
+
+    content.with_context(|| format!("Failed to read edited file: {}", path.display()))
+}
+
+fn editor_command() -> String {
+    for var in ["VISUAL", "EDITOR"] {
+        if let Ok(value) = env::var(var) {
+            if !value.trim().is_empty() {
+                return value;
+            }
+        }
+    }
+
+    if cfg!(target_os = "windows") {
+        "notepad".into()
+    } else {
+        "vi".into()
+    }
+}
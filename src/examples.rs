@@ -0,0 +1,156 @@
+use std::collections::HashMap;
+use std::fs;
+use std::path::PathBuf;
+
+use anyhow::{Context, Result};
+use colored::Colorize;
+
+use crate::config::{self, Example};
+use crate::llm::ollama::OllamaProvider;
+use crate::progress;
+
+const DEFAULT_EMBEDDING_MODEL: &str = "nomic-embed-text";
+
+/// The examples worth showing for `query`. With `prompt.example_top_k` set
+/// and more examples than that, only the K most similar by embedding are
+/// kept. Retrieval is an optimisation: if Ollama can't embed, the first K
+/// are used instead of failing the query.
+pub fn relevant(query: &str, examples: &[Example], verbose: bool) -> Vec<Example> {
+    let top_k = config::get().prompt.example_top_k;
+    if top_k == 0 || examples.len() <= top_k {
+        return examples.to_vec();
+    }
+
+    match nearest(query, examples, top_k) {
+        Ok(picked) => picked.into_iter().map(|i| examples[i].clone()).collect(),
+        Err(e) => {
+            if verbose {
+                progress::eprint_line(&format!(
+                    "{}",
+                    format!(
+                        "  example retrieval failed, using the first {}: {:#}",
+                        top_k, e
+                    )
+                    .dimmed()
+                ));
+            }
+            examples[..top_k].to_vec()
+        }
+    }
+}
+
+/// Indices of the `top_k` examples closest to the query
+fn nearest(query: &str, examples: &[Example], top_k: usize) -> Result<Vec<usize>> {
+    let cfg = &config::get().prompt;
+    let model = if cfg.embedding_model.is_empty() {
+        DEFAULT_EMBEDDING_MODEL
+    } else {
+        &cfg.embedding_model
+    };
+    let ollama = embedder()?;
+
+    let mut cache = load_cache();
+    let mut changed = false;
+    let mut vectors = Vec::with_capacity(examples.len());
+    for example in examples {
+        let key = format!("{}\t{}", model, example.query);
+        if !cache.contains_key(&key) {
+            cache.insert(key.clone(), ollama.embed(model, &example.query)?);
+            changed = true;
+        }
+        vectors.push(cache[&key].clone());
+    }
+    if changed {
+        // Losing the cache only costs a re-embed next time
+        let _ = save_cache(&cache);
+    }
+
+    let query = ollama.embed(model, query)?;
+    Ok(rank(&query, &vectors, top_k))
+}
+
+/// The Ollama provider from the config (by kind, preferring one named
+/// "ollama"), used for embeddings whichever provider generates
+fn embedder() -> Result<OllamaProvider> {
+    let providers = &config::get().providers;
+    let pcfg = providers
+        .get("ollama")
+        .filter(|p| p.kind == "ollama")
+        .or_else(|| providers.values().find(|p| p.kind == "ollama"))
+        .context("Ranking examples needs an Ollama provider for embeddings")?;
+    let base_url = if pcfg.base_url.is_empty() {
+        "http://127.0.0.1:11434"
+    } else {
+        &pcfg.base_url
+    };
+    OllamaProvider::new(base_url, &pcfg.model, HashMap::new())
+}
+
+/// Indices of the `top_k` vectors most similar to `query`, best first
+fn rank(query: &[f32], vectors: &[Vec<f32>], top_k: usize) -> Vec<usize> {
+    let mut scored: Vec<(usize, f32)> = vectors
+        .iter()
+        .enumerate()
+        .map(|(i, v)| (i, cosine(query, v)))
+        .collect();
+    scored.sort_by(|a, b| b.1.total_cmp(&a.1));
+    scored.into_iter().take(top_k).map(|(i, _)| i).collect()
+}
+
+fn cosine(a: &[f32], b: &[f32]) -> f32 {
+    if a.len() != b.len() {
+        return 0.0;
+    }
+    let dot: f32 = a.iter().zip(b).map(|(x, y)| x * y).sum();
+    let norm = |v: &[f32]| v.iter().map(|x| x * x).sum::<f32>().sqrt();
+    let denom = norm(a) * norm(b);
+    if denom == 0.0 {
+        0.0
+    } else {
+        dot / denom
+    }
+}
+
+/// Example embeddings keyed by `model<TAB>query`, in `~/.niko`
+fn cache_path() -> PathBuf {
+    config::config_dir().join("example-embeddings.json")
+}
+
+fn load_cache() -> HashMap<String, Vec<f32>> {
+    fs::read_to_string(cache_path())
+        .ok()
+        .and_then(|text| serde_json::from_str(&text).ok())
+        .unwrap_or_default()
+}
+
+fn save_cache(cache: &HashMap<String, Vec<f32>>) -> Result<()> {
+    let path = cache_path();
+    if let Some(dir) = path.parent() {
+        config::create_private_dir(dir)?;
+    }
+    config::write_private(&path, serde_json::to_string(cache)?.as_bytes())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn ranks_by_cosine_similarity() {
+        let vectors = vec![
+            vec![0.0, 1.0],
+            vec![1.0, 0.1],
+            vec![-1.0, 0.0],
+            vec![0.7, 0.7],
+        ];
+        assert_eq!(rank(&[1.0, 0.0], &vectors, 2), vec![1, 3]);
+        assert_eq!(rank(&[1.0, 0.0], &vectors, 10).len(), 4);
+    }
+
+    #[test]
+    fn mismatched_or_zero_vectors_score_zero() {
+        assert_eq!(cosine(&[1.0, 2.0], &[1.0]), 0.0);
+        assert_eq!(cosine(&[0.0, 0.0], &[1.0, 1.0]), 0.0);
+        assert!((cosine(&[2.0, 0.0], &[3.0, 0.0]) - 1.0).abs() < 1e-6);
+    }
+}
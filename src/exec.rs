@@ -0,0 +1,230 @@
+use std::io::{self, BufRead, IsTerminal, Read, Write};
+use std::path::Path;
+use std::process::{Command, ExitStatus, Stdio};
+
+use anyhow::{bail, Context, Result};
+
+/// Run a command through the platform shell with the terminal attached,
+/// the same way the TUI's `/run` does. `cwd` overrides the working directory.
+pub fn run(command: &str, cwd: Option<&Path>) -> Result<ExitStatus> {
+    shell_command(command, cwd)
+        .status()
+        .with_context(|| format!("Failed to run command: {}", command))
+}
+
+/// A finished command's status and captured stderr
+pub struct Captured {
+    pub status: ExitStatus,
+    raw_stderr: String,
+}
+
+impl Captured {
+    /// stderr as the command wrote it, colour codes and all
+    #[allow(dead_code)] // Nothing needs the escapes yet; kept alongside the clean text
+    pub fn raw_stderr(&self) -> &str {
+        &self.raw_stderr
+    }
+
+    /// stderr made safe to display or send to a model: see `clean_output`
+    pub fn stderr(&self) -> String {
+        clean_output(&self.raw_stderr)
+    }
+}
+
+/// Like `run`, but stderr is also captured (it still reaches the terminal
+/// as it's written, untouched).
+pub fn run_capturing_stderr(command: &str, cwd: Option<&Path>) -> Result<Captured> {
+    let mut child = shell_command(command, cwd)
+        .stderr(Stdio::piped())
+        .spawn()
+        .with_context(|| format!("Failed to run command: {}", command))?;
+
+    let mut pipe = child.stderr.take().context("Failed to capture stderr")?;
+    let mut captured = Vec::new();
+    let mut buf = [0u8; 4096];
+    loop {
+        let n = match pipe.read(&mut buf) {
+            Ok(0) => break,
+            Ok(n) => n,
+            Err(e) if e.kind() == io::ErrorKind::Interrupted => continue,
+            Err(e) => return Err(e).context("Failed to read stderr"),
+        };
+        let _ = io::stderr().write_all(&buf[..n]);
+        captured.extend_from_slice(&buf[..n]);
+    }
+
+    let status = child.wait().context("Failed to wait for command")?;
+    Ok(Captured {
+        status,
+        raw_stderr: String::from_utf8_lossy(&captured).into_owned(),
+    })
+}
+
+/// Terminal output as plain text: ANSI escape sequences (colours, cursor
+/// moves, titles) and other control characters are dropped, and a line
+/// redrawn with `\r`, like a progress bar, keeps only its last state.
+/// Newlines and tabs stay.
+pub fn clean_output(text: &str) -> String {
+    strip_control(text, true)
+}
+
+/// Like `clean_output`, for text that was never drawn on a terminal: a
+/// `\r` is just dropped, and so is a stray escape that starts no CSI or
+/// OSC sequence, leaving the character after it
+pub fn strip_escapes(text: &str) -> String {
+    strip_control(text, false)
+}
+
+/// `terminal`: `\r` redraws the line, and an escape followed by anything
+/// else is a two-character sequence like `ESC 7`
+fn strip_control(text: &str, terminal: bool) -> String {
+    let mut out = String::with_capacity(text.len());
+    let mut chars = text.chars().peekable();
+    while let Some(c) = chars.next() {
+        match c {
+            '\x1b' => match chars.next_if(|&c| terminal || c == '[' || c == ']') {
+                // CSI: parameters, then a final byte in @..~
+                Some('[') => {
+                    for c in chars.by_ref() {
+                        if ('@'..='~').contains(&c) {
+                            break;
+                        }
+                    }
+                }
+                // OSC: up to BEL or ESC \
+                Some(']') => {
+                    while let Some(c) = chars.next() {
+                        if c == '\x07' {
+                            break;
+                        }
+                        if c == '\x1b' {
+                            chars.next_if_eq(&'\\');
+                            break;
+                        }
+                    }
+                }
+                _ => {}
+            },
+            '\r' if terminal => {
+                if !matches!(chars.peek(), None | Some('\n')) {
+                    let line_start = out.rfind('\n').map_or(0, |i| i + 1);
+                    out.truncate(line_start);
+                }
+            }
+            '\n' | '\t' => out.push(c),
+            c if c.is_control() => {}
+            c => out.push(c),
+        }
+    }
+    out
+}
+
+fn shell_command(command: &str, cwd: Option<&Path>) -> Command {
+    let mut shell = if cfg!(target_os = "windows") {
+        let mut c = Command::new("cmd");
+        c.args(["/C", command]);
+        c
+    } else {
+        let mut c = Command::new("sh");
+        c.args(["-lc", command]);
+        c
+    };
+
+    if let Some(dir) = cwd {
+        shell.current_dir(dir);
+    }
+    shell
+}
+
+/// Whether we can ask the user questions (stdin and stderr are terminals)
+pub fn is_interactive() -> bool {
+    io::stdin().is_terminal() && io::stderr().is_terminal()
+}
+
+/// Prompt on stderr and read one line from stdin, trimmed
+pub fn ask(prompt: &str) -> Result<String> {
+    eprint!("{}", prompt);
+    io::stderr().flush()?;
+
+    let mut answer = String::new();
+    io::stdin().lock().read_line(&mut answer)?;
+    Ok(answer.trim().to_string())
+}
+
+/// Ask a yes/no question on stderr; anything but y/yes is a no.
+/// Fails when stdin isn't a terminal, since nobody can answer.
+pub fn confirm(question: &str) -> Result<bool> {
+    if !io::stdin().is_terminal() {
+        bail!(
+            "Cannot ask for confirmation without a terminal: {}",
+            question
+        );
+    }
+
+    let answer = ask(&format!("{} [y/N]: ", question))?;
+    Ok(matches!(answer.to_lowercase().as_str(), "y" | "yes"))
+}
+
+/// Have the user type `command` back, line by line, before it runs; any
+/// difference is a no. Fails without a terminal, like `confirm`.
+pub fn confirm_by_retyping(command: &str) -> Result<bool> {
+    if !io::stdin().is_terminal() {
+        bail!("Cannot ask for confirmation without a terminal: retype the command to run it");
+    }
+
+    eprintln!("Type the command exactly to run it (anything else aborts):");
+    let mut typed = Vec::new();
+    for _ in command.trim().lines() {
+        typed.push(ask("> ")?);
+    }
+    Ok(retyped_matches(&typed, command))
+}
+
+/// Whether the lines typed are the command's, ignoring only the
+/// whitespace around each line
+fn retyped_matches(typed: &[String], command: &str) -> bool {
+    let expected: Vec<&str> = command.trim().lines().map(str::trim).collect();
+    expected.len() == typed.len() && expected.iter().zip(typed).all(|(e, t)| *e == t.trim())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn typed(lines: &[&str]) -> Vec<String> {
+        lines.iter().map(|l| l.to_string()).collect()
+    }
+
+    #[test]
+    fn cleaned_output_drops_escapes_and_redrawn_progress() {
+        assert_eq!(
+            clean_output("\x1b[1;31merror:\x1b[0m no such file\r\n"),
+            "error: no such file\n"
+        );
+        assert_eq!(clean_output(" 10%\r 55%\r100%\ndone\n"), "100%\ndone\n");
+        assert_eq!(
+            clean_output("\x1b]0;build\x07ok\x1b]8;;http://x\x1b\\link\x08\tend"),
+            "oklink\tend"
+        );
+        assert_eq!(clean_output("last line\r"), "last line");
+    }
+
+    #[test]
+    fn retyping_must_match_every_line() {
+        assert!(retyped_matches(&typed(&["rm -rf ~/old"]), "rm -rf ~/old\n"));
+        assert!(retyped_matches(
+            &typed(&["  rm -rf ~/old "]),
+            "rm -rf ~/old"
+        ));
+        assert!(!retyped_matches(&typed(&["y"]), "rm -rf ~/old"));
+        assert!(!retyped_matches(&typed(&["rm -rf ~/old/"]), "rm -rf ~/old"));
+        assert!(retyped_matches(
+            &typed(&["cd /srv", "rm -rf data"]),
+            "cd /srv\nrm -rf data"
+        ));
+        assert!(!retyped_matches(
+            &typed(&["cd /srv"]),
+            "cd /srv\nrm -rf data"
+        ));
+    }
+}
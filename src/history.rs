@@ -0,0 +1,146 @@
+use std::fs;
+use std::io::Write;
+use std::path::PathBuf;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+
+use crate::config;
+use crate::safety::RiskLevel;
+
+/// One generated command, appended as a JSON line to `~/.niko/history.jsonl`
+#[derive(Debug, Clone, Serialize, Deserialize, Default)]
+#[serde(default)]
+pub struct Entry {
+    /// Unix timestamp (seconds)
+    pub timestamp: u64,
+    pub query: String,
+    pub command: String,
+    pub provider: String,
+    pub risk: RiskLevel,
+    /// Generation latency, if measured
+    pub latency_ms: Option<u64>,
+    /// Why it was run (`--note`, `niko history annotate`)
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub note: Option<String>,
+}
+
+pub fn history_path() -> PathBuf {
+    config::config_dir().join("history.jsonl")
+}
+
+pub fn now_unix() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
+
+/// Append an entry to the history log
+pub fn record(entry: &Entry) -> Result<()> {
+    let path = history_path();
+    if let Some(dir) = path.parent() {
+        config::create_private_dir(dir)?;
+    }
+
+    let line = serde_json::to_string(entry).context("Failed to serialize history entry")?;
+    let mut file = config::open_private(&path, true)?;
+    writeln!(file, "{}", line)
+        .with_context(|| format!("Failed to write history: {}", path.display()))?;
+
+    Ok(())
+}
+
+/// Set (or, when `note` is empty, clear) the note on entry `id`, counting
+/// from 1 in the order `load` returns them. Returns the updated entry.
+pub fn annotate(id: usize, note: &str) -> Result<Entry> {
+    let path = history_path();
+    let content = fs::read_to_string(&path)
+        .with_context(|| format!("Failed to read history: {}", path.display()))?;
+    let (content, entry) = annotate_in(&content, id, note)?;
+    config::write_private(&path, content.as_bytes())?;
+    Ok(entry)
+}
+
+/// `annotate` on the file's text. Lines that aren't entries are kept as-is.
+fn annotate_in(content: &str, id: usize, note: &str) -> Result<(String, Entry)> {
+    let mut seen = 0;
+    let mut updated = None;
+    let mut out = String::with_capacity(content.len() + note.len());
+
+    for line in content.lines() {
+        let parsed = if line.trim().is_empty() {
+            None
+        } else {
+            serde_json::from_str::<Entry>(line).ok()
+        };
+        if let Some(mut entry) = parsed {
+            seen += 1;
+            if seen == id {
+                let note = note.trim();
+                entry.note = (!note.is_empty()).then(|| note.to_string());
+                out.push_str(&serde_json::to_string(&entry)?);
+                out.push('\n');
+                updated = Some(entry);
+                continue;
+            }
+        }
+        out.push_str(line);
+        out.push('\n');
+    }
+
+    match updated {
+        Some(entry) => Ok((out, entry)),
+        None => anyhow::bail!("No history entry {} (there are {})", id, seen),
+    }
+}
+
+/// Load all history entries, oldest first. Malformed lines are skipped.
+pub fn load() -> Result<Vec<Entry>> {
+    let path = history_path();
+    if !path.exists() {
+        return Ok(Vec::new());
+    }
+
+    let content = fs::read_to_string(&path)
+        .with_context(|| format!("Failed to read history: {}", path.display()))?;
+
+    Ok(content
+        .lines()
+        .filter(|line| !line.trim().is_empty())
+        .filter_map(|line| serde_json::from_str(line).ok())
+        .collect())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn annotate_rewrites_only_the_numbered_entry() {
+        let content = "{\"query\":\"a\",\"command\":\"ls\"}\n\
+                       not json\n\
+                       \n\
+                       {\"query\":\"b\",\"command\":\"df -h\",\"note\":\"old\"}\n";
+
+        let (out, entry) = annotate_in(content, 2, " disk was full ").unwrap();
+        assert_eq!(entry.command, "df -h");
+        assert_eq!(entry.note.as_deref(), Some("disk was full"));
+        let lines: Vec<&str> = out.lines().collect();
+        assert_eq!(
+            lines[..3],
+            ["{\"query\":\"a\",\"command\":\"ls\"}", "not json", ""]
+        );
+        assert!(lines[3].contains("\"note\":\"disk was full\""));
+
+        let (out, entry) = annotate_in(&out, 2, "").unwrap();
+        assert_eq!(entry.note, None);
+        assert!(!out.contains("note"));
+
+        assert!(annotate_in(content, 3, "x")
+            .unwrap_err()
+            .to_string()
+            .contains("there are 2"));
+    }
+}
@@ -0,0 +1,229 @@
+use std::io::{Read, Write};
+use std::path::PathBuf;
+use std::process::{Command, Stdio};
+use std::thread;
+use std::time::{Duration, Instant};
+
+use anyhow::{bail, Context, Result};
+use serde::Deserialize;
+
+use crate::safety::RiskLevel;
+
+/// Run the `hooks.post_generate` program on `command`. It gets the command
+/// on stdin and `$NIKO_QUERY` / `$NIKO_PROVIDER` in its environment, and
+/// prints the command to use instead; printing nothing keeps it as is, so
+/// a hook that only logs needn't echo it back. A non-zero exit vetoes the
+/// command, with the hook's stderr as the reason.
+///
+/// Returns the replacement, or `None` when the command is unchanged.
+pub fn post_generate(
+    hook: &str,
+    command: &str,
+    query: &str,
+    provider: &str,
+) -> Result<Option<String>> {
+    let program = expand_home(hook.trim());
+    let mut child = Command::new(&program)
+        .env("NIKO_QUERY", query)
+        .env("NIKO_PROVIDER", provider)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .with_context(|| format!("Failed to run hooks.post_generate ({})", program.display()))?;
+
+    if let Some(mut stdin) = child.stdin.take() {
+        // A hook may exit without reading; a broken pipe then isn't an error
+        let _ = writeln!(stdin, "{}", command);
+    }
+    let output = child
+        .wait_with_output()
+        .context("Failed to wait for hooks.post_generate")?;
+
+    if !output.status.success() {
+        let reason = String::from_utf8_lossy(&output.stderr).trim().to_string();
+        bail!(
+            "hooks.post_generate rejected the command ({}){}\n{}",
+            output.status,
+            if reason.is_empty() {
+                String::new()
+            } else {
+                format!(": {}", reason)
+            },
+            command
+        );
+    }
+
+    let replaced = String::from_utf8_lossy(&output.stdout).trim().to_string();
+    Ok((!replaced.is_empty() && replaced != command).then_some(replaced))
+}
+
+/// What `hooks.assess` prints about a command
+#[derive(Debug, Deserialize)]
+struct Verdict {
+    level: RiskLevel,
+    #[serde(default)]
+    reasons: Vec<String>,
+}
+
+/// How long `hooks.assess` gets per command before it counts as failed
+const ASSESS_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Run the `hooks.assess` program on `command`, given on stdin. It prints
+/// `{"level": "dangerous", "reasons": ["..."]}`, or nothing to add no
+/// opinion. Failing to run, a non-zero exit, unreadable output and taking
+/// longer than `ASSESS_TIMEOUT` are errors.
+pub fn assess(hook: &str, command: &str) -> Result<Option<(RiskLevel, Vec<String>)>> {
+    assess_within(hook, command, ASSESS_TIMEOUT)
+}
+
+fn assess_within(
+    hook: &str,
+    command: &str,
+    timeout: Duration,
+) -> Result<Option<(RiskLevel, Vec<String>)>> {
+    let program = expand_home(hook.trim());
+    let mut child = Command::new(&program)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .with_context(|| format!("couldn't run {}", program.display()))?;
+
+    if let Some(mut stdin) = child.stdin.take() {
+        let _ = writeln!(stdin, "{}", command);
+    }
+    // Drain both pipes meanwhile, so a chatty hook can't block on a full one
+    let drain = |pipe: Option<Box<dyn Read + Send>>| {
+        thread::spawn(move || {
+            let mut text = String::new();
+            if let Some(mut pipe) = pipe {
+                let _ = pipe.read_to_string(&mut text);
+            }
+            text
+        })
+    };
+    let stdout = drain(child.stdout.take().map(|p| Box::new(p) as _));
+    let stderr = drain(child.stderr.take().map(|p| Box::new(p) as _));
+
+    let deadline = Instant::now() + timeout;
+    let status = loop {
+        match child.try_wait().context("couldn't wait for it")? {
+            Some(status) => break status,
+            None if Instant::now() < deadline => thread::sleep(Duration::from_millis(20)),
+            None => {
+                let _ = child.kill();
+                let _ = child.wait();
+                bail!("no answer within {}s", timeout.as_secs_f32());
+            }
+        }
+    };
+    let stdout = stdout.join().unwrap_or_default();
+    let stderr = stderr.join().unwrap_or_default();
+
+    if !status.success() {
+        let reason = stderr.trim().to_string();
+        bail!(
+            "{}{}",
+            status,
+            if reason.is_empty() {
+                String::new()
+            } else {
+                format!(": {}", reason)
+            }
+        );
+    }
+    parse_verdict(&stdout)
+}
+
+fn parse_verdict(output: &str) -> Result<Option<(RiskLevel, Vec<String>)>> {
+    let output = output.trim();
+    if output.is_empty() {
+        return Ok(None);
+    }
+    let verdict: Verdict =
+        serde_json::from_str(output).with_context(|| format!("unreadable verdict {:?}", output))?;
+    Ok(Some((verdict.level, verdict.reasons)))
+}
+
+/// `~/bin/hook` → `$HOME/bin/hook`
+fn expand_home(path: &str) -> PathBuf {
+    match (path.strip_prefix("~/"), dirs::home_dir()) {
+        (Some(rest), Some(home)) => home.join(rest),
+        _ => PathBuf::from(path),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[cfg(unix)]
+    fn script(name: &str, body: &str) -> PathBuf {
+        use std::fs;
+        use std::os::unix::fs::PermissionsExt;
+
+        let path = std::env::temp_dir().join(format!("niko-hook-{}-{}", name, std::process::id()));
+        fs::write(&path, format!("#!/bin/sh\n{}\n", body)).unwrap();
+        fs::set_permissions(&path, fs::Permissions::from_mode(0o755)).unwrap();
+        path
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn hooks_can_rewrite_keep_or_veto() {
+        let rewrite = script("rewrite", "sed 's/rm -rf/trash/'");
+        let keep = script("keep", "cat >/dev/null");
+        let veto = script("veto", "echo 'no deletes on fridays' >&2; exit 3");
+
+        let hook = |p: &PathBuf| p.to_str().unwrap().to_string();
+        assert_eq!(
+            post_generate(&hook(&rewrite), "rm -rf build", "q", "ollama").unwrap(),
+            Some("trash build".to_string())
+        );
+        assert_eq!(
+            post_generate(&hook(&keep), "ls", "q", "ollama").unwrap(),
+            None
+        );
+        let err = post_generate(&hook(&veto), "rm -rf build", "q", "ollama").unwrap_err();
+        assert!(err.to_string().contains("no deletes on fridays"));
+
+        for path in [rewrite, keep, veto] {
+            std::fs::remove_file(path).unwrap();
+        }
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn assess_hooks_give_a_verdict_or_none() {
+        let strict = script(
+            "strict",
+            r#"grep -q kubectl && echo '{"level": "critical", "reasons": ["touches the cluster"]}'"#,
+        );
+        let broken = script("broken", "echo 'not json'");
+
+        let hook = |p: &PathBuf| p.to_str().unwrap().to_string();
+        assert_eq!(
+            assess(&hook(&strict), "kubectl delete pod web").unwrap(),
+            Some((RiskLevel::Critical, vec!["touches the cluster".to_string()]))
+        );
+        // grep finds nothing and exits 1
+        assert!(assess(&hook(&strict), "ls").is_err());
+        assert!(assess(&hook(&broken), "ls").is_err());
+        assert_eq!(parse_verdict("\n").unwrap(), None);
+        assert_eq!(
+            parse_verdict(r#"{"level": "moderate"}"#).unwrap(),
+            Some((RiskLevel::Moderate, Vec::new()))
+        );
+
+        let slow = script("slow", "exec sleep 5");
+        let started = Instant::now();
+        let err = assess_within(&hook(&slow), "ls", Duration::from_millis(200)).unwrap_err();
+        assert!(err.to_string().contains("no answer within"));
+        assert!(started.elapsed() < Duration::from_secs(3));
+
+        for path in [strict, broken, slow] {
+            let _ = std::fs::remove_file(path);
+        }
+    }
+}
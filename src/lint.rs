@@ -0,0 +1,74 @@
+use std::io::Write;
+use std::process::{Command, Stdio};
+
+/// Shells shellcheck understands, keyed by the name `prompt` detects
+const SUPPORTED_SHELLS: &[&str] = &["sh", "bash", "dash", "ksh"];
+
+/// Run `command` through shellcheck and return its warnings.
+///
+/// Returns nothing when the shell isn't one shellcheck supports, shellcheck
+/// isn't on PATH, or it fails to run — linting is best-effort and never
+/// blocks the command.
+pub fn shellcheck(command: &str, shell: &str) -> Vec<String> {
+    if !SUPPORTED_SHELLS.contains(&shell) {
+        return Vec::new();
+    }
+
+    let child = Command::new("shellcheck")
+        .args(["--format=gcc", "--shell", shell, "-"])
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::null())
+        .spawn();
+    let Ok(mut child) = child else {
+        return Vec::new();
+    };
+
+    if let Some(mut stdin) = child.stdin.take() {
+        if writeln!(stdin, "{}", command).is_err() {
+            let _ = child.kill();
+            return Vec::new();
+        }
+    }
+
+    match child.wait_with_output() {
+        Ok(output) => parse_gcc_output(&String::from_utf8_lossy(&output.stdout)),
+        Err(_) => Vec::new(),
+    }
+}
+
+/// Turn `-:1:5: warning: message [SC2086]` lines into `1:5: warning: message [SC2086]`
+fn parse_gcc_output(output: &str) -> Vec<String> {
+    output
+        .lines()
+        .filter_map(|line| line.strip_prefix("-:"))
+        .map(|line| line.trim().to_string())
+        .filter(|line| !line.is_empty())
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parses_gcc_format_and_drops_noise() {
+        let output = "-:1:6: warning: Double quote to prevent globbing. [SC2086]\n\
+                      \n\
+                      In - line 1:\n\
+                      -:1:1: error: Couldn't parse this. [SC1073]\n";
+        assert_eq!(
+            parse_gcc_output(output),
+            vec![
+                "1:6: warning: Double quote to prevent globbing. [SC2086]",
+                "1:1: error: Couldn't parse this. [SC1073]",
+            ]
+        );
+    }
+
+    #[test]
+    fn unsupported_shells_are_skipped() {
+        assert!(shellcheck("echo $((1 +", "fish").is_empty());
+        assert!(shellcheck("Get-ChildItem", "powershell").is_empty());
+    }
+}
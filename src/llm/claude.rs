@@ -1,15 +1,18 @@
-use std::io::{BufRead, BufReader};
-use std::time::Duration;
+use std::time::{Duration, Instant};
 
 use anyhow::{bail, Context, Result};
+use reqwest::header::HeaderMap;
 use serde::Deserialize;
 
-use crate::llm::{estimate_param_billions, ModelInfo, Provider};
+use crate::llm::{self, estimate_param_billions, Generation, Message, ModelInfo, Provider, Role};
+use crate::progress;
 
 /// Anthropic Claude Messages API provider with SSE streaming
 pub struct ClaudeProvider {
     api_key: String,
     model: String,
+    /// Sampling temperature (`<provider>.temperature`, default 0.1)
+    temperature: f64,
     client: reqwest::blocking::Client,
 }
 
@@ -17,11 +20,23 @@ pub struct ClaudeProvider {
 struct MessagesResponse {
     content: Option<Vec<ContentBlock>>,
     #[serde(default)]
+    model: Option<String>,
+    #[serde(default)]
+    usage: Option<Usage>,
+    #[serde(default)]
     stop_reason: Option<String>,
     #[serde(default)]
     error: Option<ApiError>,
 }
 
+#[derive(Deserialize)]
+struct Usage {
+    #[serde(default)]
+    input_tokens: Option<u32>,
+    #[serde(default)]
+    output_tokens: Option<u32>,
+}
+
 #[derive(Deserialize)]
 struct ContentBlock {
     text: Option<String>,
@@ -71,8 +86,9 @@ struct ClaudeModel {
 }
 
 impl ClaudeProvider {
-    pub fn new(api_key: &str, model: &str) -> Self {
+    pub fn new(api_key: &str, model: &str, temperature: f64, headers: HeaderMap) -> Self {
         let client = reqwest::blocking::Client::builder()
+            .default_headers(headers)
             .timeout(Duration::from_secs(120))
             .connect_timeout(Duration::from_secs(10))
             .pool_max_idle_per_host(4)
@@ -84,6 +100,7 @@ impl ClaudeProvider {
         Self {
             api_key: api_key.to_string(),
             model: model.to_string(),
+            temperature,
             client,
         }
     }
@@ -103,26 +120,52 @@ impl ClaudeProvider {
     }
 }
 
+/// Split chat messages into Claude's top-level system prompt and the
+/// user/assistant turns (the Messages API has no "system" role)
+fn split_messages(messages: &[Message]) -> (String, Vec<serde_json::Value>) {
+    let mut system_parts = Vec::new();
+    let mut api_messages = Vec::new();
+
+    for msg in messages {
+        match msg.role {
+            Role::System => system_parts.push(msg.content.as_str()),
+            Role::User => {
+                api_messages.push(serde_json::json!({ "role": "user", "content": msg.content }))
+            }
+            Role::Assistant => api_messages
+                .push(serde_json::json!({ "role": "assistant", "content": msg.content })),
+        }
+    }
+
+    (system_parts.join("\n\n"), api_messages)
+}
+
 impl Provider for ClaudeProvider {
     fn name(&self) -> &str {
         "claude"
     }
 
+    fn model(&self) -> &str {
+        &self.model
+    }
+
     fn is_available(&self) -> bool {
         !self.api_key.is_empty()
     }
 
-    fn generate(&self, system_prompt: &str, user_prompt: &str, max_tokens: u32) -> Result<String> {
+    fn generate_with_meta(&self, messages: &[Message], max_tokens: u32) -> Result<Generation> {
         self.validate()?;
 
+        let (system_prompt, api_messages) = split_messages(messages);
         let body = serde_json::json!({
             "model": self.model,
             "max_tokens": max_tokens,
             "system": system_prompt,
-            "messages": [{ "role": "user", "content": user_prompt }],
-            "temperature": 0.1,
+            "messages": api_messages,
+            "temperature": self.temperature,
         });
 
+        let started = Instant::now();
         let resp = self
             .client
             .post("https://api.anthropic.com/v1/messages")
@@ -151,7 +194,9 @@ impl Provider for ClaudeProvider {
             bail!("Claude API error ({}): {}", status.as_u16(), text);
         }
 
-        let msg: MessagesResponse = resp.json().context("Failed to parse Claude response")?;
+        let msg: MessagesResponse =
+            llm::parse_json(resp).context("Failed to parse Claude response")?;
+        let latency = started.elapsed();
 
         if let Some(err) = msg.error {
             if let Some(emsg) = err.message {
@@ -160,7 +205,7 @@ impl Provider for ClaudeProvider {
         }
 
         if msg.stop_reason.as_deref() == Some("max_tokens") {
-            eprintln!("  ⚠ Response truncated (hit max_tokens)");
+            progress::eprint_line("  ⚠ Response truncated (hit max_tokens)");
         }
 
         let content = msg
@@ -179,24 +224,36 @@ impl Provider for ClaudeProvider {
             bail!("Claude returned empty response");
         }
 
-        Ok(trimmed.to_string())
+        Ok(Generation {
+            text: trimmed.to_string(),
+            model: msg.model.unwrap_or_else(|| self.model.clone()),
+            prompt_tokens: msg.usage.as_ref().and_then(|u| u.input_tokens),
+            completion_tokens: msg.usage.as_ref().and_then(|u| u.output_tokens),
+            latency,
+            note: None,
+            forced: false,
+        })
+    }
+
+    fn supports_streaming(&self) -> bool {
+        true
     }
 
     fn generate_stream(
         &self,
-        system_prompt: &str,
-        user_prompt: &str,
+        messages: &[Message],
         max_tokens: u32,
         on_token: &mut dyn FnMut(&str),
     ) -> Result<String> {
         self.validate()?;
 
+        let (system_prompt, api_messages) = split_messages(messages);
         let body = serde_json::json!({
             "model": self.model,
             "max_tokens": max_tokens,
             "system": system_prompt,
-            "messages": [{ "role": "user", "content": user_prompt }],
-            "temperature": 0.1,
+            "messages": api_messages,
+            "temperature": self.temperature,
             "stream": true,
         });
 
@@ -216,10 +273,9 @@ impl Provider for ClaudeProvider {
             bail!("Claude API error ({}): {}", status.as_u16(), text);
         }
 
-        let reader = BufReader::new(resp);
         let mut accumulated = String::new();
 
-        for line in reader.lines() {
+        for line in llm::lossy_lines(resp) {
             let line = match line {
                 Ok(l) => l,
                 Err(e) => {
@@ -254,7 +310,9 @@ impl Provider for ClaudeProvider {
                         "message_delta" => {
                             if let Some(delta) = event.delta {
                                 if delta.stop_reason.as_deref() == Some("max_tokens") {
-                                    eprintln!("\n  ⚠ Response truncated (hit max_tokens)");
+                                    progress::eprint_line(
+                                        "\n  ⚠ Response truncated (hit max_tokens)",
+                                    );
                                 }
                             }
                         }
@@ -0,0 +1,61 @@
+use std::time::Duration;
+
+use anyhow::Result;
+
+use super::{Generation, Message, ModelInfo, Provider};
+
+/// Environment variable that swaps every provider for [`MockProvider`]
+pub const MOCK_RESPONSE_ENV: &str = "NIKO_MOCK_RESPONSE";
+
+/// Provider that answers every request with the same canned text, so the
+/// whole query pipeline (extraction, risk assessment, output) can be
+/// exercised without a network or a running Ollama:
+///
+/// ```bash
+/// NIKO_MOCK_RESPONSE='```bash
+/// ls -la
+/// ```' niko list files
+/// ```
+pub struct MockProvider {
+    response: String,
+}
+
+impl MockProvider {
+    pub fn new(response: impl Into<String>) -> Self {
+        Self {
+            response: response.into(),
+        }
+    }
+
+    /// The mock selected by `$NIKO_MOCK_RESPONSE`, if set
+    pub fn from_env() -> Option<Self> {
+        std::env::var(MOCK_RESPONSE_ENV).ok().map(Self::new)
+    }
+}
+
+impl Provider for MockProvider {
+    fn name(&self) -> &str {
+        "mock"
+    }
+
+    fn model(&self) -> &str {
+        "mock"
+    }
+
+    fn generate_with_meta(&self, _messages: &[Message], _max_tokens: u32) -> Result<Generation> {
+        Ok(Generation {
+            text: self.response.clone(),
+            model: "mock".to_string(),
+            latency: Duration::ZERO,
+            ..Default::default()
+        })
+    }
+
+    fn is_available(&self) -> bool {
+        true
+    }
+
+    fn list_models(&self) -> Result<Vec<ModelInfo>> {
+        Ok(Vec::new())
+    }
+}
@@ -1,17 +1,26 @@
 pub mod claude;
+pub mod mock;
 pub mod ollama;
 pub mod openai_compat;
 
+use std::collections::HashMap;
+use std::io::{self, BufRead, BufReader, Read};
 use std::thread;
-use std::time::Duration;
+use std::time::{Duration, Instant};
 
-use anyhow::{bail, Result};
+use anyhow::{bail, Context, Result};
+use reqwest::header::{HeaderMap, HeaderName, HeaderValue};
 
 use crate::config::{self, ProviderConfig};
+use crate::exec;
+use crate::progress;
 
 // ─── Retry configuration ────────────────────────────────────────────────────
 
 const MAX_RETRIES: u32 = 3;
+/// How long to keep waiting while a local model is still loading
+const MODEL_LOAD_TIMEOUT: Duration = Duration::from_secs(120);
+const MODEL_LOAD_POLL: Duration = Duration::from_secs(2);
 const RETRY_BASE_DELAY_MS: u64 = 500;
 const RETRY_MAX_DELAY_MS: u64 = 8000;
 
@@ -28,13 +37,37 @@ pub struct Message {
     pub content: String,
 }
 
+/// A generated response plus what the provider reported about it
+#[derive(Debug, Clone, Default)]
+pub struct Generation {
+    pub text: String,
+    /// Model that actually answered (may differ from the configured alias)
+    pub model: String,
+    pub prompt_tokens: Option<u32>,
+    pub completion_tokens: Option<u32>,
+    pub latency: Duration,
+    /// What the model said about the command besides the command itself
+    /// (the `risk_note` of a structured answer)
+    pub note: Option<String>,
+    /// The model refused at first and only answered on the `--force` retry
+    pub forced: bool,
+}
+
 /// Trait for all LLM providers
 pub trait Provider: Send + Sync {
     /// Provider name
     fn name(&self) -> &str;
 
-    /// Generate a response (non-streaming)
-    fn generate(&self, messages: &[Message], max_tokens: u32) -> Result<String>;
+    /// Configured model name
+    fn model(&self) -> &str;
+
+    /// Generate a response with model, token usage and latency (non-streaming)
+    fn generate_with_meta(&self, messages: &[Message], max_tokens: u32) -> Result<Generation>;
+
+    /// Generate a response (non-streaming), text only
+    fn generate(&self, messages: &[Message], max_tokens: u32) -> Result<String> {
+        Ok(self.generate_with_meta(messages, max_tokens)?.text)
+    }
 
     /// Stream tokens to a callback, return accumulated response.
     /// Default: falls back to non-streaming generate.
@@ -49,9 +82,43 @@ pub trait Provider: Send + Sync {
         Ok(result)
     }
 
+    /// Whether `generate_stream` delivers tokens as they arrive rather
+    /// than the whole response at the end
+    fn supports_streaming(&self) -> bool {
+        false
+    }
+
+    /// Whether commands should be asked for as JSON rather than free text
+    /// (`<provider>.structured_output`)
+    fn supports_structured_output(&self) -> bool {
+        false
+    }
+
+    /// Generate an answer constrained to the JSON `schema`; the text is the
+    /// JSON. Default: not supported.
+    fn generate_json(
+        &self,
+        _messages: &[Message],
+        _max_tokens: u32,
+        _schema: &serde_json::Value,
+    ) -> Result<Generation> {
+        bail!("{} doesn't support structured output", self.name())
+    }
+
     /// Check if the provider is available
     fn is_available(&self) -> bool;
 
+    /// Whether this provider runs on the local machine (no per-call cost)
+    fn is_local(&self) -> bool {
+        false
+    }
+
+    /// Context window the model is pinned to, in tokens, when the user set
+    /// one. `None` means the provider sizes it (or it's too large to matter).
+    fn context_size(&self) -> Option<u32> {
+        None
+    }
+
     /// Fetch all available models from this provider
     fn list_models(&self) -> Result<Vec<ModelInfo>>;
 }
@@ -107,22 +174,33 @@ pub fn generate_with_retry(
     messages: &[Message],
     max_tokens: u32,
 ) -> Result<String> {
+    Ok(generate_with_retry_meta(provider, messages, max_tokens)?.text)
+}
+
+/// Like `generate_with_retry`, keeping the metadata of the successful attempt
+pub fn generate_with_retry_meta(
+    provider: &dyn Provider,
+    messages: &[Message],
+    max_tokens: u32,
+) -> Result<Generation> {
     let mut last_err = None;
+    let mut loading_since: Option<Instant> = None;
+    let mut attempt = 0;
 
-    for attempt in 0..=MAX_RETRIES {
-        match provider.generate(messages, max_tokens) {
-            Ok(response) => {
-                let trimmed = response.trim();
+    while attempt <= MAX_RETRIES {
+        if progress::is_abandoned() {
+            bail!("Stopped: the answer is no longer needed");
+        }
+        match provider.generate_with_meta(messages, max_tokens) {
+            Ok(generation) => {
+                let text = sanitize(&generation.text);
+                let trimmed = text.trim();
                 if trimmed.is_empty() {
                     if attempt < MAX_RETRIES {
                         let delay = retry_delay(attempt);
-                        eprintln!(
-                            "  ↻ Empty response, retrying in {:.1}s… ({}/{})",
-                            delay.as_secs_f64(),
-                            attempt + 1,
-                            MAX_RETRIES
-                        );
+                        report_retry("Empty response", delay, attempt);
                         thread::sleep(delay);
+                        attempt += 1;
                         continue;
                     }
                     bail!(
@@ -130,20 +208,40 @@ pub fn generate_with_retry(
                         MAX_RETRIES + 1
                     );
                 }
-                return Ok(trimmed.to_string());
+                return Ok(Generation {
+                    text: trimmed.to_string(),
+                    ..generation
+                });
             }
             Err(e) => {
+                // Ollama answers 503 until a cold model is in memory, which
+                // can take far longer than the backoff below allows for;
+                // polling for it doesn't use up attempts
+                if provider.is_local() && is_model_loading(&e) {
+                    let first = loading_since.is_none();
+                    let waited = loading_since.get_or_insert_with(Instant::now).elapsed();
+                    if waited >= MODEL_LOAD_TIMEOUT {
+                        bail!(
+                            "{} was still loading after {}s: {:#}",
+                            provider.model(),
+                            MODEL_LOAD_TIMEOUT.as_secs(),
+                            e
+                        );
+                    }
+                    // Without a progress line, say it once rather than every poll
+                    let message = format!("loading {}… ({}s)", provider.model(), waited.as_secs());
+                    if !progress::set_message(&message) && first {
+                        progress::eprint_line(&format!("  loading {}…", provider.model()));
+                    }
+                    thread::sleep(MODEL_LOAD_POLL);
+                    continue;
+                }
                 if attempt < MAX_RETRIES && is_retryable_error(&e) {
                     let delay = retry_delay(attempt);
-                    eprintln!(
-                        "  ↻ {}, retrying in {:.1}s… ({}/{})",
-                        summarize_error(&e),
-                        delay.as_secs_f64(),
-                        attempt + 1,
-                        MAX_RETRIES
-                    );
+                    report_retry(&retry_reason(&e), delay, attempt);
                     thread::sleep(delay);
                     last_err = Some(e);
+                    attempt += 1;
                 } else {
                     return Err(e);
                 }
@@ -155,31 +253,38 @@ pub fn generate_with_retry(
 }
 
 /// Streaming generate — no retry once tokens start flowing.
-/// Retries only on initial connection failure (before any tokens arrive).
+/// Retries only on initial connection failure (before any tokens arrive);
+/// after that the caller has shown part of the answer, so the error is
+/// returned rather than a fresh answer it would never see.
 pub fn generate_streaming(
     provider: &dyn Provider,
     messages: &[Message],
     max_tokens: u32,
     on_token: &mut dyn FnMut(&str),
 ) -> Result<String> {
+    let mut delivered = false;
+    let mut on_clean_token = |token: &str| {
+        let token = sanitize(token);
+        delivered |= !token.is_empty();
+        on_token(&token)
+    };
+
     // Try once; if connection fails before any tokens, retry with non-streaming
-    match provider.generate_stream(messages, max_tokens, on_token) {
+    match provider.generate_stream(messages, max_tokens, &mut on_clean_token) {
         Ok(result) => {
+            let result = sanitize(&result);
             let trimmed = result.trim();
             if trimmed.is_empty() {
                 bail!("Provider returned empty response");
             }
             Ok(trimmed.to_string())
         }
-        Err(e) => {
-            if is_retryable_error(&e) {
-                eprintln!("  ↻ Stream failed, retrying without streaming…");
-                // Fallback to non-streaming with retry
-                generate_with_retry(provider, messages, max_tokens)
-            } else {
-                Err(e)
-            }
+        Err(e) if !delivered && is_retryable_error(&e) => {
+            report_status("↻ Stream failed, retrying without streaming…");
+            // Fallback to non-streaming with retry
+            generate_with_retry(provider, messages, max_tokens)
         }
+        Err(e) => Err(e),
     }
 }
 
@@ -190,6 +295,44 @@ fn retry_delay(attempt: u32) -> Duration {
     Duration::from_millis(delay_ms + jitter)
 }
 
+/// Say why a retry is coming and when: in the spinner if one is showing,
+/// otherwise on its own stderr line
+fn report_retry(reason: &str, delay: Duration, attempt: u32) {
+    report_status(&format!(
+        "↻ {}, retrying in {:.1}s… ({}/{})",
+        reason,
+        delay.as_secs_f64(),
+        attempt + 1,
+        MAX_RETRIES
+    ));
+}
+
+/// Show `message` in the progress line, or on stderr when there is none
+pub fn report_status(message: &str) {
+    if !progress::set_message(message) {
+        progress::eprint_line(&format!("  {}", message));
+    }
+}
+
+/// Ollama's answer while a model is still being loaded into memory
+fn is_model_loading(err: &anyhow::Error) -> bool {
+    let msg = format!("{:#}", err).to_lowercase();
+    msg.contains("model is loading")
+        || msg.contains("loading model")
+        || msg.contains("(503")
+        || msg.contains("503 service unavailable")
+}
+
+/// Short cause for a retry; rate limits get plain words rather than the
+/// provider's error body
+fn retry_reason(err: &anyhow::Error) -> String {
+    let msg = format!("{:#}", err).to_lowercase();
+    if msg.contains("429") || msg.contains("rate limit") || msg.contains("too many requests") {
+        return "rate limited".to_string();
+    }
+    summarize_error(err)
+}
+
 fn summarize_error(err: &anyhow::Error) -> String {
     let full = format!("{:#}", err);
     if full.len() > 80 {
@@ -204,6 +347,42 @@ fn summarize_error(err: &anyhow::Error) -> String {
     }
 }
 
+// ─── Response decoding ──────────────────────────────────────────────────────
+
+/// Parse a JSON response body, replacing invalid UTF-8 instead of failing.
+/// A body cut off mid-character would otherwise lose the whole answer.
+pub fn parse_json<T: serde::de::DeserializeOwned>(resp: reqwest::blocking::Response) -> Result<T> {
+    let bytes = resp.bytes()?;
+    Ok(serde_json::from_str(&String::from_utf8_lossy(&bytes))?)
+}
+
+/// Lines of a streaming body, with invalid UTF-8 replaced rather than
+/// ending the stream (`BufRead::lines` errors on the first bad byte)
+pub fn lossy_lines<R: Read>(reader: R) -> impl Iterator<Item = io::Result<String>> {
+    let mut reader = BufReader::new(reader);
+    std::iter::from_fn(move || {
+        let mut buf = Vec::new();
+        match reader.read_until(b'\n', &mut buf) {
+            Ok(0) => None,
+            Ok(_) => {
+                let line = String::from_utf8_lossy(&buf);
+                Some(Ok(line.trim_end_matches(['\r', '\n']).to_string()))
+            }
+            Err(e) => Some(Err(e)),
+        }
+    })
+}
+
+/// Drop replacement characters left by lossy decoding, and escape
+/// sequences and other control characters that would garble the terminal
+/// (see `exec::strip_escapes`). Newlines and tabs are kept.
+pub fn sanitize(text: &str) -> String {
+    exec::strip_escapes(text)
+        .chars()
+        .filter(|&c| c != char::REPLACEMENT_CHARACTER)
+        .collect()
+}
+
 // ─── Provider factory ───────────────────────────────────────────────────────
 
 pub fn from_config(name: &str, pcfg: &ProviderConfig) -> Result<Box<dyn Provider>> {
@@ -225,10 +404,15 @@ pub fn from_config(name: &str, pcfg: &ProviderConfig) -> Result<Box<dyn Provider
             &pcfg.api_key,
             &pcfg.base_url,
             &pcfg.model,
+            cloud_temperature(name, pcfg)?,
+            structured_output(name, pcfg)?,
+            extra_headers(name, pcfg)?,
         ))),
         "anthropic" => Ok(Box::new(claude::ClaudeProvider::new(
             &pcfg.api_key,
             &pcfg.model,
+            cloud_temperature(name, pcfg)?,
+            extra_headers(name, pcfg)?,
         ))),
         "" => bail!(
             "Provider '{}' has no kind set.\nRun 'niko settings configure' to set it up.",
@@ -241,32 +425,151 @@ pub fn from_config(name: &str, pcfg: &ProviderConfig) -> Result<Box<dyn Provider
     }
 }
 
-pub fn get_active_provider() -> Result<Box<dyn Provider>> {
-    let (name, pcfg) = config::active_provider()?;
-    from_config(&name, &pcfg)
+/// `<provider>.headers` for the HTTP client. Values are marked sensitive
+/// so they stay out of debug output, since gateways often put tokens
+/// there. Headers niko sets itself, like the API key's, still win.
+fn extra_headers(name: &str, pcfg: &ProviderConfig) -> Result<HeaderMap> {
+    let mut headers = HeaderMap::new();
+    for (key, value) in &pcfg.headers {
+        let header = HeaderName::from_bytes(key.trim().as_bytes())
+            .with_context(|| format!("{}.headers: '{}' isn't a valid header name", name, key))?;
+        let mut value = HeaderValue::from_str(value.trim())
+            .with_context(|| format!("{}.headers.{} has an invalid value", name, key))?;
+        value.set_sensitive(true);
+        headers.insert(header, value);
+    }
+    Ok(headers)
+}
+
+/// Cloud providers default to a low but non-zero temperature
+const DEFAULT_CLOUD_TEMPERATURE: f64 = 0.1;
+
+/// `<provider>.temperature` from the options, validated like the APIs do
+/// `<provider>.structured_output`, off when unset
+fn structured_output(name: &str, pcfg: &ProviderConfig) -> Result<bool> {
+    match pcfg.options.get("structured_output") {
+        Some(value) => config::parse_bool(&format!("{}.structured_output", name), value),
+        None => Ok(false),
+    }
+}
+
+fn cloud_temperature(name: &str, pcfg: &ProviderConfig) -> Result<f64> {
+    // Anthropic rejects anything above 1 with a 400; OpenAI-style APIs take up to 2
+    let max = if pcfg.kind == "anthropic" { 1.0 } else { 2.0 };
+    match pcfg.options.get("temperature").map(|t| t.trim()) {
+        None | Some("") => Ok(DEFAULT_CLOUD_TEMPERATURE),
+        Some(value) => value
+            .parse::<f64>()
+            .ok()
+            .filter(|t| (0.0..=max).contains(t))
+            .ok_or_else(|| {
+                anyhow::anyhow!(
+                    "{}.temperature must be a number from 0 to {}, got '{}'",
+                    name,
+                    max,
+                    value
+                )
+            }),
+    }
 }
 
 pub fn get_provider(override_name: Option<&str>) -> Result<Box<dyn Provider>> {
-    match override_name {
+    get_provider_with(override_name, &HashMap::new())
+}
+
+/// Like `get_provider`, with per-run overrides (e.g. from CLI flags) layered
+/// over the provider's configured `options`
+pub fn get_provider_with(
+    override_name: Option<&str>,
+    option_overrides: &HashMap<String, String>,
+) -> Result<Box<dyn Provider>> {
+    if let Some(mock) = mock::MockProvider::from_env() {
+        return Ok(Box::new(mock));
+    }
+
+    let (name, mut pcfg) = match override_name {
         Some(name) => {
             let cfg = config::load()?;
-            let pcfg = cfg.providers.get(name).ok_or_else(|| {
+            let pcfg = cfg.providers.get(name).cloned().ok_or_else(|| {
                 anyhow::anyhow!(
                     "Provider '{}' not configured.\nRun 'niko settings configure' to add it.",
                     name
                 )
             })?;
-            from_config(name, pcfg)
+            (name.to_string(), pcfg)
         }
-        None => get_active_provider(),
-    }
+        None => config::active_provider()?,
+    };
+
+    pcfg.options.extend(option_overrides.clone());
+    from_config(&name, &pcfg)
 }
 
 // ─── Helpers ────────────────────────────────────────────────────────────────
 
+/// A few well-known model ids per provider. Only used to hint at typos —
+/// unknown models are always allowed since new ones appear constantly.
+pub fn known_models(provider: &str) -> &'static [&'static str] {
+    match provider {
+        "openai" => &[
+            "gpt-4o",
+            "gpt-4o-mini",
+            "gpt-4.1",
+            "gpt-4.1-mini",
+            "gpt-4.1-nano",
+            "o3-mini",
+            "o4-mini",
+        ],
+        "claude" => &[
+            "claude-opus-4-20250514",
+            "claude-sonnet-4-20250514",
+            "claude-3-7-sonnet-latest",
+            "claude-3-5-haiku-latest",
+        ],
+        "deepseek" => &["deepseek-chat", "deepseek-reasoner"],
+        "grok" => &["grok-3", "grok-3-mini", "grok-2-latest"],
+        "groq" => &[
+            "llama-3.3-70b-versatile",
+            "llama-3.1-8b-instant",
+            "gemma2-9b-it",
+        ],
+        "mistral" => &[
+            "mistral-large-latest",
+            "mistral-small-latest",
+            "codestral-latest",
+        ],
+        _ => &[],
+    }
+}
+
+/// Hint shown when `model` isn't in the provider's known list
+pub fn unknown_model_hint(provider: &str, model: &str) -> Option<String> {
+    let known = known_models(provider);
+    if known.is_empty() || model.is_empty() || known.contains(&model) {
+        return None;
+    }
+    Some(format!(
+        "Model '{}' isn't one niko knows for {}. Known models: {}\n\
+         Change it with: niko settings set {}.model <name>",
+        model,
+        provider,
+        known.join(", "),
+        provider
+    ))
+}
+
+/// Whether an API error means the requested model doesn't exist
+pub fn is_model_not_found(err: &anyhow::Error) -> bool {
+    let msg = format!("{:#}", err).to_lowercase();
+    msg.contains("model_not_found")
+        || msg.contains("does not exist")
+        || (msg.contains("model") && (msg.contains("not found") || msg.contains("404")))
+}
+
 pub fn estimate_param_billions(model_name: &str, size_bytes: u64) -> f64 {
     let lower = model_name.to_lowercase();
-    for token in lower.split(&[':', '-', '_', '.'][..]) {
+    // Not split on '.', so fractional sizes like `1.5b` parse whole
+    for token in lower.split(&[':', '-', '_'][..]) {
         if let Some(num_str) = token.strip_suffix('b') {
             if let Ok(n) = num_str.parse::<f64>() {
                 return n;
@@ -296,6 +599,7 @@ mod tests {
         assert_eq!(estimate_param_billions("qwen2.5-coder:7b", 0), 7.0);
         assert_eq!(estimate_param_billions("llama3.2_1b", 0), 1.0);
         assert_eq!(estimate_param_billions("model-14b-instruct", 0), 14.0);
+        assert_eq!(estimate_param_billions("qwen2.5-coder:1.5b", 0), 1.5);
     }
 
     #[test]
@@ -305,6 +609,114 @@ mod tests {
         assert!((estimated - 1.0).abs() < f64::EPSILON);
     }
 
+    #[test]
+    fn unknown_model_hint_only_for_known_providers() {
+        assert!(unknown_model_hint("openai", "gpt4o")
+            .unwrap()
+            .contains("gpt-4o-mini"));
+        assert_eq!(unknown_model_hint("openai", "gpt-4o"), None);
+        assert_eq!(unknown_model_hint("openrouter", "anything/goes"), None);
+    }
+
+    #[test]
+    fn detects_model_not_found_errors() {
+        let err = anyhow::anyhow!(
+            "openai API error (404): {{\"error\":{{\"code\":\"model_not_found\"}}}}"
+        );
+        assert!(is_model_not_found(&err));
+        assert!(!is_model_not_found(&anyhow::anyhow!("connection refused")));
+    }
+
+    #[test]
+    fn loading_models_are_recognised() {
+        assert!(is_model_loading(&anyhow::anyhow!(
+            "Ollama error (503 Service Unavailable): {{\"error\":\"server busy\"}}"
+        )));
+        assert!(is_model_loading(&anyhow::anyhow!(
+            "model is loading, try again"
+        )));
+        assert!(!is_model_loading(&anyhow::anyhow!(
+            "Ollama error (404 Not Found)"
+        )));
+    }
+
+    #[test]
+    fn rate_limits_are_named_plainly_when_retrying() {
+        let err = anyhow::anyhow!("groq API error (429): {{\"error\":\"slow down\"}}");
+        assert_eq!(retry_reason(&err), "rate limited");
+        assert_eq!(
+            retry_reason(&anyhow::anyhow!("connection reset by peer")),
+            "connection reset by peer"
+        );
+    }
+
+    #[test]
+    fn invalid_utf8_in_streams_is_replaced_not_fatal() {
+        let body: &[u8] = b"{\"a\":1}\r\ncaf\xc3\n\xff\xfeok\n";
+        let lines: Vec<String> = lossy_lines(body).map(Result::unwrap).collect();
+        assert_eq!(lines.len(), 3);
+        assert_eq!(lines[0], "{\"a\":1}");
+        assert_eq!(sanitize(&lines[1]), "caf");
+        assert_eq!(sanitize(&lines[2]), "ok");
+    }
+
+    #[test]
+    fn sanitize_strips_control_characters_but_keeps_layout() {
+        assert_eq!(
+            sanitize("ls\x1b[31m -la\u{7}\n\tgrep x"),
+            "ls -la\n\tgrep x"
+        );
+        assert_eq!(sanitize("\x1b]0;pwned\x07rm\r -i"), "rm -i");
+    }
+
+    #[test]
+    fn cloud_temperature_defaults_and_validates() {
+        let mut pcfg = ProviderConfig::default();
+        assert_eq!(cloud_temperature("openai", &pcfg).unwrap(), 0.1);
+
+        pcfg.options.insert("temperature".into(), "0.5".into());
+        assert_eq!(cloud_temperature("openai", &pcfg).unwrap(), 0.5);
+
+        pcfg.options.insert("temperature".into(), "hot".into());
+        let err = cloud_temperature("openai", &pcfg).unwrap_err();
+        assert!(err.to_string().contains("openai.temperature"));
+
+        pcfg.options.insert("temperature".into(), "3".into());
+        assert!(cloud_temperature("openai", &pcfg).is_err());
+    }
+
+    #[test]
+    fn anthropic_temperature_stops_at_one() {
+        let mut pcfg = ProviderConfig {
+            kind: "anthropic".into(),
+            ..Default::default()
+        };
+        pcfg.options.insert("temperature".into(), "1.5".into());
+        let err = cloud_temperature("claude", &pcfg).unwrap_err();
+        assert!(err.to_string().contains("from 0 to 1,"));
+
+        pcfg.options.insert("temperature".into(), "1".into());
+        assert_eq!(cloud_temperature("claude", &pcfg).unwrap(), 1.0);
+        pcfg.kind = "openai_compat".into();
+        pcfg.options.insert("temperature".into(), "1.5".into());
+        assert_eq!(cloud_temperature("openai", &pcfg).unwrap(), 1.5);
+    }
+
+    #[test]
+    fn structured_output_takes_any_boolean_spelling() {
+        let mut pcfg = ProviderConfig::default();
+        assert!(!structured_output("vllm", &pcfg).unwrap());
+        for (value, expected) in [("true", true), ("yes", true), ("1", true), ("off", false)] {
+            pcfg.options
+                .insert("structured_output".into(), value.into());
+            assert_eq!(structured_output("vllm", &pcfg).unwrap(), expected);
+        }
+        pcfg.options
+            .insert("structured_output".into(), "json".into());
+        let err = structured_output("vllm", &pcfg).unwrap_err();
+        assert!(err.to_string().contains("vllm.structured_output"));
+    }
+
     #[test]
     fn non_positive_model_size_is_always_allowed() {
         assert!(model_fits_in_ram(0.0));
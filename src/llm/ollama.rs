@@ -1,23 +1,126 @@
 use std::collections::HashMap;
-use std::io::{BufRead, BufReader};
 use std::process::Command;
-use std::time::Duration;
+use std::sync::OnceLock;
+use std::time::{Duration, Instant};
 
 use anyhow::{bail, Context, Result};
 use serde::Deserialize;
 
-use crate::llm::{estimate_param_billions, ModelInfo, Provider};
+use crate::cancel;
+use crate::config;
+use crate::llm::{self, estimate_param_billions, Generation, ModelInfo, Provider};
+use crate::progress;
+
+/// Flatten a conversation for /api/generate: system messages become the
+/// `system` field and the rest one prompt. Ollama still wraps it in the
+/// model's template.
+fn generate_prompt(messages: &[crate::llm::Message]) -> (String, String) {
+    use crate::llm::Role;
+
+    let system: Vec<&str> = messages
+        .iter()
+        .filter(|m| m.role == Role::System)
+        .map(|m| m.content.as_str())
+        .collect();
+    let turns: Vec<&crate::llm::Message> =
+        messages.iter().filter(|m| m.role != Role::System).collect();
+
+    let prompt = match turns.as_slice() {
+        [only] => only.content.clone(),
+        _ => turns
+            .iter()
+            .map(|m| {
+                let who = if m.role == Role::User {
+                    "User"
+                } else {
+                    "Assistant"
+                };
+                format!("{}: {}", who, m.content)
+            })
+            .collect::<Vec<_>>()
+            .join("\n\n"),
+    };
+
+    (system.join("\n\n"), prompt)
+}
+
+/// Keep the model resident between queries unless configured otherwise
+const DEFAULT_KEEP_ALIVE: &str = "30m";
+
+/// `ollama.fallback_model`, used when `model` can't be pulled; unset, blank
+/// or the same model means there is none
+fn fallback_model<'a>(options: &'a HashMap<String, String>, model: &str) -> Option<&'a str> {
+    options
+        .get("fallback_model")
+        .map(|m| m.trim())
+        .filter(|m| !m.is_empty() && *m != model)
+}
+
+/// Check `model` against `ollama.min_model`, a size such as `3b` or a
+/// model whose size is the floor. A model whose size its name doesn't
+/// give can't be checked, and is let through with a warning.
+fn check_min_model(options: &HashMap<String, String>, model: &str) -> Result<()> {
+    let Some(floor) = options
+        .get("min_model")
+        .map(|m| m.trim())
+        .filter(|m| !m.is_empty())
+    else {
+        return Ok(());
+    };
+    let min = estimate_param_billions(floor, 0);
+    if min <= 0.0 {
+        bail!(
+            "Invalid ollama.min_model '{}': expected a size like '3b' or a model like 'qwen2.5-coder:3b'",
+            floor
+        );
+    }
+
+    let params = estimate_param_billions(model, 0);
+    if params <= 0.0 {
+        progress::eprint_line(&format!(
+            "  Can't tell the size of '{}' from its name; ollama.min_model ({}) not checked",
+            model, floor
+        ));
+        return Ok(());
+    }
+    if params < min {
+        let suggested = RECOMMENDED_MODELS
+            .iter()
+            .find(|(_, p)| *p >= min)
+            .map_or(floor, |(name, _)| *name);
+        bail!(
+            "Model '{}' ({}B) is smaller than ollama.min_model ({}).\n\
+             Switch with: niko settings set ollama.model {}",
+            model,
+            params,
+            floor,
+            suggested
+        );
+    }
+    Ok(())
+}
 
 pub struct OllamaProvider {
     base_url: String,
     model: String,
+    /// `fallback_model`, once it has replaced a model that couldn't be pulled
+    fallback: OnceLock<String>,
     options: HashMap<String, String>,
     client: reqwest::blocking::Client,
 }
 
+/// Response from /api/chat (`message`) or /api/generate (`response`)
 #[derive(Deserialize)]
 struct ChatResponse {
     message: Option<ChatMessage>,
+    #[serde(default)]
+    response: Option<String>,
+    #[serde(default)]
+    model: Option<String>,
+    #[serde(default)]
+    prompt_eval_count: Option<u32>,
+    #[serde(default)]
+    eval_count: Option<u32>,
 }
 
 #[derive(Deserialize)]
@@ -30,6 +133,8 @@ struct ChatMessage {
 struct StreamChunk {
     message: Option<StreamMessage>,
     #[serde(default)]
+    response: Option<String>,
+    #[serde(default)]
     done: bool,
 }
 
@@ -39,6 +144,11 @@ struct StreamMessage {
     content: String,
 }
 
+#[derive(Deserialize)]
+struct EmbeddingResponse {
+    embedding: Vec<f32>,
+}
+
 #[derive(Deserialize)]
 struct TagsResponse {
     models: Option<Vec<OllamaModel>>,
@@ -69,14 +179,45 @@ impl OllamaProvider {
             .build()
             .context("Failed to create HTTP client")?;
 
+        // Hand-edited configs skip `settings set`, so normalize here too
+        let base_url = config::normalize_base_url(base_url)
+            .with_context(|| format!("Bad Ollama base_url '{}'", base_url))?;
+
         Ok(Self {
-            base_url: base_url.trim_end_matches('/').to_string(),
+            base_url,
             model: model.to_string(),
+            fallback: OnceLock::new(),
             options,
             client,
         })
     }
 
+    /// Embed `text` with `model` via /api/embeddings
+    pub fn embed(&self, model: &str, text: &str) -> Result<Vec<f32>> {
+        let resp = self
+            .client
+            .post(format!("{}/api/embeddings", self.base_url))
+            .json(&serde_json::json!({ "model": model, "prompt": text }))
+            .send()
+            .context("Failed to call Ollama for embeddings")?;
+
+        if !resp.status().is_success() {
+            let status = resp.status();
+            let text = resp.text().unwrap_or_default();
+            bail!("Ollama embeddings error ({}): {}", status, text);
+        }
+
+        let parsed: EmbeddingResponse =
+            llm::parse_json(resp).context("Failed to parse Ollama embeddings")?;
+        if parsed.embedding.is_empty() {
+            bail!(
+                "Ollama returned no embedding (is '{}' an embedding model?)",
+                model
+            );
+        }
+        Ok(parsed.embedding)
+    }
+
     fn opt_f64(&self, key: &str, default: f64) -> f64 {
         self.options
             .get(key)
@@ -91,6 +232,18 @@ impl OllamaProvider {
             .unwrap_or(default)
     }
 
+    /// How long Ollama keeps the model loaded after a request. Plain numbers
+    /// are seconds (`-1` = forever); anything else is a duration like `10m`.
+    fn keep_alive(&self) -> serde_json::Value {
+        match self.options.get("keep_alive").map(|v| v.trim()) {
+            Some(v) if !v.is_empty() => match v.parse::<i64>() {
+                Ok(secs) => secs.into(),
+                Err(_) => v.into(),
+            },
+            _ => DEFAULT_KEEP_ALIVE.into(),
+        }
+    }
+
     fn is_server_running(&self) -> bool {
         self.client
             .get(format!("{}/api/tags", self.base_url))
@@ -143,7 +296,7 @@ impl OllamaProvider {
     }
 
     pub fn pull_model(&self, model: &str) -> Result<()> {
-        eprintln!("  Downloading '{}'...", model);
+        progress::eprint_line(&format!("  Downloading '{}'...", model));
 
         let body = serde_json::json!({ "name": model, "stream": true });
         let resp = self
@@ -160,10 +313,12 @@ impl OllamaProvider {
             bail!("Ollama pull failed ({}): {}", status, text);
         }
 
-        let reader = BufReader::new(resp);
+        // Ollama keeps the layers it has so far and resumes from them, so an
+        // interrupted pull costs nothing but the time already spent
+        let _note = cancel::note_on_cancel("download cancelled; run it again to resume");
         let mut last_status = String::new();
 
-        for line in reader.lines() {
+        for line in llm::lossy_lines(resp) {
             let line = match line {
                 Ok(l) => l,
                 Err(_) => continue,
@@ -176,15 +331,15 @@ impl OllamaProvider {
                 if let (Some(done), Some(total)) = (p.completed, p.total) {
                     if total > 0 {
                         let pct = (done as f64 / total as f64) * 100.0;
-                        eprint!("\r  {}: {:.1}%   ", status, pct);
+                        progress::status(&format!("  {}: {:.1}%", status, pct));
                     }
                 } else if status != last_status {
-                    eprint!("\r  {}          ", status);
+                    progress::status(&format!("  {}", status));
                 }
                 last_status = status;
             }
         }
-        eprintln!();
+        progress::end_status();
         Ok(())
     }
 
@@ -192,18 +347,95 @@ impl OllamaProvider {
         if self.model.is_empty() {
             bail!(
                 "No model selected for Ollama.\n\
-                 Run 'niko settings configure' to select a model."
+                 Run 'niko settings configure' to select a model,\n\
+                 or 'niko settings init --local' to download a recommended one."
             );
         }
 
-        if !self.has_model(&self.model) {
-            eprintln!("  Model '{}' not found locally, pulling...", self.model);
-            self.pull_model(&self.model)?;
+        if self.fallback.get().is_some() {
+            return Ok(());
+        }
+        check_min_model(&self.options, &self.model)?;
+        if self.has_model(&self.model) {
+            return Ok(());
         }
+        if self.options.get("offline").is_some_and(|v| v == "true") {
+            bail!(
+                "Model '{}' isn't downloaded and offline mode is on.\n\
+                 Pull it while online with: ollama pull {}",
+                self.model,
+                self.model
+            );
+        }
+        progress::eprint_line(&format!(
+            "  Model '{}' not found locally, pulling...",
+            self.model
+        ));
+        let err = match self.pull_model(&self.model) {
+            Ok(()) => return Ok(()),
+            Err(e) => e,
+        };
 
+        let Some(fallback) = fallback_model(&self.options, &self.model) else {
+            return Err(err);
+        };
+        check_min_model(&self.options, fallback)
+            .with_context(|| format!("Not falling back (after: {:#})", err))?;
+        progress::eprint_line(&format!(
+            "  Couldn't download '{}' ({:#}); trying fallback model '{}'...",
+            self.model, err, fallback
+        ));
+        if !self.has_model(fallback) {
+            self.pull_model(fallback).with_context(|| {
+                format!(
+                    "Fallback model '{}' couldn't be downloaded either (after: {:#})",
+                    fallback, err
+                )
+            })?;
+        }
+        let _ = self.fallback.set(fallback.to_string());
+        self.keep_fallback(fallback, &err);
         Ok(())
     }
 
+    /// Point `ollama.model` at the fallback, so the next run doesn't try the
+    /// failing model again. Left alone when the failing model came from
+    /// somewhere else (`NIKO_MODEL`, say) rather than the config file.
+    fn keep_fallback(&self, fallback: &str, reason: &anyhow::Error) {
+        match config::replace_provider_model("ollama", &self.model, fallback) {
+            Ok(true) => progress::eprint_line(&format!(
+                "  ollama.model is now '{}' instead of '{}', which failed to download: {:#}\n  \
+                 Switch back with: niko settings set ollama.model {}",
+                fallback, self.model, reason, self.model
+            )),
+            Ok(false) => progress::eprint_line(&format!(
+                "  Using '{}' for this run; the config still names another model",
+                fallback
+            )),
+            Err(e) => progress::eprint_line(&format!(
+                "  Using '{}', but couldn't update the config: {:#}",
+                fallback, e
+            )),
+        }
+    }
+
+    /// `api_mode: generate` uses the raw /api/generate endpoint, which some
+    /// older models handle better than /api/chat
+    fn uses_generate_api(&self) -> bool {
+        self.options
+            .get("api_mode")
+            .is_some_and(|m| m.trim() == "generate")
+    }
+
+    fn endpoint(&self) -> String {
+        let api = if self.uses_generate_api() {
+            "generate"
+        } else {
+            "chat"
+        };
+        format!("{}/api/{}", self.base_url, api)
+    }
+
     /// Build the request body with performance optimizations
     fn build_request_body(
         &self,
@@ -244,12 +476,12 @@ impl OllamaProvider {
         let top_p = self.opt_f64("top_p", 0.9);
         let top_k = self.opt_u32("top_k", 40);
         let repeat_penalty = self.opt_f64("repeat_penalty", 1.1);
+        let keep_alive = self.keep_alive();
 
-        serde_json::json!({
-            "model": self.model,
-            "messages": api_messages,
+        let mut body = serde_json::json!({
+            "model": self.model(),
             "stream": stream,
-            "keep_alive": "30m",
+            "keep_alive": keep_alive,
             "options": {
                 "temperature": temperature,
                 "num_predict": max_tokens,
@@ -260,7 +492,22 @@ impl OllamaProvider {
                 "repeat_penalty": repeat_penalty,
                 "flash_attn": true
             }
-        })
+        });
+
+        if self.uses_generate_api() {
+            let (system, prompt) = generate_prompt(messages);
+            body["system"] = system.into();
+            body["prompt"] = prompt.into();
+        } else {
+            body["messages"] = api_messages.into();
+        }
+
+        // Fixed seed + temperature 0 makes local output reproducible
+        if let Some(seed) = self.options.get("seed").and_then(|v| v.parse::<i64>().ok()) {
+            body["options"]["seed"] = seed.into();
+        }
+
+        body
     }
 }
 
@@ -269,14 +516,27 @@ impl Provider for OllamaProvider {
         "ollama"
     }
 
+    fn model(&self) -> &str {
+        self.fallback.get().unwrap_or(&self.model)
+    }
+
     fn is_available(&self) -> bool {
         self.is_server_running()
     }
 
-    fn generate(&self, messages: &[crate::llm::Message], max_tokens: u32) -> Result<String> {
-        // No pre-check — just attempt the request, handle errors directly
-        let body = self.build_request_body(messages, max_tokens, false);
+    fn is_local(&self) -> bool {
+        true
+    }
 
+    fn context_size(&self) -> Option<u32> {
+        self.options.get("num_ctx").and_then(|v| v.parse().ok())
+    }
+
+    fn generate_with_meta(
+        &self,
+        messages: &[crate::llm::Message],
+        max_tokens: u32,
+    ) -> Result<Generation> {
         // Ensure model is pulled (only checks on first call, then server has it cached)
         self.ensure_model_available().map_err(|e| {
             if format!("{:#}", e).contains("connect") {
@@ -291,9 +551,14 @@ impl Provider for OllamaProvider {
             }
         })?;
 
+        // No pre-check — just attempt the request, handle errors directly
+        // (built after the check, which may have switched to the fallback)
+        let body = self.build_request_body(messages, max_tokens, false);
+
+        let started = Instant::now();
         let resp = self
             .client
-            .post(format!("{}/api/chat", self.base_url))
+            .post(self.endpoint())
             .json(&body)
             .send()
             .map_err(|e| {
@@ -314,15 +579,33 @@ impl Provider for OllamaProvider {
             bail!("Ollama error ({}): {}", status, text);
         }
 
-        let chat: ChatResponse = resp.json().context("Failed to parse Ollama response")?;
-        let content = chat.message.map(|m| m.content).unwrap_or_default();
+        let chat: ChatResponse =
+            llm::parse_json(resp).context("Failed to parse Ollama response")?;
+        let latency = started.elapsed();
+        let content = chat
+            .message
+            .map(|m| m.content)
+            .or(chat.response)
+            .unwrap_or_default();
         let trimmed = content.trim();
 
         if trimmed.is_empty() {
             bail!("Ollama returned empty response");
         }
 
-        Ok(trimmed.to_string())
+        Ok(Generation {
+            text: trimmed.to_string(),
+            model: chat.model.unwrap_or_else(|| self.model().to_string()),
+            prompt_tokens: chat.prompt_eval_count,
+            completion_tokens: chat.eval_count,
+            latency,
+            note: None,
+            forced: false,
+        })
+    }
+
+    fn supports_streaming(&self) -> bool {
+        true
     }
 
     fn generate_stream(
@@ -346,7 +629,7 @@ impl Provider for OllamaProvider {
 
         let resp = self
             .client
-            .post(format!("{}/api/chat", self.base_url))
+            .post(self.endpoint())
             .json(&body)
             .send()
             .map_err(|e| {
@@ -366,10 +649,9 @@ impl Provider for OllamaProvider {
             bail!("Ollama error ({}): {}", status, text);
         }
 
-        let reader = BufReader::new(resp);
         let mut accumulated = String::new();
 
-        for line in reader.lines() {
+        for line in llm::lossy_lines(resp) {
             let line = match line {
                 Ok(l) => l,
                 Err(e) => {
@@ -386,11 +668,10 @@ impl Provider for OllamaProvider {
 
             match serde_json::from_str::<StreamChunk>(&line) {
                 Ok(chunk) => {
-                    if let Some(msg) = chunk.message {
-                        if !msg.content.is_empty() {
-                            on_token(&msg.content);
-                            accumulated.push_str(&msg.content);
-                        }
+                    let text = chunk.message.map(|m| m.content).or(chunk.response);
+                    if let Some(text) = text.filter(|t| !t.is_empty()) {
+                        on_token(&text);
+                        accumulated.push_str(&text);
                     }
                     if chunk.done {
                         break;
@@ -440,7 +721,17 @@ pub fn is_ollama_running() -> bool {
         .unwrap_or(false)
 }
 
+/// Shown instead of installing when `ollama.auto_install` is off
+const MANUAL_INSTALL: &str = "Ollama is not installed, and automatic installation is disabled \
+(ollama.auto_install: false or $NIKO_NO_AUTO_INSTALL).\n\
+Install it yourself from https://ollama.com/download (or your package manager), \
+then check with: ollama --version";
+
+/// Download and run the official installer, unless that's been disabled
 pub fn install_ollama() -> Result<()> {
+    if !crate::config::auto_install_allowed(crate::config::get(), |var| std::env::var(var).ok()) {
+        bail!("{}", MANUAL_INSTALL);
+    }
     eprintln!("  Installing Ollama...");
     if cfg!(target_os = "macos") || cfg!(target_os = "linux") {
         let status = Command::new("sh")
@@ -472,6 +763,28 @@ pub fn install_ollama() -> Result<()> {
     Ok(())
 }
 
+/// Coding models offered by `niko settings init --local`, smallest first.
+/// 7B is plenty for shell commands and stays fast, so we stop there.
+pub const RECOMMENDED_MODELS: &[(&str, f64)] = &[
+    ("qwen2.5-coder:1.5b", 1.5),
+    ("qwen2.5-coder:3b", 3.0),
+    ("qwen2.5-coder:7b", 7.0),
+];
+
+/// The largest recommended model that fits in this machine's RAM
+pub fn recommended_model() -> &'static str {
+    recommended_model_for(crate::config::max_model_size_for_ram() as f64)
+}
+
+fn recommended_model_for(max_params: f64) -> &'static str {
+    RECOMMENDED_MODELS
+        .iter()
+        .rev()
+        .find(|(_, params)| *params <= max_params)
+        .map(|(name, _)| *name)
+        .unwrap_or(RECOMMENDED_MODELS[0].0)
+}
+
 pub fn search_ollama_models(query: &str) -> Result<Vec<ModelInfo>> {
     let known_models = vec![
         ("qwen2.5-coder:0.5b", 0.5),
@@ -521,3 +834,110 @@ pub fn search_ollama_models(query: &str) -> Result<Vec<ModelInfo>> {
         })
         .collect())
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::llm::{Message, Role};
+
+    fn provider(options: &[(&str, &str)]) -> OllamaProvider {
+        let options = options
+            .iter()
+            .map(|(k, v)| (k.to_string(), v.to_string()))
+            .collect();
+        OllamaProvider::new("http://127.0.0.1:11434", "qwen2.5-coder:7b", options).unwrap()
+    }
+
+    #[test]
+    fn fallback_model_replaces_the_model_once_set() {
+        let p = provider(&[("fallback_model", " llama3.2:3b ")]);
+        assert_eq!(fallback_model(&p.options, &p.model), Some("llama3.2:3b"));
+        assert_eq!(fallback_model(&p.options, "llama3.2:3b"), None);
+        assert_eq!(
+            fallback_model(&provider(&[("fallback_model", "")]).options, &p.model),
+            None
+        );
+
+        let messages = [Message {
+            role: Role::User,
+            content: "list files".into(),
+        }];
+        assert_eq!(p.model(), "qwen2.5-coder:7b");
+        p.fallback.set("llama3.2:3b".into()).unwrap();
+        assert_eq!(p.model(), "llama3.2:3b");
+        assert_eq!(
+            p.build_request_body(&messages, 64, false)["model"],
+            "llama3.2:3b"
+        );
+    }
+
+    #[test]
+    fn min_model_rejects_smaller_models() {
+        let floor = |v: &str| provider(&[("min_model", v)]).options;
+
+        assert!(check_min_model(&floor("3b"), "qwen2.5-coder:3b").is_ok());
+        assert!(check_min_model(&floor("3b"), "qwen2.5-coder:7b").is_ok());
+        let err = check_min_model(&floor("qwen2.5-coder:3b"), "qwen2.5-coder:1.5b")
+            .unwrap_err()
+            .to_string();
+        assert!(err.contains("smaller than ollama.min_model"));
+        assert!(err.contains("niko settings set ollama.model qwen2.5-coder:3b"));
+
+        assert!(check_min_model(&floor("big"), "qwen2.5-coder:7b").is_err());
+        assert!(check_min_model(&floor("3b"), "codellama:latest").is_ok());
+        assert!(check_min_model(&floor(""), "qwen2.5-coder:0.5b").is_ok());
+    }
+
+    #[test]
+    fn seed_option_reaches_request_body() {
+        let messages = [Message {
+            role: Role::User,
+            content: "list files".into(),
+        }];
+
+        let body = provider(&[("seed", "42")]).build_request_body(&messages, 64, false);
+        assert_eq!(body["options"]["seed"], 42);
+
+        let body = provider(&[]).build_request_body(&messages, 64, false);
+        assert!(body["options"].get("seed").is_none());
+    }
+
+    #[test]
+    fn recommended_model_scales_with_ram_and_caps_at_7b() {
+        assert_eq!(recommended_model_for(0.0), "qwen2.5-coder:1.5b");
+        assert_eq!(recommended_model_for(4.0), "qwen2.5-coder:3b");
+        assert_eq!(recommended_model_for(60.0), "qwen2.5-coder:7b");
+    }
+
+    #[test]
+    fn generate_api_mode_sends_system_and_prompt() {
+        let messages = [
+            Message {
+                role: Role::System,
+                content: "You are Niko".into(),
+            },
+            Message {
+                role: Role::User,
+                content: "list files".into(),
+            },
+        ];
+
+        let p = provider(&[("api_mode", "generate")]);
+        assert!(p.endpoint().ends_with("/api/generate"));
+        let body = p.build_request_body(&messages, 64, false);
+        assert_eq!(body["system"], "You are Niko");
+        assert_eq!(body["prompt"], "list files");
+        assert!(body.get("messages").is_none());
+
+        let p = provider(&[]);
+        assert!(p.endpoint().ends_with("/api/chat"));
+        assert!(p.build_request_body(&messages, 64, false)["messages"].is_array());
+    }
+
+    #[test]
+    fn keep_alive_accepts_durations_and_seconds() {
+        assert_eq!(provider(&[]).keep_alive(), "30m");
+        assert_eq!(provider(&[("keep_alive", "10m")]).keep_alive(), "10m");
+        assert_eq!(provider(&[("keep_alive", "-1")]).keep_alive(), -1);
+    }
+}
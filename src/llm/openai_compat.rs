@@ -1,10 +1,11 @@
-use std::io::{BufRead, BufReader};
-use std::time::Duration;
+use std::time::{Duration, Instant};
 
 use anyhow::{bail, Context, Result};
+use reqwest::header::HeaderMap;
 use serde::Deserialize;
 
-use crate::llm::{estimate_param_billions, ModelInfo, Provider};
+use crate::llm::{self, estimate_param_billions, Generation, Message, ModelInfo, Provider, Role};
+use crate::progress;
 
 /// OpenAI-compatible provider with SSE streaming support
 pub struct OpenAICompatProvider {
@@ -12,6 +13,10 @@ pub struct OpenAICompatProvider {
     api_key: String,
     base_url: String,
     model: String,
+    /// Sampling temperature (`<provider>.temperature`, default 0.1)
+    temperature: f64,
+    /// Ask for commands as JSON (`<provider>.structured_output`)
+    structured: bool,
     client: reqwest::blocking::Client,
 }
 
@@ -19,9 +24,21 @@ pub struct OpenAICompatProvider {
 struct ChatCompletionResponse {
     choices: Option<Vec<Choice>>,
     #[serde(default)]
+    model: Option<String>,
+    #[serde(default)]
+    usage: Option<Usage>,
+    #[serde(default)]
     error: Option<ApiError>,
 }
 
+#[derive(Deserialize)]
+struct Usage {
+    #[serde(default)]
+    prompt_tokens: Option<u32>,
+    #[serde(default)]
+    completion_tokens: Option<u32>,
+}
+
 #[derive(Deserialize)]
 struct Choice {
     message: ChoiceMessage,
@@ -69,8 +86,17 @@ struct ApiModel {
 }
 
 impl OpenAICompatProvider {
-    pub fn new(provider_name: &str, api_key: &str, base_url: &str, model: &str) -> Self {
+    pub fn new(
+        provider_name: &str,
+        api_key: &str,
+        base_url: &str,
+        model: &str,
+        temperature: f64,
+        structured: bool,
+        headers: HeaderMap,
+    ) -> Self {
         let client = reqwest::blocking::Client::builder()
+            .default_headers(headers)
             .timeout(Duration::from_secs(120))
             .connect_timeout(Duration::from_secs(10))
             .pool_max_idle_per_host(4)
@@ -84,6 +110,8 @@ impl OpenAICompatProvider {
             api_key: api_key.to_string(),
             base_url: base_url.trim_end_matches('/').to_string(),
             model: model.to_string(),
+            temperature,
+            structured,
             client,
         }
     }
@@ -103,30 +131,10 @@ impl OpenAICompatProvider {
         }
         Ok(())
     }
-}
-
-impl Provider for OpenAICompatProvider {
-    fn name(&self) -> &str {
-        &self.provider_name
-    }
-
-    fn is_available(&self) -> bool {
-        !self.api_key.is_empty()
-    }
-
-    fn generate(&self, system_prompt: &str, user_prompt: &str, max_tokens: u32) -> Result<String> {
-        self.validate()?;
-
-        let body = serde_json::json!({
-            "model": self.model,
-            "messages": [
-                { "role": "system", "content": system_prompt },
-                { "role": "user", "content": user_prompt }
-            ],
-            "temperature": 0.1,
-            "max_tokens": max_tokens,
-        });
 
+    /// POST a (non-streaming) chat completion request
+    fn complete(&self, body: serde_json::Value) -> Result<Generation> {
+        let started = Instant::now();
         let resp = self
             .client
             .post(format!("{}/chat/completions", self.base_url))
@@ -147,9 +155,9 @@ impl Provider for OpenAICompatProvider {
             );
         }
 
-        let completion: ChatCompletionResponse = resp
-            .json()
+        let completion: ChatCompletionResponse = llm::parse_json(resp)
             .with_context(|| format!("Failed to parse {} response", self.provider_name))?;
+        let latency = started.elapsed();
 
         if let Some(err) = completion.error {
             if let Some(msg) = err.message {
@@ -162,7 +170,7 @@ impl Provider for OpenAICompatProvider {
         let content = match choice {
             Some(c) => {
                 if c.finish_reason.as_deref() == Some("length") {
-                    eprintln!("  ⚠ Response truncated (hit max_tokens)");
+                    progress::eprint_line("  ⚠ Response truncated (hit max_tokens)");
                 }
                 c.message.content.unwrap_or_default()
             }
@@ -174,13 +182,87 @@ impl Provider for OpenAICompatProvider {
             bail!("{} returned empty response", self.provider_name);
         }
 
-        Ok(trimmed.to_string())
+        let usage = completion.usage;
+        Ok(Generation {
+            text: trimmed.to_string(),
+            model: completion.model.unwrap_or_else(|| self.model.clone()),
+            prompt_tokens: usage.as_ref().and_then(|u| u.prompt_tokens),
+            completion_tokens: usage.as_ref().and_then(|u| u.completion_tokens),
+            latency,
+            note: None,
+            forced: false,
+        })
+    }
+}
+
+/// Convert chat messages to the OpenAI wire format
+fn api_messages(messages: &[Message]) -> Vec<serde_json::Value> {
+    messages
+        .iter()
+        .map(|msg| {
+            let role_str = match msg.role {
+                Role::System => "system",
+                Role::User => "user",
+                Role::Assistant => "assistant",
+            };
+            serde_json::json!({ "role": role_str, "content": msg.content })
+        })
+        .collect()
+}
+
+impl Provider for OpenAICompatProvider {
+    fn name(&self) -> &str {
+        &self.provider_name
+    }
+
+    fn model(&self) -> &str {
+        &self.model
+    }
+
+    fn is_available(&self) -> bool {
+        !self.api_key.is_empty()
+    }
+
+    fn generate_with_meta(&self, messages: &[Message], max_tokens: u32) -> Result<Generation> {
+        self.validate()?;
+        self.complete(serde_json::json!({
+            "model": self.model,
+            "messages": api_messages(messages),
+            "temperature": self.temperature,
+            "max_tokens": max_tokens,
+        }))
+    }
+
+    fn supports_structured_output(&self) -> bool {
+        self.structured
+    }
+
+    fn generate_json(
+        &self,
+        messages: &[Message],
+        max_tokens: u32,
+        schema: &serde_json::Value,
+    ) -> Result<Generation> {
+        self.validate()?;
+        self.complete(serde_json::json!({
+            "model": self.model,
+            "messages": api_messages(messages),
+            "temperature": self.temperature,
+            "max_tokens": max_tokens,
+            "response_format": {
+                "type": "json_schema",
+                "json_schema": { "name": "answer", "strict": true, "schema": schema },
+            },
+        }))
+    }
+
+    fn supports_streaming(&self) -> bool {
+        true
     }
 
     fn generate_stream(
         &self,
-        system_prompt: &str,
-        user_prompt: &str,
+        messages: &[Message],
         max_tokens: u32,
         on_token: &mut dyn FnMut(&str),
     ) -> Result<String> {
@@ -188,11 +270,8 @@ impl Provider for OpenAICompatProvider {
 
         let body = serde_json::json!({
             "model": self.model,
-            "messages": [
-                { "role": "system", "content": system_prompt },
-                { "role": "user", "content": user_prompt }
-            ],
-            "temperature": 0.1,
+            "messages": api_messages(messages),
+            "temperature": self.temperature,
             "max_tokens": max_tokens,
             "stream": true,
         });
@@ -217,10 +296,9 @@ impl Provider for OpenAICompatProvider {
             );
         }
 
-        let reader = BufReader::new(resp);
         let mut accumulated = String::new();
 
-        for line in reader.lines() {
+        for line in llm::lossy_lines(resp) {
             let line = match line {
                 Ok(l) => l,
                 Err(e) => {
@@ -254,7 +332,7 @@ impl Provider for OpenAICompatProvider {
                                 }
                             }
                             if choice.finish_reason.as_deref() == Some("length") {
-                                eprintln!("\n  ⚠ Response truncated (hit max_tokens)");
+                                progress::eprint_line("\n  ⚠ Response truncated (hit max_tokens)");
                             }
                         }
                     }
@@ -1,18 +1,37 @@
+mod audit;
+mod bookmarks;
+mod cancel;
+mod completion;
 mod config;
+mod date;
+mod editor;
+mod examples;
+mod exec;
+mod history;
+mod hooks;
+mod lint;
 mod llm;
 mod modes;
+mod output;
+mod placeholders;
+mod preview;
+mod progress;
 mod prompt;
+mod safety;
 
 mod tui;
 
-use clap::{Parser, Subcommand};
+use std::io::IsTerminal;
+use std::path::PathBuf;
+
+use clap::{CommandFactory, Parser, Subcommand};
 use colored::Colorize;
 
 #[derive(Parser)]
 #[command(
     name = "niko",
     version,
-    about = "AI-powered CLI: explain code, generate commands, manage LLM providers",
+    about = "AI-powered CLI: generate and explain shell commands, manage LLM providers",
     long_about = "Niko is an AI-powered CLI conversational assistant.\n\n\
     • niko settings configure        — Set up any LLM provider dynamically\n\
     \n\
@@ -30,6 +49,146 @@ struct Cli {
     #[arg(short, long, global = true)]
     verbose: bool,
 
+    /// Answer yes to confirmations: with --exec, dangerous commands run
+    /// without asking (critical ones still ask)
+    #[arg(short, long, global = true)]
+    yes: bool,
+
+    /// Use this config file instead of ~/.niko/config.yaml (overrides $NIKO_CONFIG)
+    #[arg(long, global = true, value_name = "PATH")]
+    config: Option<PathBuf>,
+
+    /// Take OS, shell, cwd and tools from this JSON file instead of
+    /// detecting them, for reproducible prompts
+    #[arg(long, global = true, value_name = "PATH")]
+    context_file: Option<PathBuf>,
+
+    /// Compose the query in $EDITOR (same as passing `-` as the query;
+    /// with stdin piped, `-` reads the query from it instead)
+    #[arg(long)]
+    edit_query: bool,
+
+    /// How to print the result: text, json, markdown, quiet or script
+    #[arg(long, value_enum, value_name = "FORMAT", default_value_t = output::Format::Text)]
+    output: output::Format,
+
+    /// Wrap the command in a ``` fenced block (same as `--output markdown`)
+    #[arg(long, conflicts_with = "output")]
+    markdown: bool,
+
+    /// Fixed sampling seed for reproducible output from local models
+    #[arg(long, value_name = "N")]
+    seed: Option<i64>,
+
+    /// Only tell the model about these tools, e.g. `--context-tools git,rg,fd`
+    #[arg(long, value_name = "TOOLS", value_delimiter = ',')]
+    context_tools: Vec<String>,
+
+    /// Print the model's answer verbatim (trimmed) without extracting the command
+    #[arg(long)]
+    no_clean: bool,
+
+    /// Open the generated command in $EDITOR before printing (or running) it
+    #[arg(long)]
+    edit: bool,
+
+    /// Run the generated command instead of printing it (dangerous ones ask first)
+    #[arg(short = 'x', long)]
+    exec: bool,
+
+    /// With --exec, if the command fails, offer one corrected command based
+    /// on its error output
+    #[arg(long, requires = "exec")]
+    fix: bool,
+
+    /// With --exec, show a diff of what `sed -i` or a `>`/`>>` redirect
+    /// would change and ask before running it
+    #[arg(long, requires = "exec")]
+    diff: bool,
+
+    /// Never call cloud providers; fail fast if Ollama is down (also $NIKO_OFFLINE)
+    #[arg(long)]
+    offline: bool,
+
+    /// Don't switch to `ollama.fallback_model` when the model can't be
+    /// pulled; fail with the pull's own error
+    #[arg(long)]
+    no_fallback: bool,
+
+    /// Describe this directory to the model and run `--exec` commands in it
+    #[arg(long, value_name = "DIR")]
+    cwd: Option<PathBuf>,
+
+    /// Print how long generation took (without the rest of --verbose)
+    #[arg(long)]
+    time: bool,
+
+    /// For a dangerous command, explain what it would do instead of running it
+    #[arg(long, conflicts_with = "exec")]
+    what_if: bool,
+
+    /// If the model refuses a benign request, retry once with softened
+    /// instructions (risk checks still apply)
+    #[arg(long)]
+    force: bool,
+
+    /// Generate up to N alternative commands and list them
+    #[arg(
+        short = 'n',
+        long = "candidates",
+        value_name = "N",
+        default_value_t = 1,
+        conflicts_with_all = ["exec", "edit", "what_if"]
+    )]
+    candidates: usize,
+
+    /// Give the command for both macOS and Linux, labelled, when they differ
+    #[arg(long, conflicts_with_all = ["exec", "edit", "what_if", "candidates"])]
+    both: bool,
+
+    /// Don't check that the command's programs are installed (also
+    /// `ui.tool_check: false`)
+    #[arg(long)]
+    no_tool_check: bool,
+
+    /// Ask several providers at once and use the first valid command, e.g.
+    /// `--race ollama,openai` (costs a call to each)
+    #[arg(
+        long,
+        value_name = "PROVIDERS",
+        value_delimiter = ',',
+        conflicts_with_all = ["candidates", "both", "offline", "prompt_only"]
+    )]
+    race: Vec<String>,
+
+    /// Steer the model toward one tool when several would do, e.g. `--using fd`
+    #[arg(long, value_name = "TOOL", conflicts_with = "both")]
+    using: Option<String>,
+
+    /// First have a model rewrite a terse query ("big files") into a fuller
+    /// instruction, then generate from that (`prompt.expand_provider` picks
+    /// the model; -v shows the rewrite)
+    #[arg(long, conflicts_with = "prompt_only")]
+    expand: bool,
+
+    /// Generate the command for a remote host and run it there over ssh,
+    /// e.g. `--ssh deploy@web1` (`ssh.by_host` describes the host's system)
+    #[arg(
+        long,
+        value_name = "DESTINATION",
+        conflicts_with_all = ["cwd", "fix", "diff", "candidates", "both"]
+    )]
+    ssh: Option<String>,
+
+    /// Print the system and user prompt that would be sent, then stop
+    /// without calling the model
+    #[arg(long, conflicts_with = "both")]
+    prompt_only: bool,
+
+    /// Keep a note with this query's history entry (shown by `niko history`)
+    #[arg(long, value_name = "TEXT")]
+    note: Option<String>,
+
     /// Default mode: remaining args are treated as a command query
     #[arg(trailing_var_arg = true)]
     query: Vec<String>,
@@ -43,49 +202,233 @@ enum Commands {
         action: Option<SettingsAction>,
     },
 
+    /// List providers and whether each can be used right now
+    Providers,
+
+    /// Explain what an existing shell command does, with its risk level
+    Explain {
+        /// The command, quoted (e.g. `niko explain "find . -mtime +30 -delete"`)
+        #[arg(required = true, trailing_var_arg = true, allow_hyphen_values = true)]
+        command: Vec<String>,
+    },
+
+    /// Summarize what a shell command does in one line, e.g. for a changelog
+    Describe {
+        /// The command, quoted
+        #[arg(required = true, trailing_var_arg = true, allow_hyphen_values = true)]
+        command: Vec<String>,
+    },
+
+    /// Translate many queries at once: one per line in, one JSON object per line out
+    Batch {
+        /// File with one query per line (default: stdin; `#` lines are skipped)
+        file: Option<PathBuf>,
+    },
+
+    /// Show recent commands with their notes, or annotate one
+    History {
+        #[command(subcommand)]
+        action: Option<HistoryAction>,
+        /// How many recent entries to list
+        #[arg(short = 'n', long, default_value_t = 20)]
+        limit: usize,
+    },
+
+    /// Save the last generated command under a name, for `niko run`
+    Save {
+        name: String,
+        /// Replace an existing bookmark with this name
+        #[arg(short, long)]
+        force: bool,
+    },
+
+    /// Print (or with --exec, run) a command kept with `niko save`
+    Run {
+        name: String,
+        /// Run it instead of printing it (dangerous ones ask first)
+        #[arg(short = 'x', long)]
+        exec: bool,
+    },
+
+    /// List commands kept with `niko save`
+    Saved,
+
+    /// Summarize usage from the history log
+    Stats {
+        /// Only include queries on or after this date (YYYY-MM-DD)
+        #[arg(long)]
+        since: Option<String>,
+        /// Only include queries on or before this date (YYYY-MM-DD)
+        #[arg(long)]
+        until: Option<String>,
+    },
+
+    /// Delete niko's config, history and caches (~/.niko)
+    Reset {
+        /// Keep the config file
+        #[arg(long)]
+        keep_config: bool,
+    },
+
+    /// Print a shell completion script, e.g. `niko completion zsh > ~/.zfunc/_niko`
+    Completion { shell: completion::Shell },
+
+    /// Candidates for the completion scripts (one per line)
+    #[command(name = "__complete", hide = true)]
+    Complete {
+        /// Words typed so far, after `--` so flags among them aren't parsed
+        #[arg(raw = true)]
+        words: Vec<String>,
+    },
+
+    /// Check the local model
+    Local {
+        #[command(subcommand)]
+        action: LocalAction,
+    },
+
     /// Print version information
-    Version,
+    Version {
+        /// Print version, commit, build date, OS and architecture as JSON
+        #[arg(long)]
+        json: bool,
+    },
 }
 
 #[derive(Subcommand)]
 enum SettingsAction {
     /// Show current configuration
-    Show,
+    Show {
+        /// List every resolved setting with where its value came from
+        /// (default, file, an environment variable, safety.by_host)
+        #[arg(long)]
+        sources: bool,
+    },
     /// Interactive provider setup wizard
     Configure,
     /// Set a specific config value (e.g. `niko settings set openai.model gpt-4o`)
     Set { key: String, value: String },
     /// Re-initialise config to defaults
-    Init,
+    Init {
+        /// Instead, install Ollama and download a model sized for this machine
+        /// (keeps the rest of the config)
+        #[arg(long)]
+        local: bool,
+    },
+    /// Add options missing from the config file (e.g. after an upgrade),
+    /// keeping every value already set
+    Upgrade,
     /// Print the config file path
     Path,
 }
 
+#[derive(Subcommand)]
+enum LocalAction {
+    /// Run a few well-known queries against the local model and report how
+    /// many give a plausible command
+    Test,
+}
+
+#[derive(Subcommand)]
+enum HistoryAction {
+    /// Attach a note to an entry (an empty note removes it)
+    Annotate {
+        /// Entry number, as `niko history` lists it
+        id: usize,
+        note: String,
+    },
+}
+
 fn main() {
     let cli = Cli::parse();
 
+    if let Some(path) = &cli.config {
+        config::set_path_override(path.clone());
+    }
+    if let Some(path) = &cli.context_file {
+        if let Err(e) = prompt::load_context_file(path) {
+            eprintln!("{} {}", "✗".red().bold(), e);
+            std::process::exit(1);
+        }
+    }
+
     let result = match cli.command {
         Some(Commands::Settings { action }) => {
             let settings_action = match action {
-                Some(SettingsAction::Show) => Some(modes::settings::Action::Show),
+                Some(SettingsAction::Show { sources }) => {
+                    Some(modes::settings::Action::Show { sources })
+                }
                 Some(SettingsAction::Configure) => Some(modes::settings::Action::Configure),
                 Some(SettingsAction::Set { key, value }) => {
                     Some(modes::settings::Action::Set { key, value })
                 }
-                Some(SettingsAction::Init) => Some(modes::settings::Action::Init),
+                Some(SettingsAction::Init { local }) => {
+                    Some(modes::settings::Action::Init { local })
+                }
+                Some(SettingsAction::Upgrade) => Some(modes::settings::Action::Upgrade),
                 Some(SettingsAction::Path) => Some(modes::settings::Action::Path),
                 None => None,
             };
             modes::settings::run(settings_action)
         }
 
-        Some(Commands::Version) => {
-            println!("niko {}", env!("CARGO_PKG_VERSION"));
+        Some(Commands::Providers) => modes::providers::run(),
+
+        Some(Commands::Explain { command }) => {
+            modes::explain::run(&command.join(" "), cli.provider.as_deref())
+        }
+
+        Some(Commands::Describe { command }) => {
+            modes::describe::run(&command.join(" "), cli.provider.as_deref())
+        }
+
+        Some(Commands::Batch { file }) => {
+            modes::batch::run(file.as_deref(), cli.provider.as_deref(), cli.verbose)
+        }
+
+        Some(Commands::History { action, limit }) => {
+            let action = action.map(|HistoryAction::Annotate { id, note }| {
+                modes::history::Action::Annotate { id, note }
+            });
+            modes::history::run(action, limit)
+        }
+
+        Some(Commands::Save { name, force }) => modes::bookmarks::save(&name, force),
+
+        Some(Commands::Run { ref name, exec }) => {
+            let mut opts = cmd_options(&cli);
+            opts.exec |= exec;
+            modes::bookmarks::run(name, &opts)
+        }
+
+        Some(Commands::Saved) => modes::bookmarks::list(),
+
+        Some(Commands::Stats { since, until }) => {
+            modes::stats::run(since.as_deref(), until.as_deref())
+        }
+
+        Some(Commands::Reset { keep_config }) => modes::reset::run(cli.yes, keep_config),
+
+        Some(Commands::Completion { shell }) => {
+            print!("{}", completion::script(shell));
             Ok(())
         }
 
+        Some(Commands::Complete { words }) => {
+            for candidate in completion::candidates(&Cli::command(), &words) {
+                println!("{}", candidate);
+            }
+            Ok(())
+        }
+
+        Some(Commands::Local {
+            action: LocalAction::Test,
+        }) => modes::local::test(),
+
+        Some(Commands::Version { json }) => modes::version::run(json),
+
         None => {
-            if !cli.query.is_empty() {
+            if !cli.query.is_empty() || cli.edit_query {
                 run_query_mode(&cli)
             } else {
                 // No args — launch TUI Chat
@@ -103,33 +446,57 @@ fn main() {
     }
 }
 
-fn run_query_mode(cli: &Cli) -> anyhow::Result<()> {
-    let query = cli.query.join(" ");
-    let ctx = prompt::gather_context();
-    let mut system = prompt::chat_system_prompt(&ctx);
+/// A boolean env var is on unless unset, empty, `0` or `false`
+fn env_flag(name: &str) -> bool {
+    std::env::var(name).is_ok_and(|v| !matches!(v.trim(), "" | "0" | "false"))
+}
 
-    let tool_help = prompt::discover_tool_help(&query, cli.verbose);
-    if !tool_help.is_empty() {
-        system.push_str(&tool_help);
+fn run_query_mode(cli: &Cli) -> anyhow::Result<()> {
+    if let Some(path) = modes::batch::query_file(&cli.query) {
+        return modes::batch::run_file(path, &cmd_options(cli));
     }
+    let query = if cli.query == ["-"] && !std::io::stdin().is_terminal() {
+        modes::cmd::query_from_stdin()?
+    } else if cli.edit_query || cli.query == ["-"] {
+        modes::cmd::query_from_editor()?
+    } else {
+        modes::cmd::join_query(&cli.query)
+    };
+    modes::cmd::run(&query, &cmd_options(cli))
+}
 
-    let messages = vec![
-        llm::Message {
-            role: llm::Role::System,
-            content: system,
+/// Command-mode options from the top-level flags
+fn cmd_options(cli: &Cli) -> modes::cmd::Options {
+    modes::cmd::Options {
+        provider: cli.provider.clone(),
+        verbose: cli.verbose,
+        format: if cli.markdown {
+            output::Format::Markdown
+        } else {
+            cli.output
         },
-        llm::Message {
-            role: llm::Role::User,
-            content: query,
-        },
-    ];
-
-    let provider = llm::get_provider(cli.provider.as_deref())?;
-    if cli.verbose {
-        eprintln!("Using provider: {}", provider.name());
+        seed: cli.seed,
+        context_tools: cli.context_tools.clone(),
+        no_clean: cli.no_clean,
+        edit: cli.edit,
+        exec: cli.exec,
+        fix: cli.fix,
+        diff: cli.diff,
+        both: cli.both,
+        note: cli.note.clone(),
+        tool_check: !cli.no_tool_check && config::get().ui.tool_check,
+        prompt_only: cli.prompt_only,
+        race: cli.race.clone(),
+        using: cli.using.clone(),
+        expand: cli.expand,
+        ssh: cli.ssh.clone(),
+        yes: cli.yes,
+        candidates: cli.candidates,
+        offline: cli.offline || env_flag("NIKO_OFFLINE"),
+        no_fallback: cli.no_fallback,
+        force: cli.force,
+        cwd: cli.cwd.clone(),
+        time: cli.time,
+        what_if: cli.what_if,
     }
-
-    let response = llm::generate_with_retry(provider.as_ref(), &messages, 2048)?;
-    println!("{response}");
-    Ok(())
 }
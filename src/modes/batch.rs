@@ -0,0 +1,235 @@
+use std::fs;
+use std::io;
+use std::path::Path;
+
+use anyhow::{bail, Context, Result};
+use colored::Colorize;
+use serde::Serialize;
+
+use crate::cancel;
+use crate::config;
+use crate::history;
+use crate::llm::{self, Provider};
+use crate::modes::cmd;
+use crate::output::Format;
+use crate::prompt;
+use crate::safety::{self, RiskLevel};
+
+/// One output line of `niko batch`
+#[derive(Debug, Serialize)]
+struct Line<'a> {
+    query: &'a str,
+    command: Option<&'a str>,
+    provider: &'a str,
+    risk: Option<RiskLevel>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    error: Option<String>,
+}
+
+/// Run `niko batch [FILE]`. Every query shares one provider; cloud requests
+/// are capped at `generation.max_concurrent` in flight, local ones run
+/// one at a time since Ollama serves them serially anyway. Output keeps
+/// the input order, and failed queries get an `error` field.
+pub fn run(file: Option<&Path>, provider_name: Option<&str>, verbose: bool) -> Result<()> {
+    let input = match file {
+        Some(path) if path != Path::new("-") => fs::read_to_string(path)
+            .with_context(|| format!("Failed to read queries from {}", path.display()))?,
+        _ => io::read_to_string(io::stdin()).context("Failed to read queries from stdin")?,
+    };
+    let queries = parse_queries(&input);
+    if queries.is_empty() {
+        bail!("No queries to translate (expected one per line)");
+    }
+
+    let provider = llm::get_provider(provider_name)?;
+    let limit = if provider.is_local() {
+        1
+    } else {
+        config::get().generation.max_concurrent
+    };
+
+    let mut ctx = cmd::command_context(&[]);
+    ctx.template = config::system_template(config::get(), provider.name());
+
+    let (results, provider, queries) = cancel::run_cancellable(move || {
+        let results = translate(provider.as_ref(), &ctx, &queries, limit, verbose);
+        (results, provider, queries)
+    });
+
+    let provider_name = provider.name();
+    let mut failed = 0;
+    for (query, result) in queries.iter().zip(&results) {
+        let line = match result {
+            Ok(command) => {
+                let risk = safety::assess(command).level;
+                let entry = history::Entry {
+                    timestamp: history::now_unix(),
+                    query: query.clone(),
+                    command: command.clone(),
+                    provider: provider_name.to_string(),
+                    risk,
+                    latency_ms: None,
+                    note: None,
+                };
+                let _ = history::record(&entry);
+                Line {
+                    query,
+                    command: Some(command),
+                    provider: provider_name,
+                    risk: Some(risk),
+                    error: None,
+                }
+            }
+            Err(e) => {
+                failed += 1;
+                Line {
+                    query,
+                    command: None,
+                    provider: provider_name,
+                    risk: None,
+                    error: Some(format!("{:#}", e)),
+                }
+            }
+        };
+        println!("{}", serde_json::to_string(&line)?);
+    }
+
+    if failed > 0 {
+        bail!("{} of {} queries failed", failed, queries.len());
+    }
+    Ok(())
+}
+
+/// Run `niko @FILE`: each query in the file goes through command mode in
+/// turn, as if typed, and its command is printed under a `# query` line.
+/// The lighter sibling of `batch`: same options and output as a single
+/// query, nothing run.
+pub fn run_file(path: &Path, opts: &cmd::Options) -> Result<()> {
+    if opts.exec {
+        bail!("niko @FILE only prints commands; run them one at a time with --exec");
+    }
+    let input = fs::read_to_string(path)
+        .with_context(|| format!("Failed to read queries from {}", path.display()))?;
+    let queries = parse_queries(&input);
+    if queries.is_empty() {
+        bail!("No queries in {} (expected one per line)", path.display());
+    }
+
+    let mut failed = 0;
+    for query in &queries {
+        if matches!(opts.format, Format::Text | Format::Markdown) {
+            println!("# {}", query);
+        }
+        if let Err(e) = cmd::run(query, opts) {
+            failed += 1;
+            eprintln!("{} {:#}", "✗".red().bold(), e);
+        }
+    }
+
+    if failed > 0 {
+        bail!("{} of {} queries failed", failed, queries.len());
+    }
+    Ok(())
+}
+
+/// The file a lone `@FILE` query argument names, if that's what it is
+pub fn query_file(words: &[String]) -> Option<&Path> {
+    match words {
+        [word] => word
+            .strip_prefix('@')
+            .filter(|path| !path.is_empty() && !path.contains(char::is_whitespace))
+            .map(Path::new),
+        _ => None,
+    }
+}
+
+/// Non-empty lines that aren't `#` comments, trimmed
+fn parse_queries(input: &str) -> Vec<String> {
+    input
+        .lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty() && !line.starts_with('#'))
+        .map(String::from)
+        .collect()
+}
+
+/// Generate a command for each query, after the `safety.rewrite` policy
+/// and `hooks.post_generate`
+fn translate(
+    provider: &dyn Provider,
+    ctx: &prompt::SystemContext,
+    queries: &[String],
+    max_concurrent: usize,
+    verbose: bool,
+) -> Vec<Result<String>> {
+    cmd::pooled(queries.len(), max_concurrent, |i| {
+        let messages = cmd::build_messages(ctx, &queries[i], verbose);
+        let generation = cmd::generate_command(provider, &messages)?;
+        let command = safety::rewrite(&generation.text)?.command;
+        let hook = &config::get().hooks.post_generate;
+        Ok(cmd::run_hook(hook, command, &queries[i], provider.name())?.0)
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::llm::mock::MockProvider;
+
+    #[test]
+    fn queries_skip_blanks_and_comments() {
+        let input = "# cleanup tasks\nlist files\n\n   show disk usage  \n#done\n";
+        assert_eq!(parse_queries(input), vec!["list files", "show disk usage"]);
+    }
+
+    #[test]
+    fn only_a_lone_at_word_names_a_query_file() {
+        let words = |w: &[&str]| w.iter().map(|s| s.to_string()).collect::<Vec<_>>();
+        assert_eq!(
+            query_file(&words(&["@queries.txt"])),
+            Some(Path::new("queries.txt"))
+        );
+        assert_eq!(query_file(&words(&["@"])), None);
+        assert_eq!(query_file(&words(&["@daily cron job"])), None);
+        assert_eq!(query_file(&words(&["@reboot", "job"])), None);
+        assert_eq!(query_file(&words(&["list files"])), None);
+    }
+
+    #[test]
+    fn translates_every_query_in_order() {
+        let provider = MockProvider::new("```bash\ndu -sh *\n```");
+        let queries = vec!["one".to_string(), "two".to_string(), "three".to_string()];
+        let results = translate(&provider, &prompt::gather_context(), &queries, 2, false);
+
+        assert_eq!(results.len(), 3);
+        assert!(results
+            .iter()
+            .all(|r| r.as_deref().ok() == Some("du -sh *")));
+    }
+
+    #[test]
+    fn lines_serialize_with_error_only_on_failure() {
+        let ok = Line {
+            query: "list files",
+            command: Some("ls"),
+            provider: "ollama",
+            risk: Some(RiskLevel::Safe),
+            error: None,
+        };
+        assert_eq!(
+            serde_json::to_string(&ok).unwrap(),
+            r#"{"query":"list files","command":"ls","provider":"ollama","risk":"safe"}"#
+        );
+
+        let failed = Line {
+            query: "x",
+            command: None,
+            provider: "openai",
+            risk: None,
+            error: Some("timed out".into()),
+        };
+        let json = serde_json::to_string(&failed).unwrap();
+        assert!(json.contains(r#""command":null"#));
+        assert!(json.contains(r#""error":"timed out""#));
+    }
+}
@@ -0,0 +1,81 @@
+use anyhow::{bail, Result};
+use colored::Colorize;
+
+use crate::bookmarks::{self, Bookmark};
+use crate::history;
+use crate::modes::cmd;
+
+/// Run `niko save <NAME>`: keep the most recent command from the history
+/// under `name`. An existing bookmark is only replaced with `force`.
+pub fn save(name: &str, force: bool) -> Result<()> {
+    bookmarks::validate_name(name)?;
+    let Some(last) = history::load()?.pop() else {
+        bail!(
+            "No command to save yet: generate one first, then run `niko save {}`",
+            name
+        );
+    };
+
+    let mut all = bookmarks::load()?;
+    if let Some(existing) = all.get(name) {
+        if !force {
+            bail!(
+                "'{}' is already saved as: {}\nUse --force to replace it.",
+                name,
+                existing.command
+            );
+        }
+    }
+
+    println!("{} Saved {}: {}", "✓".green(), name.bold(), last.command);
+    all.insert(
+        name.to_string(),
+        Bookmark {
+            command: last.command,
+            query: last.query,
+            saved_at: history::now_unix(),
+        },
+    );
+    bookmarks::store(&all)
+}
+
+/// Run `niko saved`: list bookmarks by name
+pub fn list() -> Result<()> {
+    let all = bookmarks::load()?;
+    if all.is_empty() {
+        eprintln!(
+            "{}",
+            "No saved commands yet. Save the last one with `niko save <name>`.".dimmed()
+        );
+        return Ok(());
+    }
+
+    let width = all.keys().map(|k| k.chars().count()).max().unwrap_or(0);
+    for (name, bookmark) in &all {
+        println!(
+            "{}  {}",
+            format!("{:<width$}", name, width = width).bold(),
+            bookmark.command
+        );
+        if !bookmark.query.is_empty() {
+            println!("{:<width$}  {}", "", bookmark.query.dimmed(), width = width);
+        }
+    }
+    Ok(())
+}
+
+/// Run `niko run <NAME>`: report the saved command like a generated one
+/// (risk, notes, placeholders) and, with `--exec`, run it after the usual
+/// confirmation
+pub fn run(name: &str, opts: &cmd::Options) -> Result<()> {
+    let all = bookmarks::load()?;
+    let Some(bookmark) = all.get(name) else {
+        bail!("No saved command '{}' (see `niko saved`)", name);
+    };
+    let query = if bookmark.query.is_empty() {
+        name
+    } else {
+        &bookmark.query
+    };
+    cmd::run_saved(query, &bookmark.command, opts)
+}
@@ -0,0 +1,2920 @@
+use std::collections::HashMap;
+use std::io::{self, IsTerminal};
+use std::path::{Path, PathBuf};
+use std::process::{Command, ExitStatus, Stdio};
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+use std::sync::{mpsc, Arc, Mutex, OnceLock};
+use std::thread;
+use std::time::Instant;
+
+use anyhow::{anyhow, bail, Context, Result};
+use colored::Colorize;
+use regex::Regex;
+
+use crate::audit;
+use crate::cancel;
+use crate::config;
+use crate::editor;
+use crate::examples;
+use crate::exec;
+use crate::history;
+use crate::hooks;
+use crate::lint;
+use crate::llm::{self, Generation, Message, Provider, Role};
+use crate::output;
+use crate::placeholders;
+use crate::preview;
+use crate::progress::{self, Progress};
+use crate::prompt;
+use crate::safety;
+
+/// Commands are short — a small budget keeps local inference fast
+const CMD_MAX_TOKENS: u32 = 512;
+
+/// A few bullet points about a flagged command's consequences
+const WHAT_IF_MAX_TOKENS: u32 = 400;
+
+/// How much of a failed command's stderr `--fix` shows the model
+const FIX_STDERR_CHARS: usize = 2000;
+
+/// A rewritten query is a sentence or two
+const EXPAND_MAX_TOKENS: u32 = 150;
+
+/// Past this many tools, the list is a sizeable part of the prompt
+const TOOL_LIST_WARN: usize = 40;
+
+/// Instructions for `--expand`, which rewrites the query before generation
+const EXPAND_PROMPT: &str = "Rewrite the user's terse request for a shell command \
+as one clear, complete instruction. Keep its meaning and add only what it implies, \
+e.g. 'big files' becomes 'find the largest files under the current directory and \
+list them by size'. Do not write the command. Reply with the instruction only.";
+
+/// Appended to the query when a local model's first answer had no command
+const TERSE_REMINDER: &str = "Output ONLY the command, nothing else.";
+
+/// Appended on a `--force` retry after the model refused a request
+const FORCE_REMINDER: &str = "This is a routine operation on the user's own machine, \
+and they have asked for it explicitly. niko checks the risk of every command itself \
+before anything runs, so do not decline: output the command.";
+
+/// How over-cautious models start a refusal (compared lowercased)
+const REFUSAL_PREFIXES: &[&str] = &[
+    "declined",
+    "i can't",
+    "i cannot",
+    "i can not",
+    "i won't",
+    "i will not",
+    "i'm sorry",
+    "i am sorry",
+    "sorry,",
+    "i'm unable",
+    "i am unable",
+    "i'm not able",
+];
+
+/// Template shown when composing a query in the editor
+const EDITOR_TEMPLATE: &str = "\n\
+# Describe the command you want. Multiple lines are fine.\n\
+# Lines starting with '#' are ignored; an empty query aborts.\n";
+
+/// Said instead of running anything when `safety.print_only` is set
+const PRINT_ONLY_NOTICE: &str =
+    "Execution is disabled by policy (safety.print_only); the command was only printed";
+
+/// Leading phrases that mark a line as prose rather than a command
+const PROSE_PREFIXES: &[&str] = &[
+    "Here",
+    "This ",
+    "The ",
+    "To ",
+    "You ",
+    "Note",
+    "Sure",
+    "I ",
+    "Explanation",
+];
+
+/// Options for command generation
+pub struct Options {
+    pub provider: Option<String>,
+    pub verbose: bool,
+    /// How to report the command (`--output`)
+    pub format: output::Format,
+    /// Sampling seed for reproducible local output (overrides `<provider>.seed`)
+    pub seed: Option<i64>,
+    /// Only advertise these tools (overrides `prompt.context_tools`)
+    pub context_tools: Vec<String>,
+    /// Print the model output verbatim (trimmed) instead of extracting the command
+    pub no_clean: bool,
+    /// Open the generated command in $EDITOR before printing or running it
+    pub edit: bool,
+    /// Run the command instead of printing it
+    pub exec: bool,
+    /// Number of candidates to generate (1 = the usual single command)
+    pub candidates: usize,
+    /// Only use a local provider; fail fast instead of touching the network
+    pub offline: bool,
+    /// Surface a failed model pull instead of using `ollama.fallback_model`
+    pub no_fallback: bool,
+    /// Retry once with softened instructions if the model refuses
+    pub force: bool,
+    /// Directory to describe to the model and run the command in
+    pub cwd: Option<PathBuf>,
+    /// Print how long generation took, without the rest of `verbose`
+    pub time: bool,
+    /// Explain what a dangerous command would do; never run it
+    pub what_if: bool,
+    /// Under `exec`, offer one corrected command if the first one fails
+    pub fix: bool,
+    /// Under `exec`, preview file edits as a diff and confirm first
+    pub diff: bool,
+    /// Print a macOS and a Linux variant when they differ
+    pub both: bool,
+    /// Stored with the history entry
+    pub note: Option<String>,
+    /// Note programs in the command that aren't on PATH
+    pub tool_check: bool,
+    /// Print the assembled prompt and stop before any model call
+    pub prompt_only: bool,
+    /// Ask these providers at once and keep the first valid command
+    pub race: Vec<String>,
+    /// Tool the model should prefer (`--using`)
+    pub using: Option<String>,
+    /// Rewrite the query into a fuller instruction before generating
+    pub expand: bool,
+    /// Run the command on this `user@host` over SSH (`--ssh`)
+    pub ssh: Option<String>,
+    /// Answer yes to the confirmations before running, except for critical
+    /// commands
+    pub yes: bool,
+}
+
+/// Run command mode: natural language → shell command on stdout
+pub fn run(query: &str, opts: &Options) -> Result<()> {
+    let cwd = opts.cwd.as_deref().map(resolve_cwd).transpose()?;
+    let mut ctx = context_for(opts)?;
+    if let Some(dir) = &cwd {
+        ctx.working_dir = dir.display().to_string();
+    }
+
+    if let Some(command) = alias_for(&config::get().prompt.aliases, query) {
+        if opts.verbose {
+            eprintln!("{}", "  matched prompt.aliases, no model call".dimmed());
+        }
+        if opts.prompt_only {
+            eprintln!(
+                "{}",
+                format!(
+                    "  matched prompt.aliases: nothing is sent, the command is {}",
+                    command
+                )
+                .dimmed()
+            );
+            return Ok(());
+        }
+        return run_alias(query, command, "alias", &ctx, opts, cwd.as_deref());
+    }
+
+    if let Some(tool) = opts
+        .using
+        .as_deref()
+        .map(str::trim)
+        .filter(|t| !t.is_empty())
+    {
+        if !prompt::prefer_tool(&mut ctx, tool) {
+            eprintln!(
+                "{} {} isn't installed here; asking for it anyway",
+                "⚠".yellow(),
+                tool
+            );
+        }
+    }
+
+    let mut overrides = HashMap::new();
+    if let Some(seed) = opts.seed {
+        overrides.insert("seed".to_string(), seed.to_string());
+    }
+    if opts.no_fallback {
+        // A blank fallback_model means there is none
+        overrides.insert("fallback_model".to_string(), String::new());
+    }
+
+    // The model sees the expanded query; history keeps what was typed
+    let original = query;
+    let expanded = if opts.expand {
+        expand_query(query, opts, &overrides)?
+    } else {
+        query.to_string()
+    };
+    let query = expanded.as_str();
+
+    if !opts.race.is_empty() {
+        let started = Instant::now();
+        let (generation, provider) = race(&ctx, query, &opts.race, &overrides, opts)?;
+        let latency_ms = started.elapsed().as_millis() as u64;
+        if opts.time {
+            print_elapsed(started);
+        }
+        if opts.verbose {
+            eprintln!(
+                "{}",
+                format!("  {} answered first", provider.name()).dimmed()
+            );
+            eprintln!("{}", describe_generation(&generation).dimmed());
+        }
+        return deliver(
+            original,
+            &generation,
+            provider,
+            &ctx,
+            cwd.as_deref(),
+            latency_ms,
+            opts,
+        );
+    }
+
+    let provider = if opts.offline {
+        overrides.insert("offline".to_string(), "true".to_string());
+        offline_provider(opts.provider.as_deref(), &overrides)?
+    } else {
+        llm::get_provider_with(opts.provider.as_deref(), &overrides)?
+    };
+    let provider_name = provider.name().to_string();
+    let model_hint = llm::unknown_model_hint(&provider_name, provider.model());
+    if opts.verbose {
+        eprintln!("Using provider: {}", provider_name);
+        if let Some(hint) = &model_hint {
+            eprintln!("{}", hint.dimmed());
+        }
+        let base_url = config::get()
+            .providers
+            .get(&provider_name)
+            .map(|p| p.base_url.as_str());
+        if let Some(owner) = base_url.and_then(|url| config::endpoint_owner(&provider_name, url)) {
+            eprintln!(
+                "{}",
+                format!(
+                    "  {}.base_url is {}'s endpoint; did you mean -p {}?",
+                    provider_name, owner, owner
+                )
+                .dimmed()
+            );
+        }
+    }
+    ctx.template = config::system_template(config::get(), &provider_name);
+    let messages = fit_context(&ctx, query, opts.verbose, provider.context_size());
+    if opts.prompt_only {
+        print!("{}", format_prompt(&messages));
+        return Ok(());
+    }
+
+    if opts.candidates > 1 {
+        if opts.format != output::Format::Text {
+            bail!("-n lists candidates as plain text and can't be combined with --output");
+        }
+        let limit = config::get().generation.max_concurrent;
+        let started = Instant::now();
+        run_candidates(
+            original,
+            provider,
+            &messages,
+            opts.candidates,
+            limit,
+            opts.note.clone(),
+        )?;
+        if opts.time {
+            print_elapsed(started);
+        }
+        return Ok(());
+    }
+
+    if opts.both {
+        if opts.format != output::Format::Text {
+            bail!("--both prints labelled plain text and can't be combined with --output");
+        }
+        let limit = config::get().generation.max_concurrent;
+        return run_both(query, &ctx, provider, opts.verbose, limit);
+    }
+
+    let started = Instant::now();
+    let (no_clean, force) = (opts.no_clean, opts.force);
+    // Token counts only come back from non-streaming calls, and -v shows
+    // them; a structured answer is JSON, which isn't worth streaming
+    let structured = provider.supports_structured_output() && !no_clean;
+    let streaming = provider.supports_streaming() && !structured && !opts.verbose;
+    let (generation, provider) = cancel::run_cancellable(move || {
+        let mut progress = Progress::start(streaming);
+        if structured {
+            let generation = generate_command_with(provider.as_ref(), &messages, force);
+            progress.finish();
+            return (generation, provider);
+        }
+        let generation = progress
+            .generate(provider.as_ref(), &messages, CMD_MAX_TOKENS)
+            .and_then(|first| {
+                progress.finish();
+                if no_clean {
+                    check_length(&first.text, config::get().safety.max_command_length)
+                        .map(|_| first)
+                } else {
+                    finish_command(provider.as_ref(), &messages, force, first)
+                }
+            });
+        (generation, provider)
+    });
+    let generation = generation.map_err(|e| match &model_hint {
+        Some(hint) if llm::is_model_not_found(&e) => anyhow!("{:#}\n\n{}", e, hint),
+        _ => e,
+    })?;
+    let latency_ms = started.elapsed().as_millis() as u64;
+    if opts.time {
+        print_elapsed(started);
+    }
+    if opts.verbose {
+        eprintln!("{}", describe_generation(&generation).dimmed());
+    }
+    deliver(
+        original,
+        &generation,
+        provider,
+        &ctx,
+        cwd.as_deref(),
+        latency_ms,
+        opts,
+    )
+}
+
+/// Everything after generation: the rewrite policy, editing, placeholders,
+/// notes and report, the history entry, then `--what-if` or `--exec`
+fn deliver(
+    query: &str,
+    generation: &Generation,
+    provider: Box<dyn Provider>,
+    ctx: &prompt::SystemContext,
+    cwd: Option<&Path>,
+    latency_ms: u64,
+    opts: &Options,
+) -> Result<()> {
+    let provider_name = provider.name().to_string();
+    let rewritten = safety::rewrite(&generation.text)?;
+    let command = if opts.edit {
+        edit_command(&rewritten.command)?
+    } else {
+        rewritten.command
+    };
+    let command = fill_placeholders(&command)?;
+    let hook = &config::get().hooks.post_generate;
+    let (command, hook_note) = run_hook(hook, command, query, &provider_name)?;
+
+    let mut notes = rewritten.notes;
+    notes.extend(generation.note.as_ref().map(|n| format!("model: {}", n)));
+    notes.extend(hook_note);
+    // Paths and installed tools can only be checked on this machine
+    if opts.ssh.is_none() {
+        notes.extend(uncommitted_warning(&command, cwd));
+        notes.extend(path_warnings(&command, cwd));
+        notes.extend(install_hints(&command));
+        if opts.tool_check {
+            notes.extend(missing_tools(&command, &ctx.shell));
+        }
+    }
+    let assessment = report(&command, &notes, &ctx.shell, opts)?;
+    record_history(
+        query,
+        &over_ssh(opts.ssh.as_deref(), &command),
+        provider_name,
+        assessment.level,
+        Some(latency_ms),
+        opts,
+    );
+
+    if opts.what_if {
+        if assessment.level < safety::RiskLevel::Dangerous {
+            eprintln!(
+                "{}",
+                format!("  {} command, nothing to simulate", assessment.level).dimmed()
+            );
+        } else {
+            let messages = what_if_messages(ctx, &command, &assessment);
+            let explanation = cancel::run_cancellable(move || {
+                llm::generate_with_retry(provider.as_ref(), &messages, WHAT_IF_MAX_TOKENS)
+            })?;
+            eprintln!("\n{}\n{}", "What would happen:".bold(), explanation);
+        }
+    } else if opts.exec && config::get().safety.print_only {
+        eprintln!("{} {}", "⚠".yellow(), PRINT_ONLY_NOTICE);
+    } else if opts.exec {
+        if opts.diff {
+            confirm_edits(&command, cwd, opts.yes)?;
+        }
+        let gate = Gate {
+            yes: opts.yes,
+            forced: generation.forced,
+        };
+        if opts.fix {
+            execute_with_fix(query, ctx, &command, &assessment, cwd, provider, gate)?;
+        } else {
+            execute(&command, &assessment, cwd, opts.ssh.as_deref(), gate)?;
+        }
+    }
+
+    Ok(())
+}
+
+/// `--expand`: have `prompt.expand_provider` (or the provider in use)
+/// rewrite `query` as a fuller instruction. A blank answer keeps the query.
+fn expand_query(
+    query: &str,
+    opts: &Options,
+    overrides: &HashMap<String, String>,
+) -> Result<String> {
+    let configured = config::get().prompt.expand_provider.trim();
+    let name = Some(configured)
+        .filter(|n| !n.is_empty())
+        .or(opts.provider.as_deref());
+    let provider = if opts.offline {
+        offline_provider(name, overrides)?
+    } else {
+        llm::get_provider_with(name, overrides)?
+    };
+
+    let messages = expand_messages(query);
+    let text = cancel::run_cancellable(move || {
+        let mut progress = Progress::start(false);
+        let text = llm::generate_with_retry(provider.as_ref(), &messages, EXPAND_MAX_TOKENS);
+        progress.finish();
+        text
+    })?;
+    let expanded = clean_expansion(&text).unwrap_or_else(|| query.to_string());
+    if opts.verbose {
+        eprintln!("{}", format!("  expanded: {}", expanded).dimmed());
+    }
+    Ok(expanded)
+}
+
+fn expand_messages(query: &str) -> Vec<Message> {
+    vec![
+        Message {
+            role: Role::System,
+            content: EXPAND_PROMPT.to_string(),
+        },
+        Message {
+            role: Role::User,
+            content: query.to_string(),
+        },
+    ]
+}
+
+/// The rewritten instruction: its first paragraph, without quotes or a
+/// leading label
+fn clean_expansion(text: &str) -> Option<String> {
+    let paragraph = text.trim().split("\n\n").next().unwrap_or_default();
+    let line = paragraph.split_whitespace().collect::<Vec<_>>().join(" ");
+    let line = line
+        .strip_prefix("Instruction:")
+        .unwrap_or(&line)
+        .trim()
+        .trim_matches(|c| c == '"' || c == '\'' || c == '`')
+        .trim();
+    (!line.is_empty()).then(|| line.to_string())
+}
+
+/// `--race`: generate with every named provider at once and keep the first
+/// command that extracts cleanly. Blocking requests can't be interrupted, so
+/// the slower ones are abandoned rather than cancelled: their answers are
+/// ignored, and their connections close when niko exits (cloud calls that
+/// were already sent are still billed).
+fn race(
+    ctx: &prompt::SystemContext,
+    query: &str,
+    names: &[String],
+    overrides: &HashMap<String, String>,
+    opts: &Options,
+) -> Result<(Generation, Box<dyn Provider>)> {
+    let mut unique: Vec<&str> = Vec::new();
+    for name in names.iter().map(|n| n.trim()).filter(|n| !n.is_empty()) {
+        if !unique.contains(&name) {
+            unique.push(name);
+        }
+    }
+    if unique.len() < 2 {
+        bail!("--race needs at least two providers, e.g. --race ollama,openai");
+    }
+    let providers = unique
+        .iter()
+        .map(|name| llm::get_provider_with(Some(name), overrides))
+        .collect::<Result<Vec<_>>>()?;
+
+    let (ctx, query) = (ctx.clone(), query.to_string());
+    let (verbose, force) = (opts.verbose, opts.force);
+    cancel::run_cancellable(move || race_providers(&ctx, &query, providers, verbose, force))
+}
+
+/// The first of `providers` to produce a command, with its generation.
+/// The others are abandoned then: they go quiet and stop retrying, so
+/// nothing of theirs shows up in the winner's prompt or output.
+fn race_providers(
+    ctx: &prompt::SystemContext,
+    query: &str,
+    providers: Vec<Box<dyn Provider>>,
+    verbose: bool,
+    force: bool,
+) -> Result<(Generation, Box<dyn Provider>)> {
+    let (tx, rx) = mpsc::channel();
+    let decided = Arc::new(AtomicBool::new(false));
+    for provider in providers {
+        let tx = tx.clone();
+        let decided = Arc::clone(&decided);
+        let mut ctx = ctx.clone();
+        ctx.template = config::system_template(config::get(), provider.name());
+        let query = query.to_string();
+        thread::spawn(move || {
+            progress::abandon_when(decided);
+            let messages = fit_context(&ctx, &query, verbose, provider.context_size());
+            let result = generate_command_with(provider.as_ref(), &messages, force);
+            let _ = tx.send((result, provider));
+        });
+    }
+    drop(tx);
+
+    let mut failures = Vec::new();
+    for (result, provider) in rx {
+        match result {
+            Ok(generation) => {
+                decided.store(true, Ordering::Relaxed);
+                return Ok((generation, provider));
+            }
+            Err(e) => failures.push(format!("{}: {:#}", provider.name(), e)),
+        }
+    }
+    bail!(
+        "Every provider in the race failed:\n  {}",
+        failures.join("\n  ")
+    )
+}
+
+/// The command `prompt.aliases` maps `query` to, if any
+fn alias_for<'a>(aliases: &'a HashMap<String, String>, query: &str) -> Option<&'a str> {
+    let query = query.trim();
+    aliases
+        .iter()
+        .find(|(alias, _)| alias.trim().eq_ignore_ascii_case(query))
+        .map(|(_, command)| command.as_str())
+}
+
+/// A saved command (`niko run`), handled like an aliased query
+pub fn run_saved(query: &str, command: &str, opts: &Options) -> Result<()> {
+    let cwd = opts.cwd.as_deref().map(resolve_cwd).transpose()?;
+    let ctx = context_for(opts)?;
+    run_alias(query, command, "saved", &ctx, opts, cwd.as_deref())
+}
+
+/// An aliased query: the configured command goes through the same editing,
+/// checks and output as a generated one. There's no model, so `--what-if`
+/// and `--fix` don't apply; the command is reported and, under `--exec`, run.
+/// History records `source` as the provider.
+fn run_alias(
+    query: &str,
+    command: &str,
+    source: &str,
+    ctx: &prompt::SystemContext,
+    opts: &Options,
+    cwd: Option<&Path>,
+) -> Result<()> {
+    let command = if opts.edit {
+        edit_command(command)?
+    } else {
+        command.to_string()
+    };
+    let command = fill_placeholders(&command)?;
+    let hook = &config::get().hooks.post_generate;
+    let (command, hook_note) = run_hook(hook, command, query, source)?;
+
+    let mut notes: Vec<String> = hook_note.into_iter().collect();
+    // Paths and installed tools can only be checked on this machine
+    if opts.ssh.is_none() {
+        notes.extend(uncommitted_warning(&command, cwd));
+        notes.extend(path_warnings(&command, cwd));
+        notes.extend(install_hints(&command));
+        if opts.tool_check {
+            notes.extend(missing_tools(&command, &ctx.shell));
+        }
+    }
+    let assessment = report(&command, &notes, &ctx.shell, opts)?;
+    record_history(
+        query,
+        &over_ssh(opts.ssh.as_deref(), &command),
+        source.to_string(),
+        assessment.level,
+        None,
+        opts,
+    );
+
+    if opts.exec && config::get().safety.print_only {
+        eprintln!("{} {}", "⚠".yellow(), PRINT_ONLY_NOTICE);
+    } else if opts.exec {
+        if opts.diff {
+            confirm_edits(&command, cwd, opts.yes)?;
+        }
+        let gate = Gate {
+            yes: opts.yes,
+            forced: false,
+        };
+        execute(&command, &assessment, cwd, opts.ssh.as_deref(), gate)?;
+    }
+    Ok(())
+}
+
+/// Pass the command through `hook` (`hooks.post_generate`), if one is
+/// configured, noting when the hook changed it
+pub fn run_hook(
+    hook: &str,
+    command: String,
+    query: &str,
+    provider: &str,
+) -> Result<(String, Option<String>)> {
+    if hook.trim().is_empty() {
+        return Ok((command, None));
+    }
+    match hooks::post_generate(hook, &command, query, provider)? {
+        Some(replaced) => Ok((
+            replaced,
+            Some(format!("changed by hooks.post_generate (was: {})", command)),
+        )),
+        None => Ok((command, None)),
+    }
+}
+
+/// A note for each global package install, with the scoped alternative
+fn install_hints(command: &str) -> Vec<String> {
+    safety::global_install_hints(command, std::env::var_os("VIRTUAL_ENV").is_some())
+}
+
+/// `safety.check_paths`: a note for each path an `rm`/`mv`-style command
+/// names that isn't in the directory it will run in
+fn path_warnings(command: &str, cwd: Option<&Path>) -> Vec<String> {
+    if !config::get().safety.check_paths {
+        return Vec::new();
+    }
+    let dir = match cwd {
+        Some(dir) => dir.to_path_buf(),
+        None => match std::env::current_dir() {
+            Ok(dir) => dir,
+            Err(_) => return Vec::new(),
+        },
+    };
+    safety::missing_paths(command, &dir)
+        .into_iter()
+        .map(|path| {
+            format!(
+                "no '{}' in {} — are you in the right folder?",
+                path,
+                dir.display()
+            )
+        })
+        .collect()
+}
+
+/// A note when the command throws away uncommitted git work and the
+/// repository it runs in has some
+fn uncommitted_warning(command: &str, cwd: Option<&Path>) -> Option<String> {
+    let loss = safety::git_loss(command)?;
+    let mut git = Command::new("git");
+    git.args(["status", "--porcelain"]).stderr(Stdio::null());
+    if let Some(dir) = cwd {
+        git.current_dir(dir);
+    }
+    let output = git.output().ok().filter(|o| o.status.success())?;
+    let status = String::from_utf8_lossy(&output.stdout);
+    uncommitted_note(loss, &status)
+}
+
+/// The note for `git status --porcelain` output, if it shows anything the
+/// loss applies to
+fn uncommitted_note(loss: safety::GitLoss, status: &str) -> Option<String> {
+    let untracked = loss == safety::GitLoss::Untracked;
+    let count = status
+        .lines()
+        .filter(|line| !line.trim().is_empty() && line.starts_with("??") == untracked)
+        .count();
+    let files = if count == 1 { "file" } else { "files" };
+    match (count, loss) {
+        (0, _) => None,
+        (_, safety::GitLoss::Changes) => Some(format!(
+            "you have uncommitted changes that will be lost ({} {})",
+            count, files
+        )),
+        (_, safety::GitLoss::Untracked) => Some(format!(
+            "you have untracked files that will be deleted ({} {})",
+            count, files
+        )),
+    }
+}
+
+/// Shell keywords and builtins that start a step but aren't on PATH
+const SHELL_BUILTINS: &[&str] = &[
+    "cd",
+    "echo",
+    "export",
+    "source",
+    ".",
+    "alias",
+    "unset",
+    "set",
+    "read",
+    "printf",
+    "test",
+    "[",
+    "[[",
+    "eval",
+    "exit",
+    "return",
+    "shift",
+    "trap",
+    "type",
+    "wait",
+    "ulimit",
+    "umask",
+    "for",
+    "while",
+    "until",
+    "if",
+    "then",
+    "else",
+    "elif",
+    "fi",
+    "do",
+    "done",
+    "case",
+    "esac",
+    "function",
+    "{",
+    "}",
+    "!",
+    "true",
+    "false",
+    "local",
+    "pushd",
+    "popd",
+    "dirs",
+    "exec",
+    "command",
+    "builtin",
+    "declare",
+    "typeset",
+    "let",
+    "readonly",
+    "getopts",
+    "hash",
+    "history",
+    "jobs",
+    "fg",
+    "bg",
+    "disown",
+    "time",
+    "mapfile",
+    "readarray",
+    "shopt",
+    "select",
+    "kill",
+    "enable",
+    "compgen",
+    "complete",
+    "bind",
+    "caller",
+    "suspend",
+    "logout",
+    "times",
+    "break",
+    "continue",
+    ":",
+];
+
+/// Shells whose commands split into steps and builtins the way
+/// `missing_tools` reads them. PowerShell cmdlets and cmd's built-ins
+/// aren't programs on PATH, so those shells get no check.
+const POSIX_SHELLS: &[&str] = &["sh", "bash", "dash", "ksh", "zsh"];
+
+/// A note for each program the command runs that isn't on PATH, so a
+/// missing tool shows up before the command fails. `ui.known_commands`
+/// are never missing, and with `ui.tool_check_shell` the user's shell gets
+/// the last word on the rest. Only done for `POSIX_SHELLS`.
+fn missing_tools(command: &str, shell: &str) -> Vec<String> {
+    if !POSIX_SHELLS.contains(&shell) {
+        return Vec::new();
+    }
+    let ui = &config::get().ui;
+    let mut tools: Vec<String> = Vec::new();
+    for step in command.split(['|', ';', '&', '\n']) {
+        let Some(tool) = first_tool(step) else {
+            continue;
+        };
+        // Scripts run by path (`./build.sh`) aren't looked up on PATH
+        let by_path = step
+            .split_whitespace()
+            .any(|word| word.contains('/') && word.ends_with(tool.as_str()));
+        if !by_path
+            && !SHELL_BUILTINS.contains(&tool.as_str())
+            && !ui.known_commands.contains(&tool)
+            && !tools.contains(&tool)
+        {
+            tools.push(tool);
+        }
+    }
+
+    tools.retain(|tool| !prompt::which(tool));
+    if ui.tool_check_shell && !tools.is_empty() {
+        let defined = prompt::shell_defines(&tools);
+        tools.retain(|tool| !defined.contains(tool));
+    }
+    tools
+        .into_iter()
+        .map(|tool| format!("'{}' is not installed (or not on PATH)", tool))
+        .collect()
+}
+
+/// Lint and assess the command, then write it in the requested format.
+/// Linting happens before anything runs; its warnings never block.
+fn report(
+    command: &str,
+    notes: &[String],
+    shell: &str,
+    opts: &Options,
+) -> Result<safety::Assessment> {
+    let lints = lint::shellcheck(command, shell);
+    let assessment = safety::assess(command);
+    let shown = over_ssh(opts.ssh.as_deref(), command);
+    let report = output::Report {
+        command: &shown,
+        notes,
+        lints: &lints,
+        assessment: &assessment,
+    };
+    let exec = opts.exec && !config::get().safety.print_only;
+    output::formatter(opts.format, shell, exec).write(
+        &report,
+        &mut io::stdout(),
+        &mut io::stderr(),
+    )?;
+    Ok(assessment)
+}
+
+fn record_history(
+    query: &str,
+    command: &str,
+    provider: String,
+    risk: safety::RiskLevel,
+    latency_ms: Option<u64>,
+    opts: &Options,
+) {
+    let entry = history::Entry {
+        timestamp: history::now_unix(),
+        query: query.to_string(),
+        command: command.to_string(),
+        provider,
+        risk,
+        latency_ms,
+        note: opts.note.clone(),
+    };
+    if let Err(e) = history::record(&entry) {
+        if opts.verbose {
+            eprintln!("  ⚠ Could not record history: {:#}", e);
+        }
+    }
+}
+
+/// Ask the model to describe a flagged command's consequences (`--what-if`),
+/// giving it the rules that matched so the two accounts line up
+fn what_if_messages(
+    ctx: &prompt::SystemContext,
+    command: &str,
+    assessment: &safety::Assessment,
+) -> Vec<Message> {
+    vec![
+        Message {
+            role: Role::System,
+            content: prompt::what_if_system_prompt(ctx),
+        },
+        Message {
+            role: Role::User,
+            content: format!(
+                "Command:\n{}\n\nFlagged as {}: {}",
+                command,
+                assessment.level,
+                assessment.reasons.join(", ")
+            ),
+        },
+    ]
+}
+
+/// `--time`: one line on stderr, so piping the command stays clean
+fn print_elapsed(started: Instant) {
+    eprintln!(
+        "{}",
+        format!("generated in {:.1}s", started.elapsed().as_secs_f64()).dimmed()
+    );
+}
+
+/// Run the `safety.strip_sudo` / `safety.rewrite` policy, then `hook`,
+/// noting on stderr whenever either changed the model's command
+fn apply_rewrites(text: &str, hook: &str, query: &str, provider: &str) -> Result<String> {
+    let rewritten = safety::rewrite(text)?;
+    let (command, hook_note) = run_hook(hook, rewritten.command, query, provider)?;
+    for note in rewritten.notes.iter().chain(&hook_note) {
+        eprintln!("{}", format!("  note: {}", note).dimmed());
+    }
+    Ok(command)
+}
+
+/// Label and OS description for each `--both` variant. The OS goes into
+/// the prompt's "works on {os}" rule, so the userland is spelled out.
+const BOTH_TARGETS: [(&str, &str); 2] = [
+    ("macOS", "macOS (BSD userland)"),
+    ("Linux", "Linux (GNU coreutils)"),
+];
+
+/// `--both`: generate the command once per target OS and print them
+/// labelled, or just once when they agree
+fn run_both(
+    query: &str,
+    ctx: &prompt::SystemContext,
+    provider: Box<dyn Provider>,
+    verbose: bool,
+    max_concurrent: usize,
+) -> Result<()> {
+    let num_ctx = provider.context_size();
+    let provider_name = provider.name().to_string();
+    let variants: Vec<Vec<Message>> = BOTH_TARGETS
+        .iter()
+        .map(|(_, os)| {
+            let mut target = ctx.clone();
+            target.os = os.to_string();
+            // Hints describe this machine, e.g. GNU tools on a Mac
+            target.hints.clear();
+            fit_context(&target, query, verbose, num_ctx)
+        })
+        .collect();
+
+    let results = cancel::run_cancellable(move || {
+        pooled(variants.len(), max_concurrent, |i| {
+            generate_command(provider.as_ref(), &variants[i])
+        })
+    });
+    // A variant that fails or is vetoed is left out, and the other still
+    // printed under its label
+    let hook = &config::get().hooks.post_generate;
+    let mut commands = Vec::new();
+    let mut last_err = None;
+    for ((label, _), result) in BOTH_TARGETS.iter().zip(results) {
+        let command = result.and_then(|g| apply_rewrites(&g.text, hook, query, &provider_name));
+        match command {
+            Ok(command) => commands.push((*label, command)),
+            Err(e) => {
+                dropped_note(label, &e);
+                last_err = Some(e);
+            }
+        }
+    }
+    if commands.is_empty() {
+        return Err(last_err.unwrap_or_else(|| anyhow!("No variants generated")));
+    }
+
+    for (_, command) in &commands {
+        let assessment = safety::assess(command);
+        if assessment.level >= safety::RiskLevel::Dangerous {
+            eprintln!(
+                "{} {}: {}",
+                "⚠".yellow().bold(),
+                assessment.level.as_str().yellow().bold(),
+                command
+            );
+        }
+    }
+    print!("{}", label_variants(&commands));
+    Ok(())
+}
+
+/// One command when every target agrees, else each under a `# label`
+/// comment so the output can still be pasted into a script. A variant
+/// that's missing leaves the other labelled.
+fn label_variants(commands: &[(&str, String)]) -> String {
+    if commands.len() == BOTH_TARGETS.len() && commands.windows(2).all(|w| w[0].1 == w[1].1) {
+        return format!("{}\n", commands[0].1);
+    }
+    commands
+        .iter()
+        .map(|(label, command)| format!("# {}\n{}\n", label, command))
+        .collect()
+}
+
+/// Say on stderr that one of several commands was left out, and why
+fn dropped_note(what: &str, err: &anyhow::Error) {
+    let reason = format!("{:#}", err);
+    eprintln!(
+        "{}",
+        format!(
+            "  {} left out: {}",
+            what,
+            reason.lines().next().unwrap_or_default()
+        )
+        .dimmed()
+    );
+}
+
+/// Pick a local provider for `--offline` and make sure it's reachable now,
+/// rather than finding out after retries or a model download attempt
+fn offline_provider(
+    requested: Option<&str>,
+    overrides: &HashMap<String, String>,
+) -> Result<Box<dyn Provider>> {
+    let cfg = config::load()?;
+    let is_local = |name: &str| cfg.providers.get(name).is_some_and(|p| p.kind == "ollama");
+
+    let name = match requested {
+        Some(name) if is_local(name) => name.to_string(),
+        Some(name) => bail!(
+            "--offline needs a local provider, but '{}' is a cloud provider",
+            name
+        ),
+        None if is_local(&cfg.active_provider) => cfg.active_provider.clone(),
+        None => {
+            let mut local: Vec<&String> = cfg.providers.keys().filter(|n| is_local(n)).collect();
+            local.sort();
+            match local.first() {
+                Some(name) => name.to_string(),
+                None => bail!(
+                    "Offline mode needs a local provider, but none is configured.\n\
+                     Run 'niko settings init --local' while online."
+                ),
+            }
+        }
+    };
+
+    let provider = llm::get_provider_with(Some(&name), overrides)?;
+    if !provider.is_available() {
+        bail!(
+            "Offline mode: Ollama ('{}') is not reachable.\nStart it with: ollama serve",
+            name
+        );
+    }
+    Ok(provider)
+}
+
+/// `-n N`: print up to N distinct candidates, numbered
+fn run_candidates(
+    query: &str,
+    provider: Box<dyn Provider>,
+    messages: &[Message],
+    n: usize,
+    max_concurrent: usize,
+    note: Option<String>,
+) -> Result<()> {
+    let provider_name = provider.name().to_string();
+    let messages = messages.to_vec();
+    let results = cancel::run_cancellable(move || {
+        generate_candidates(provider.as_ref(), &messages, n, max_concurrent)
+    });
+    let hook = &config::get().hooks.post_generate;
+    let commands = candidate_commands(results, hook, query, &provider_name)?;
+
+    for (i, command) in commands.iter().enumerate() {
+        let assessment = safety::assess(command);
+        let marker = if assessment.level >= safety::RiskLevel::Dangerous {
+            format!("  ⚠ {}", assessment.level).yellow().to_string()
+        } else {
+            String::new()
+        };
+        println!("{}. {}{}", i + 1, command, marker);
+    }
+    if commands.len() < n {
+        eprintln!(
+            "{}",
+            format!(
+                "{} of {} candidates were duplicates (raise the temperature for more variety)",
+                n - commands.len(),
+                n
+            )
+            .dimmed()
+        );
+    }
+
+    let entry = history::Entry {
+        timestamp: history::now_unix(),
+        query: query.to_string(),
+        command: commands[0].clone(),
+        provider: provider_name,
+        risk: safety::assess(&commands[0]).level,
+        latency_ms: None,
+        note,
+    };
+    let _ = history::record(&entry);
+
+    Ok(())
+}
+
+/// The distinct commands among `results`, each through `apply_rewrites`.
+/// Failed generations and vetoed candidates are skipped unless none are
+/// left.
+fn candidate_commands(
+    results: Vec<Result<Generation>>,
+    hook: &str,
+    query: &str,
+    provider: &str,
+) -> Result<Vec<String>> {
+    let mut commands: Vec<String> = Vec::new();
+    let mut last_err = None;
+    for (i, result) in results.into_iter().enumerate() {
+        match result {
+            Ok(generation) => match apply_rewrites(&generation.text, hook, query, provider) {
+                Ok(command) => {
+                    if !commands.contains(&command) {
+                        commands.push(command);
+                    }
+                }
+                Err(e) => {
+                    dropped_note(&format!("candidate {}", i + 1), &e);
+                    last_err = Some(e);
+                }
+            },
+            Err(e) => last_err = Some(e),
+        }
+    }
+
+    if commands.is_empty() {
+        return Err(last_err.unwrap_or_else(|| anyhow!("No candidates generated")));
+    }
+    Ok(commands)
+}
+
+/// Generate `n` candidates with at most `max_concurrent` requests in flight.
+/// Rate-limit errors that still occur are retried with backoff by
+/// `generate_with_retry`. Results come back in request order.
+pub fn generate_candidates(
+    provider: &dyn Provider,
+    messages: &[Message],
+    n: usize,
+    max_concurrent: usize,
+) -> Vec<Result<Generation>> {
+    pooled(n, max_concurrent, |_| generate_command(provider, messages))
+}
+
+/// Run `work(0..n)` on at most `max_concurrent` threads, returning the
+/// results in index order
+pub fn pooled<T, F>(n: usize, max_concurrent: usize, work: F) -> Vec<T>
+where
+    T: Send,
+    F: Fn(usize) -> T + Sync,
+{
+    let next = AtomicUsize::new(0);
+    let results: Mutex<Vec<Option<T>>> = Mutex::new((0..n).map(|_| None).collect());
+
+    thread::scope(|scope| {
+        for _ in 0..max_concurrent.clamp(1, n.max(1)) {
+            scope.spawn(|| loop {
+                let i = next.fetch_add(1, Ordering::SeqCst);
+                if i >= n {
+                    break;
+                }
+                let result = work(i);
+                results.lock().unwrap()[i] = Some(result);
+            });
+        }
+    });
+
+    results
+        .into_inner()
+        .unwrap()
+        .into_iter()
+        .flatten()
+        .collect()
+}
+
+/// Run `command` (on `ssh`'s host, when given) once the safety checks
+/// pass, exiting with its status. The checks see the command itself, not
+/// the `ssh` wrapped around it.
+fn execute(
+    command: &str,
+    assessment: &safety::Assessment,
+    cwd: Option<&Path>,
+    ssh: Option<&str>,
+    gate: Gate,
+) -> Result<()> {
+    let command = prepare_execution(command, assessment, gate)?;
+    exit_with(exec::run(&over_ssh(ssh, &command), cwd)?)
+}
+
+/// `--exec --fix`: run the command, and if it fails, show the model its
+/// error output and offer the corrected command. Only one round, so a
+/// model that keeps getting it wrong can't loop.
+fn execute_with_fix(
+    query: &str,
+    ctx: &prompt::SystemContext,
+    command: &str,
+    assessment: &safety::Assessment,
+    cwd: Option<&Path>,
+    provider: Box<dyn Provider>,
+    gate: Gate,
+) -> Result<()> {
+    let provider_name = provider.name().to_string();
+    let prepared = prepare_execution(command, assessment, gate)?;
+    let captured = exec::run_capturing_stderr(&prepared, cwd)?;
+    let code = match captured.status.code() {
+        Some(code) if code != 0 => code,
+        _ => return exit_with(captured.status),
+    };
+    let stderr = captured.stderr();
+
+    eprintln!(
+        "{}",
+        format!("  exited with {}, asking for a fix…", code).dimmed()
+    );
+    let messages = fix_messages(ctx, query, command, code, &stderr);
+    let generation =
+        cancel::run_cancellable(move || generate_command(provider.as_ref(), &messages))?;
+    let hook = &config::get().hooks.post_generate;
+    let (fixed, notes) = corrected_command(&generation.text, hook, query, &provider_name)?;
+    if fixed.trim() == command.trim() {
+        eprintln!("{}", "  no different command suggested".dimmed());
+        std::process::exit(code);
+    }
+
+    let lints = lint::shellcheck(&fixed, &ctx.shell);
+    let assessment = safety::assess(&fixed);
+    let report = output::Report {
+        command: &fixed,
+        notes: &notes,
+        lints: &lints,
+        assessment: &assessment,
+    };
+    output::formatter(output::Format::Text, &ctx.shell, true).write(
+        &report,
+        &mut io::stdout(),
+        &mut io::stderr(),
+    )?;
+    if !confirm("Run the corrected command?", gate.yes)? {
+        std::process::exit(code);
+    }
+    // The correction was asked for without --force
+    let gate = Gate {
+        forced: false,
+        ..gate
+    };
+    execute(&fixed, &assessment, cwd, None, gate)
+}
+
+/// The original request, the command that failed and the tail of its
+/// stderr, for a corrected command
+fn fix_messages(
+    ctx: &prompt::SystemContext,
+    query: &str,
+    command: &str,
+    code: i32,
+    stderr: &str,
+) -> Vec<Message> {
+    let stderr = stderr.trim();
+    let tail = match stderr.char_indices().rev().nth(FIX_STDERR_CHARS) {
+        Some((i, _)) => &stderr[i..],
+        None => stderr,
+    };
+    vec![
+        Message {
+            role: Role::System,
+            content: prompt::cmd_system_prompt(ctx),
+        },
+        Message {
+            role: Role::User,
+            content: format!(
+                "{}\n\nThis command failed with exit code {}:\n{}\n\nError output:\n{}\n\n\
+                 Give a corrected command.",
+                query, code, command, tail
+            ),
+        },
+    ]
+}
+
+/// The model's answer to a `--fix` request as a command, going through
+/// the rewrite policy, placeholders and `hook` like the first one did.
+/// Returns it with the notes to report.
+fn corrected_command(
+    text: &str,
+    hook: &str,
+    query: &str,
+    provider: &str,
+) -> Result<(String, Vec<String>)> {
+    let rewritten = safety::rewrite(text)?;
+    let fixed = fill_placeholders(&rewritten.command)?;
+    let (fixed, hook_note) = run_hook(hook, fixed, query, provider)?;
+    let mut notes = rewritten.notes;
+    notes.extend(hook_note);
+    Ok((fixed, notes))
+}
+
+/// `--diff`: show what the command would change in each file and ask
+/// before going on. Commands it can't preview ask too, saying so.
+/// Previewing runs part of the command, so it's held to the same
+/// print-only and blocked checks as running it.
+fn confirm_edits(command: &str, cwd: Option<&Path>, yes: bool) -> Result<()> {
+    if config::get().safety.print_only {
+        bail!("{}", PRINT_ONLY_NOTICE);
+    }
+    if safety::assess(command).blocked {
+        bail!("Command blocked by safety rules");
+    }
+    let question = match preview::preview(command, cwd)? {
+        Some(diffs) => {
+            for file in &diffs {
+                if file.diff.is_empty() {
+                    eprintln!(
+                        "{}",
+                        format!("  {}: unchanged", file.path.display()).dimmed()
+                    );
+                }
+                for line in file.diff.lines() {
+                    let line = match line.chars().next() {
+                        Some('+') if !line.starts_with("+++") => line.green(),
+                        Some('-') if !line.starts_with("---") => line.red(),
+                        Some('@') => line.cyan(),
+                        _ => line.normal(),
+                    };
+                    eprintln!("{}", line);
+                }
+            }
+            "Apply these changes?"
+        }
+        None => {
+            eprintln!("{}", "  no preview for this command".dimmed());
+            "Run it without a preview?"
+        }
+    };
+    if !confirm(question, yes)? {
+        bail!("Aborted");
+    }
+    Ok(())
+}
+
+/// How the checks in `prepare_execution` may be answered, and what the
+/// command already got past on its way there
+#[derive(Debug, Clone, Copy)]
+struct Gate {
+    /// `--yes`: answer the dangerous-command question
+    yes: bool,
+    /// The model only gave the command on a `--force` retry, noted in the
+    /// audit log once the command passes the checks
+    forced: bool,
+}
+
+/// `exec::confirm`, already answered under `--yes`
+fn confirm(question: &str, yes: bool) -> Result<bool> {
+    if yes {
+        eprintln!("{}", format!("  {} yes (--yes)", question).dimmed());
+        return Ok(true);
+    }
+    exec::confirm(question)
+}
+
+/// Blocked, placeholder and confirmation checks before running, then the
+/// command with TTY flags dropped when there is no terminal to give it.
+/// The checks use
+/// a fresh assessment of `command` itself, so whatever was typed into a
+/// placeholder, the editor or a hook is judged as part of what runs, not
+/// just the reported `assessment`.
+fn prepare_execution(command: &str, reported: &safety::Assessment, gate: Gate) -> Result<String> {
+    if config::get().safety.print_only {
+        bail!("{}", PRINT_ONLY_NOTICE);
+    }
+    check_filled(command)?;
+    let assessment = recheck(command, reported);
+    if assessment.blocked {
+        bail!("Command blocked by safety rules");
+    }
+
+    match confirmation_for(assessment.level, &config::get().safety) {
+        Confirmation::Retype => {
+            if !exec::confirm_by_retyping(command)? {
+                bail!("Aborted: the command wasn't retyped exactly");
+            }
+            audit_override(command, assessment.level, audit::Override::Retyped);
+        }
+        Confirmation::YesNo => {
+            // `--yes` never answers for a critical command
+            let yes = gate.yes && assessment.level < safety::RiskLevel::Critical;
+            if !confirm(&format!("Run this {} command?", assessment.level), yes)? {
+                bail!("Aborted");
+            }
+            if yes {
+                audit_override(command, assessment.level, audit::Override::Yes);
+            } else if assessment.level == safety::RiskLevel::Critical {
+                audit_override(command, assessment.level, audit::Override::Confirmed);
+            }
+        }
+        Confirmation::NotNeeded => {}
+    }
+
+    if gate.forced {
+        audit_override(command, assessment.level, audit::Override::Force);
+    }
+
+    Ok(if io::stdin().is_terminal() {
+        command.to_string()
+    } else {
+        without_tty(command)
+    })
+}
+
+/// What has to be answered before a command runs
+#[derive(Debug, PartialEq)]
+enum Confirmation {
+    NotNeeded,
+    YesNo,
+    /// Typing the command back, for `safety.retype_critical`
+    Retype,
+}
+
+/// The confirmation a command at `level` needs under `settings`.
+/// `require_confirm_dangerous: false` only waives it for dangerous
+/// commands; critical ones always ask.
+fn confirmation_for(level: safety::RiskLevel, settings: &config::SafetyConfig) -> Confirmation {
+    match level {
+        safety::RiskLevel::Critical if settings.retype_critical => Confirmation::Retype,
+        safety::RiskLevel::Critical => Confirmation::YesNo,
+        safety::RiskLevel::Dangerous if settings.require_confirm_dangerous => Confirmation::YesNo,
+        _ => Confirmation::NotNeeded,
+    }
+}
+
+/// Note a safety stop that was got past in the audit log. Like history,
+/// a log that can't be written doesn't stop the command.
+fn audit_override(command: &str, risk: safety::RiskLevel, mechanism: audit::Override) {
+    let _ = audit::record(&audit::Entry::new(command, risk, mechanism));
+}
+
+/// Assess the command about to run, and warn when it's riskier than the
+/// assessment that was shown for it
+fn recheck(command: &str, reported: &safety::Assessment) -> safety::Assessment {
+    let assessment = safety::assess(command);
+    if assessment.level > reported.level || (assessment.blocked && !reported.blocked) {
+        let mut warning = format!("now {}", assessment.level);
+        if !assessment.reasons.is_empty() {
+            warning.push_str(&format!(" ({})", assessment.reasons.join(", ")));
+        }
+        eprintln!(
+            "{} {}",
+            "⚠".yellow(),
+            format!("The command to run is {} after substitution", warning).yellow()
+        );
+    }
+    assessment
+}
+
+/// Exit with the command's own status code
+fn exit_with(status: ExitStatus) -> Result<()> {
+    match status.code() {
+        Some(0) => Ok(()),
+        Some(code) => std::process::exit(code),
+        None => bail!("Command terminated by signal"),
+    }
+}
+
+/// System context for command generation with the `prompt.*` settings
+/// applied. A non-empty `tools` overrides `prompt.context_tools`.
+pub fn command_context(tools: &[String]) -> prompt::SystemContext {
+    let cfg = &config::get().prompt;
+    let mut ctx = prompt::gather_context();
+    let allowed = if tools.is_empty() {
+        &cfg.context_tools
+    } else {
+        tools
+    };
+    prompt::restrict_tools(&mut ctx, allowed);
+    if cfg.gnu_coreutils {
+        prompt::prefer_gnu_coreutils(&mut ctx);
+    }
+    ctx.examples = cfg.examples.clone();
+    ctx
+}
+
+/// The context for `opts`: this machine's, or under `--ssh` the remote
+/// host's as far as `ssh.by_host` describes it
+fn context_for(opts: &Options) -> Result<prompt::SystemContext> {
+    match opts.ssh.as_deref() {
+        Some(destination) => remote_context(destination),
+        None => Ok(command_context(&opts.context_tools)),
+    }
+}
+
+/// What the model is told about an SSH destination. Nothing can be
+/// detected from here, so unset fields assume a Linux host with bash.
+fn remote_context(destination: &str) -> Result<prompt::SystemContext> {
+    check_destination(destination)?;
+    let cfg = config::get();
+    let remote = config::remote_host(cfg, destination);
+    let mut ctx = prompt::context_from(&prompt::PinnedContext {
+        os: Some(remote.os.unwrap_or_else(|| "linux".into())),
+        arch: Some(remote.arch.unwrap_or_else(|| "unknown".into())),
+        shell: Some(remote.shell.unwrap_or_else(|| "bash".into())),
+        cwd: Some("~".into()),
+        tools: Some(remote.tools),
+    });
+    ctx.hints.push(format!(
+        "The command runs on {} over SSH, starting in the remote user's home directory.",
+        destination
+    ));
+    ctx.examples = cfg.prompt.examples.clone();
+    Ok(ctx)
+}
+
+/// `--ssh` must be a plain `[user@]host`: it's passed to ssh as one
+/// argument, and a leading `-` would be read as an option
+fn check_destination(destination: &str) -> Result<()> {
+    static VALID: OnceLock<Regex> = OnceLock::new();
+    let valid = VALID
+        .get_or_init(|| Regex::new(r"^[A-Za-z0-9_.%:\[\]-]+(@[A-Za-z0-9_.%:\[\]-]+)?$").unwrap());
+    if destination.starts_with('-') || !valid.is_match(destination) {
+        bail!(
+            "--ssh {:?}: expected user@host (or a host from ~/.ssh/config)",
+            destination
+        );
+    }
+    Ok(())
+}
+
+/// `command` as it runs under `--ssh`: handed to ssh as a single quoted
+/// argument, which the remote shell then runs
+fn over_ssh(destination: Option<&str>, command: &str) -> String {
+    match destination {
+        Some(destination) => format!(
+            "ssh -- {} '{}'",
+            destination,
+            command.replace('\'', r"'\''")
+        ),
+        None => command.to_string(),
+    }
+}
+
+/// Absolute form of `--cwd`, which must be an existing directory
+fn resolve_cwd(dir: &Path) -> Result<PathBuf> {
+    let resolved = dir
+        .canonicalize()
+        .with_context(|| format!("--cwd {}: no such directory", dir.display()))?;
+    if !resolved.is_dir() {
+        bail!("--cwd {}: not a directory", dir.display());
+    }
+    Ok(resolved)
+}
+
+/// Adapt a command for running without a terminal: `docker exec -it` and
+/// friends lose the `-t` (which would fail with "the input device is not a
+/// TTY"), and interactive programs get a warning.
+fn without_tty(command: &str) -> String {
+    if let Some(adapted) = drop_tty_flag(command) {
+        eprintln!(
+            "{}",
+            "  note: no terminal, running with -i instead of -it".dimmed()
+        );
+        return adapted;
+    }
+    if let Some(tool) = interactive_tool(command, &config::get().ui.interactive_tools) {
+        eprintln!(
+            "{} {} needs a terminal and may hang or fail here",
+            "⚠".yellow(),
+            tool.bold()
+        );
+    }
+    command.to_string()
+}
+
+/// `-it`/`-ti` on `docker|podman|kubectl … exec|run`, replaced by `-i`
+fn drop_tty_flag(command: &str) -> Option<String> {
+    static TTY_FLAG: OnceLock<Regex> = OnceLock::new();
+    let re = TTY_FLAG.get_or_init(|| {
+        Regex::new(r"\b((?:docker|podman|kubectl)\s+(?:\S+\s+)*?(?:exec|run)\s+(?:[^|;&]*?\s)?)-(?:it|ti)\b")
+            .expect("invalid tty flag pattern")
+    });
+    re.is_match(command)
+        .then(|| re.replace_all(command, "${1}-i").into_owned())
+}
+
+/// The first program from `tools` (`ui.interactive_tools`) in any step of
+/// a pipeline or chain
+fn interactive_tool(command: &str, tools: &[String]) -> Option<String> {
+    command
+        .split(['|', ';', '&'])
+        .filter_map(first_tool)
+        .find(|tool| tools.contains(tool))
+}
+
+/// Ask for each `<placeholder>` on a terminal; otherwise leave them and
+/// say so. Blank answers keep the placeholder, and `prepare_execution`
+/// won't run a command that has any left.
+fn fill_placeholders(command: &str) -> Result<String> {
+    let names = placeholders::find(command);
+    if names.is_empty() {
+        return Ok(command.to_string());
+    }
+
+    if !exec::is_interactive() {
+        let list: Vec<String> = names.iter().map(|n| format!("<{}>", n)).collect();
+        eprintln!(
+            "{}",
+            format!("Fill in before running: {}", list.join(", ")).dimmed()
+        );
+        return Ok(command.to_string());
+    }
+
+    let mut values = Vec::new();
+    for name in names {
+        let value = exec::ask(&format!("{} {}: ", "?".cyan().bold(), name))?;
+        if !value.is_empty() {
+            values.push((name, value));
+        }
+    }
+    Ok(placeholders::fill(command, &values))
+}
+
+/// Refuse a command that still has `<placeholder>`s: `sh` would read
+/// `<file>` as an input redirect, and `<x> out` can truncate `out`
+fn check_filled(command: &str) -> Result<()> {
+    let names = placeholders::find(command);
+    if names.is_empty() {
+        return Ok(());
+    }
+    let list: Vec<String> = names.iter().map(|n| format!("<{}>", n)).collect();
+    bail!(
+        "Not running a command with unfilled placeholders: {}\n{}",
+        list.join(", "),
+        command
+    )
+}
+
+/// Let the user tweak the generated command in $EDITOR (`--edit`)
+fn edit_command(command: &str) -> Result<String> {
+    let edited = editor::edit_text(&format!("{}\n", command), ".sh")?;
+    let edited = edited.trim();
+    if edited.is_empty() {
+        bail!("Empty command, aborting");
+    }
+    Ok(edited.to_string())
+}
+
+/// Compose a query in $EDITOR (`niko --edit-query` or `niko -`)
+pub fn query_from_editor() -> Result<String> {
+    let buffer = editor::edit_text(EDITOR_TEMPLATE, ".txt")?;
+    let query = strip_comment_lines(&buffer);
+    if query.is_empty() {
+        bail!("Empty query, aborting");
+    }
+    Ok(query)
+}
+
+/// The query piped to `niko -`, paragraphs kept
+pub fn query_from_stdin() -> Result<String> {
+    let input = io::read_to_string(io::stdin()).context("Failed to read the query from stdin")?;
+    let query = join_query(&[input]);
+    if query.is_empty() {
+        bail!("Empty query on stdin");
+    }
+    Ok(query)
+}
+
+/// The query's arguments as one request. They're joined with spaces, but
+/// newlines inside them (a quoted multi-line paste) stay, since the
+/// paragraph structure helps the model: line endings are normalised, each
+/// line trimmed, and runs of blank lines shrunk to one.
+pub fn join_query(parts: &[String]) -> String {
+    let joined = parts.join(" ").replace("\r\n", "\n").replace('\r', "\n");
+    let mut lines: Vec<&str> = Vec::new();
+    for line in joined.lines().map(str::trim) {
+        if line.is_empty() && lines.last().is_none_or(|l| l.is_empty()) {
+            continue;
+        }
+        lines.push(line);
+    }
+    lines.join("\n").trim().to_string()
+}
+
+fn strip_comment_lines(buffer: &str) -> String {
+    buffer
+        .lines()
+        .filter(|line| !line.trim_start().starts_with('#'))
+        .collect::<Vec<_>>()
+        .join("\n")
+        .trim()
+        .to_string()
+}
+
+/// The tools to list for `query`, at most `prompt.max_tools` of them. A
+/// long uncapped list is only pointed out under `-v`.
+fn relevant_tools(ctx: &prompt::SystemContext, query: &str, verbose: bool) -> Vec<String> {
+    let max = config::get().prompt.max_tools;
+    let count = ctx.available_tools.len();
+    if max == 0 || count <= max {
+        if verbose && count > TOOL_LIST_WARN {
+            progress::eprint_line(&format!(
+                "{}",
+                format!(
+                    "  {} tools listed in the prompt; prompt.max_tools can cap them",
+                    count
+                )
+                .dimmed()
+            ));
+        }
+        return ctx.available_tools.clone();
+    }
+    if verbose {
+        progress::eprint_line(&format!(
+            "{}",
+            format!("  listing {} of {} tools (prompt.max_tools)", max, count).dimmed()
+        ));
+    }
+    prompt::rank_tools(&ctx.available_tools, query, &ctx.hints, max)
+}
+
+pub fn build_messages(ctx: &prompt::SystemContext, query: &str, verbose: bool) -> Vec<Message> {
+    let mut ctx = ctx.clone();
+    ctx.examples = examples::relevant(query, &ctx.examples, verbose);
+    ctx.available_tools = relevant_tools(&ctx, query, verbose);
+    let mut system = prompt::cmd_system_prompt(&ctx);
+
+    let tool_help = prompt::discover_tool_help(query, verbose);
+    if !tool_help.is_empty() {
+        system.push_str(&tool_help);
+    }
+
+    vec![
+        Message {
+            role: Role::System,
+            content: system,
+        },
+        Message {
+            role: Role::User,
+            content: query.to_string(),
+        },
+    ]
+}
+
+/// Rough token count for a prompt: about four characters per token
+fn estimate_tokens(messages: &[Message]) -> usize {
+    messages.iter().map(|m| m.content.len()).sum::<usize>() / 4
+}
+
+/// Messages for `query` that leave room for the reply within `num_ctx`
+/// tokens. Over budget, the least useful context goes first: the tools
+/// list, then the `--help` excerpts and examples. Ollama silently drops the start of
+/// an overflowing prompt, which is where the rules are.
+fn fit_context(
+    ctx: &prompt::SystemContext,
+    query: &str,
+    verbose: bool,
+    num_ctx: Option<u32>,
+) -> Vec<Message> {
+    let messages = build_messages(ctx, query, verbose);
+    let Some(num_ctx) = num_ctx else {
+        return messages;
+    };
+    let budget = (num_ctx as usize).saturating_sub(CMD_MAX_TOKENS as usize);
+    if estimate_tokens(&messages) <= budget {
+        return messages;
+    }
+
+    let mut trimmed = ctx.clone();
+    trimmed.available_tools.clear();
+    let messages = build_messages(&trimmed, query, verbose);
+    if verbose {
+        progress::eprint_line(&format!(
+            "{}",
+            format!(
+                "  prompt exceeds num_ctx {}: dropped the tools list",
+                num_ctx
+            )
+            .dimmed()
+        ));
+    }
+    if estimate_tokens(&messages) <= budget {
+        return messages;
+    }
+
+    if verbose {
+        progress::eprint_line(&format!(
+            "{}",
+            "  still too long: dropped --help excerpts and examples".dimmed()
+        ));
+    }
+    trimmed.examples.clear();
+    vec![
+        Message {
+            role: Role::System,
+            content: prompt::cmd_system_prompt(&trimmed),
+        },
+        Message {
+            role: Role::User,
+            content: query.to_string(),
+        },
+    ]
+}
+
+/// Generate a response and extract the command from it. The returned
+/// generation's `text` is the extracted command.
+///
+/// Providers return the model text as-is; extraction happens here and only
+/// here, so local and cloud output go through exactly the same cleaning.
+pub fn generate_command(provider: &dyn Provider, messages: &[Message]) -> Result<Generation> {
+    generate_command_with(provider, messages, false)
+}
+
+/// Like `generate_command`; with `force`, a refusal is retried once with
+/// softened instructions. The deterministic risk check then takes over from
+/// the model: a forced answer that assesses as critical is rejected.
+pub fn generate_command_with(
+    provider: &dyn Provider,
+    messages: &[Message],
+    force: bool,
+) -> Result<Generation> {
+    if let Some(generation) = structured_command(provider, messages) {
+        check_length(&generation.text, config::get().safety.max_command_length)?;
+        return Ok(generation);
+    }
+    let first = llm::generate_with_retry_meta(provider, messages, CMD_MAX_TOKENS)?;
+    finish_command(provider, messages, force, first)
+}
+
+/// What providers with `structured_output` are asked to answer with
+fn command_schema() -> serde_json::Value {
+    serde_json::json!({
+        "type": "object",
+        "properties": {
+            "command": {
+                "type": "string",
+                "description": "The shell command, and nothing else"
+            },
+            "risk_note": {
+                "type": "string",
+                "description": "One short sentence on what the command could damage, or empty"
+            }
+        },
+        "required": ["command", "risk_note"],
+        "additionalProperties": false
+    })
+}
+
+/// With `<provider>.structured_output`, the command from a JSON answer.
+/// `None` means asking for text instead: structured output is off, the
+/// provider or model rejected it, or the answer held no command.
+fn structured_command(provider: &dyn Provider, messages: &[Message]) -> Option<Generation> {
+    if !provider.supports_structured_output() {
+        return None;
+    }
+    let problem = match provider.generate_json(messages, CMD_MAX_TOKENS, &command_schema()) {
+        Ok(generation) => match parse_structured(&generation.text) {
+            Some((command, note)) => {
+                return Some(Generation {
+                    text: command,
+                    note,
+                    ..generation
+                })
+            }
+            None => "the structured answer had no command".to_string(),
+        },
+        Err(e) => {
+            let error = format!("{:#}", e);
+            format!(
+                "structured output failed ({})",
+                error.lines().next().unwrap_or_default()
+            )
+        }
+    };
+    llm::report_status(&format!("{}; asking for text…", problem));
+    None
+}
+
+/// The command (cleaned like a free-text answer) and risk note from a
+/// structured answer. JSON can spell escapes as `\u001b`, so both are
+/// sanitized after decoding.
+fn parse_structured(text: &str) -> Option<(String, Option<String>)> {
+    let start = text.find('{')?;
+    let end = text.rfind('}')?;
+    let answer: serde_json::Value = serde_json::from_str(text.get(start..=end)?).ok()?;
+    let command = extract_command(&llm::sanitize(answer.get("command")?.as_str()?))?;
+    let note = answer
+        .get("risk_note")
+        .and_then(|n| n.as_str())
+        .map(llm::sanitize)
+        .map(|n| n.trim().to_string())
+        .filter(|n| !n.is_empty());
+    Some((command, note))
+}
+
+/// Extract the command from a first generation already made for
+/// `messages`, retrying as `generate_command_with` describes, and reject
+/// it if it's longer than `safety.max_command_length`
+fn finish_command(
+    provider: &dyn Provider,
+    messages: &[Message],
+    force: bool,
+    generation: Generation,
+) -> Result<Generation> {
+    let generation = extract_generation(provider, messages, force, generation)?;
+    check_length(&generation.text, config::get().safety.max_command_length)?;
+    Ok(generation)
+}
+
+/// Refuse output over `max` characters (0 = no limit): a model that dumps
+/// a wall of text shouldn't flood the terminal, let alone reach `--exec`
+fn check_length(command: &str, max: usize) -> Result<()> {
+    let len = command.chars().count();
+    if max == 0 || len <= max {
+        return Ok(());
+    }
+    let preview: String = command.chars().take(200).collect();
+    bail!(
+        "Generated output too long ({} characters, limit {}), likely not a command:\n{}…\n\n\
+         Raise the limit with `niko settings set safety.max_command_length <n>` if it is.",
+        len,
+        max,
+        preview
+    )
+}
+
+fn extract_generation(
+    provider: &dyn Provider,
+    messages: &[Message],
+    force: bool,
+    mut generation: Generation,
+) -> Result<Generation> {
+    if is_refusal(&generation.text) {
+        if !force {
+            bail!(
+                "The model declined this request:\n{}\n\n\
+                 If it is benign, retry with --force (niko still checks the command's risk).",
+                generation.text
+            );
+        }
+
+        let retry = with_reminder(messages, FORCE_REMINDER);
+        generation = llm::generate_with_retry_meta(provider, &retry, CMD_MAX_TOKENS)?;
+        if is_refusal(&generation.text) {
+            bail!("The model declined even with --force:\n{}", generation.text);
+        }
+        let command =
+            extract_command(&generation.text).ok_or_else(|| no_command_error(&generation.text))?;
+
+        let assessment = safety::assess(&command);
+        if assessment.level == safety::RiskLevel::Critical {
+            bail!(
+                "Refusing a critical command obtained with --force ({}):\n{}",
+                assessment.reasons.join(", "),
+                command
+            );
+        }
+        return Ok(Generation {
+            text: command,
+            forced: true,
+            ..generation
+        });
+    }
+
+    if let Some(command) = extract_command(&generation.text) {
+        return Ok(Generation {
+            text: command,
+            ..generation
+        });
+    }
+
+    // Small local models occasionally answer in prose. One terser retry is
+    // cheap locally; cloud calls are never repeated to avoid double billing.
+    if !provider.is_local() {
+        return Err(no_command_error(&generation.text));
+    }
+
+    let retry = with_reminder(messages, TERSE_REMINDER);
+    let generation = llm::generate_with_retry_meta(provider, &retry, CMD_MAX_TOKENS)?;
+    match extract_command(&generation.text) {
+        Some(command) => Ok(Generation {
+            text: command,
+            ..generation
+        }),
+        None => Err(no_command_error(&generation.text)),
+    }
+}
+
+/// One-line summary for verbose output, e.g. `qwen2.5-coder:7b · 412→9 tokens · 1.3s`
+fn describe_generation(generation: &Generation) -> String {
+    let mut parts = Vec::new();
+    if !generation.model.is_empty() {
+        parts.push(generation.model.clone());
+    }
+    if let (Some(prompt), Some(completion)) =
+        (generation.prompt_tokens, generation.completion_tokens)
+    {
+        parts.push(format!("{}→{} tokens", prompt, completion));
+    }
+    parts.push(format!("{:.1}s", generation.latency.as_secs_f64()));
+    parts.join(" · ")
+}
+
+fn no_command_error(raw: &str) -> anyhow::Error {
+    anyhow!("Could not find a command in the response:\n{}", raw)
+}
+
+/// Messages as `--prompt-only` prints them, each under a `── role ──` rule
+fn format_prompt(messages: &[Message]) -> String {
+    messages
+        .iter()
+        .map(|m| {
+            let role = match m.role {
+                Role::System => "system",
+                Role::User => "user",
+                Role::Assistant => "assistant",
+            };
+            format!("── {} ──\n{}\n", role, m.content.trim_end())
+        })
+        .collect::<Vec<_>>()
+        .join("\n")
+}
+
+/// Copy of `messages` with `reminder` appended to the last user turn
+fn with_reminder(messages: &[Message], reminder: &str) -> Vec<Message> {
+    let mut retry = messages.to_vec();
+    if let Some(last) = retry.iter_mut().rev().find(|m| m.role == Role::User) {
+        last.content = format!("{}\n\n{}", last.content, reminder);
+    }
+    retry
+}
+
+/// Whether the answer is a refusal rather than a (possibly prose) command
+fn is_refusal(text: &str) -> bool {
+    let lowered = text.trim().replace('’', "'").to_lowercase();
+    REFUSAL_PREFIXES.iter().any(|p| lowered.starts_with(p))
+}
+
+/// First executable in a command, skipping env assignments and wrappers
+/// like `sudo`
+pub fn first_tool(command: &str) -> Option<String> {
+    const WRAPPERS: &[&str] = &["sudo", "env", "time", "nohup", "exec"];
+
+    command
+        .split_whitespace()
+        .map(|word| word.trim_start_matches('('))
+        .find(|word| !word.is_empty() && !word.contains('=') && !WRAPPERS.contains(word))
+        .and_then(|word| word.rsplit('/').next())
+        .filter(|tool| !tool.is_empty())
+        .map(String::from)
+}
+
+// ─── Extraction ─────────────────────────────────────────────────────────────
+
+/// Extract a runnable command from raw model output.
+///
+/// Handles fenced code blocks, inline backticks, `$ ` prompts and
+/// surrounding prose. Returns `None` when nothing command-like remains.
+pub fn extract_command(raw: &str) -> Option<String> {
+    let text = raw.trim();
+    if text.is_empty() {
+        return None;
+    }
+
+    let body = fenced_block(text).unwrap_or(text);
+
+    let mut lines: Vec<String> = Vec::new();
+    for line in body.lines() {
+        let line = clean_line(line);
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+        if looks_like_prose(&line) {
+            // Prose before the command is skipped, prose after it ends it
+            if lines.is_empty() {
+                continue;
+            }
+            break;
+        }
+        lines.push(line);
+    }
+
+    if lines.is_empty() {
+        return inline_code(text);
+    }
+    Some(lines.join("\n"))
+}
+
+/// Return the body of the first ``` fenced block, without its language tag
+fn fenced_block(text: &str) -> Option<&str> {
+    let start = text.find("```")?;
+    let after = &text[start + 3..];
+
+    let first_line_end = after.find('\n').unwrap_or(after.len());
+    if let Some(end) = after[..first_line_end].find("```") {
+        // Single-line fence: ```ls -la```
+        return Some(&after[..end]);
+    }
+
+    let body = &after[(first_line_end + 1).min(after.len())..];
+    let end = body.find("```").unwrap_or(body.len());
+    Some(&body[..end])
+}
+
+/// Strip prompt markers and wrapping backticks from a single line
+fn clean_line(line: &str) -> String {
+    let mut line = line.trim();
+    if let Some(rest) = line.strip_prefix("$ ") {
+        line = rest.trim_start();
+    }
+    if line.len() >= 2 && line.starts_with('`') && line.ends_with('`') {
+        line = line.trim_matches('`').trim();
+    }
+    line.to_string()
+}
+
+fn looks_like_prose(line: &str) -> bool {
+    line.ends_with(':') || PROSE_PREFIXES.iter().any(|p| line.starts_with(p))
+}
+
+/// Fall back to the first `inline code` span in a prose answer
+fn inline_code(text: &str) -> Option<String> {
+    let start = text.find('`')? + 1;
+    let len = text[start..].find('`')?;
+    let code = text[start..start + len].trim();
+    if code.is_empty() {
+        None
+    } else {
+        Some(code.to_string())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::llm::mock::MockProvider;
+    use crate::llm::ModelInfo;
+
+    /// Provider that replays canned responses in order (repeating the last),
+    /// named like a real backend
+    struct CannedProvider {
+        name: &'static str,
+        responses: Vec<&'static str>,
+        calls: AtomicUsize,
+    }
+
+    impl CannedProvider {
+        fn new(name: &'static str, responses: &[&'static str]) -> Self {
+            Self {
+                name,
+                responses: responses.to_vec(),
+                calls: AtomicUsize::new(0),
+            }
+        }
+
+        fn calls(&self) -> usize {
+            self.calls.load(Ordering::SeqCst)
+        }
+    }
+
+    impl Provider for CannedProvider {
+        fn name(&self) -> &str {
+            self.name
+        }
+
+        fn model(&self) -> &str {
+            "test-model"
+        }
+
+        fn generate_with_meta(
+            &self,
+            _messages: &[Message],
+            _max_tokens: u32,
+        ) -> Result<Generation> {
+            let call = self.calls.fetch_add(1, Ordering::SeqCst);
+            let idx = call.min(self.responses.len() - 1);
+            Ok(Generation {
+                text: self.responses[idx].to_string(),
+                model: format!("{}-test", self.name),
+                ..Default::default()
+            })
+        }
+
+        fn is_available(&self) -> bool {
+            true
+        }
+
+        fn is_local(&self) -> bool {
+            self.name == "ollama"
+        }
+
+        fn list_models(&self) -> Result<Vec<ModelInfo>> {
+            Ok(Vec::new())
+        }
+    }
+
+    #[test]
+    fn race_keeps_the_first_valid_command() {
+        let ctx = prompt::gather_context();
+        let providers: Vec<Box<dyn Provider>> = vec![
+            Box::new(CannedProvider::new(
+                "openai",
+                &["Sure! Here is how you do it."],
+            )),
+            Box::new(CannedProvider::new("ollama", &["ls -la"])),
+        ];
+        let (generation, winner) =
+            race_providers(&ctx, "list files", providers, false, false).unwrap();
+        assert_eq!(generation.text, "ls -la");
+        assert_eq!(winner.name(), "ollama");
+
+        let providers: Vec<Box<dyn Provider>> = vec![
+            Box::new(CannedProvider::new("openai", &["I cannot help with that."])),
+            Box::new(CannedProvider::new("groq", &["Declined."])),
+        ];
+        let err = race_providers(&ctx, "list files", providers, false, false)
+            .err()
+            .unwrap()
+            .to_string();
+        assert!(err.contains("openai: ") && err.contains("groq: "));
+    }
+
+    #[test]
+    fn oversized_output_is_rejected() {
+        let wall = format!("```bash\n{}\n```", "echo spam && ".repeat(400));
+        let provider = CannedProvider::new("ollama", &[wall.leak()]);
+        let messages = build_messages(&prompt::gather_context(), "say hi", false);
+        let err = generate_command(&provider, &messages)
+            .unwrap_err()
+            .to_string();
+        assert!(err.contains("too long"), "{}", err);
+
+        assert!(check_length("ls -la", 10).is_ok());
+        assert!(check_length("ls -la", 5).is_err());
+        assert!(check_length(&"x".repeat(10_000), 0).is_ok());
+    }
+
+    #[test]
+    fn extracts_plain_command() {
+        assert_eq!(extract_command("ls -la\n").as_deref(), Some("ls -la"));
+    }
+
+    #[test]
+    fn extracts_fenced_block_and_drops_language_tag() {
+        let raw = "Here is the command:\n```bash\nfind . -name '*.rs'\n```\nThis finds Rust files.";
+        assert_eq!(extract_command(raw).as_deref(), Some("find . -name '*.rs'"));
+    }
+
+    #[test]
+    fn extracts_single_line_fence() {
+        assert_eq!(
+            extract_command("```du -sh *```").as_deref(),
+            Some("du -sh *")
+        );
+    }
+
+    #[test]
+    fn strips_dollar_prompt_and_backticks() {
+        assert_eq!(
+            extract_command("$ git status").as_deref(),
+            Some("git status")
+        );
+        assert_eq!(extract_command("`df -h`").as_deref(), Some("df -h"));
+    }
+
+    #[test]
+    fn stops_at_trailing_prose() {
+        let raw = "ps aux | grep node\nThe command lists node processes.";
+        assert_eq!(extract_command(raw).as_deref(), Some("ps aux | grep node"));
+    }
+
+    #[test]
+    fn falls_back_to_inline_code_in_prose() {
+        let raw = "You can run `lsof -i :3000` to see what is using the port.";
+        assert_eq!(extract_command(raw).as_deref(), Some("lsof -i :3000"));
+    }
+
+    #[test]
+    fn empty_or_prose_only_response_has_no_command() {
+        assert_eq!(extract_command("   "), None);
+        assert_eq!(extract_command("Sure, happy to help with that."), None);
+    }
+
+    #[test]
+    fn first_tool_skips_wrappers_and_env_assignments() {
+        assert_eq!(first_tool("ls -la").as_deref(), Some("ls"));
+        assert_eq!(
+            first_tool("sudo RUST_LOG=debug /usr/bin/cargo run").as_deref(),
+            Some("cargo")
+        );
+        assert_eq!(first_tool("   "), None);
+    }
+
+    #[test]
+    fn markdown_fence_is_tagged_by_shell() {
+        assert_eq!(output::fenced("ls -la", "zsh"), "```bash\nls -la\n```");
+        assert_eq!(
+            output::fenced("Get-ChildItem", "powershell"),
+            "```powershell\nGet-ChildItem\n```"
+        );
+        assert_eq!(
+            extract_command(&output::fenced("du -sh *", "bash")).as_deref(),
+            Some("du -sh *")
+        );
+    }
+
+    #[test]
+    fn editor_buffer_drops_comments_and_keeps_paragraphs() {
+        let buffer = "find large logs\n\nolder than a week\n# ignored\n";
+        assert_eq!(
+            strip_comment_lines(buffer),
+            "find large logs\n\nolder than a week"
+        );
+        assert_eq!(strip_comment_lines(EDITOR_TEMPLATE), "");
+    }
+
+    #[test]
+    fn multi_line_queries_keep_their_paragraphs() {
+        let pasted = "Find every log file under /var/log older than a week.  \r\n\r\n\r\n\
+                      Compress them into one archive, then delete the originals.\n";
+        let query = join_query(&[pasted.to_string()]);
+        assert_eq!(
+            query,
+            "Find every log file under /var/log older than a week.\n\n\
+             Compress them into one archive, then delete the originals."
+        );
+
+        let messages = build_messages(&prompt::gather_context(), &query, false);
+        assert_eq!(messages[1].content, query);
+
+        let words = ["list".to_string(), "big".into(), "files".into()];
+        assert_eq!(join_query(&words), "list big files");
+    }
+
+    #[test]
+    fn local_and_cloud_extract_identically() {
+        let raw = "```sh\n$ tar -czf logs.tar.gz logs/\n```";
+        let messages = [Message {
+            role: Role::User,
+            content: "compress logs".into(),
+        }];
+
+        let local = CannedProvider::new("ollama", &[raw]);
+        let cloud = CannedProvider::new("openai", &[raw]);
+
+        let from_local = generate_command(&local, &messages).unwrap().text;
+        let from_cloud = generate_command(&cloud, &messages).unwrap().text;
+        assert_eq!(from_local, "tar -czf logs.tar.gz logs/");
+        assert_eq!(from_local, from_cloud);
+    }
+
+    #[test]
+    fn local_provider_retries_once_when_extraction_fails() {
+        let messages = [Message {
+            role: Role::User,
+            content: "show disk usage".into(),
+        }];
+        let local = CannedProvider::new("ollama", &["Sure, happy to help with that.", "df -h"]);
+
+        assert_eq!(generate_command(&local, &messages).unwrap().text, "df -h");
+        assert_eq!(local.calls(), 2);
+    }
+
+    #[test]
+    fn cloud_provider_does_not_retry_on_bad_extraction() {
+        let messages = [Message {
+            role: Role::User,
+            content: "show disk usage".into(),
+        }];
+        let cloud = CannedProvider::new("openai", &["Sure, happy to help.", "df -h"]);
+
+        assert!(generate_command(&cloud, &messages).is_err());
+        assert_eq!(cloud.calls(), 1);
+    }
+
+    #[test]
+    fn mock_provider_runs_through_extraction_and_assessment() {
+        let messages = build_messages(&prompt::gather_context(), "clean the build", false);
+        let mock = MockProvider::new("Here you go:\n```bash\nrm -rf ./build\n```");
+
+        let command = generate_command(&mock, &messages).unwrap().text;
+        assert_eq!(command, "rm -rf ./build");
+        let assessment = safety::assess_with(&command, &[]);
+        assert_eq!(assessment.level, safety::RiskLevel::Dangerous);
+        assert_eq!(
+            output::fenced(&command, "bash"),
+            "```bash\nrm -rf ./build\n```"
+        );
+    }
+
+    #[test]
+    fn invalid_bytes_do_not_reach_the_command() {
+        // A stream cut off mid-character, plus a stray escape byte
+        let raw = String::from_utf8_lossy(b"```bash\ndu -sh \x1b* | sort -h\xe2\x94\n```");
+        let command = extract_command(&llm::sanitize(&raw)).unwrap();
+        assert_eq!(command, "du -sh * | sort -h");
+    }
+
+    #[test]
+    fn refusals_need_force_and_are_retried_once() {
+        let messages = [Message {
+            role: Role::User,
+            content: "delete my node_modules".into(),
+        }];
+        let refusal = "Declined: deleting files could cause data loss.";
+
+        let p = CannedProvider::new("ollama", &[refusal, "rm -rf node_modules"]);
+        let err = generate_command(&p, &messages).unwrap_err().to_string();
+        assert!(err.contains("--force"));
+        assert_eq!(p.calls(), 1);
+
+        let p = CannedProvider::new("ollama", &[refusal, "rm -rf node_modules"]);
+        let forced = generate_command_with(&p, &messages, true).unwrap();
+        assert_eq!(forced.text, "rm -rf node_modules");
+        assert!(forced.forced);
+        assert_eq!(p.calls(), 2);
+    }
+
+    #[test]
+    fn forced_answers_still_face_the_risk_check() {
+        let messages = [Message {
+            role: Role::User,
+            content: "wipe everything".into(),
+        }];
+        let p = CannedProvider::new(
+            "openai",
+            &["I'm sorry, I can't help with that.", "rm -rf /"],
+        );
+        assert!(generate_command_with(&p, &messages, true).is_err());
+
+        let p = CannedProvider::new("openai", &["I cannot do that.", "I cannot do that."]);
+        let err = generate_command_with(&p, &messages, true).unwrap_err();
+        assert!(err.to_string().contains("even with --force"));
+    }
+
+    #[test]
+    fn critical_commands_ask_even_without_confirm_dangerous() {
+        use safety::RiskLevel::{Critical, Dangerous, Safe};
+
+        let mut settings = config::SafetyConfig {
+            require_confirm_dangerous: false,
+            retype_critical: false,
+            ..Default::default()
+        };
+        assert_eq!(confirmation_for(Critical, &settings), Confirmation::YesNo);
+        assert_eq!(
+            confirmation_for(Dangerous, &settings),
+            Confirmation::NotNeeded
+        );
+        assert_eq!(confirmation_for(Safe, &settings), Confirmation::NotNeeded);
+
+        settings.retype_critical = true;
+        assert_eq!(confirmation_for(Critical, &settings), Confirmation::Retype);
+        settings.require_confirm_dangerous = true;
+        assert_eq!(confirmation_for(Dangerous, &settings), Confirmation::YesNo);
+    }
+
+    #[test]
+    fn cwd_must_be_an_existing_directory() {
+        let tmp = std::env::temp_dir();
+        assert_eq!(resolve_cwd(&tmp).unwrap(), tmp.canonicalize().unwrap());
+        assert!(resolve_cwd(Path::new("/definitely/not/here")).is_err());
+
+        let file = tmp.join(format!("niko-cwd-{}", std::process::id()));
+        std::fs::write(&file, "").unwrap();
+        assert!(resolve_cwd(&file).is_err());
+        std::fs::remove_file(&file).unwrap();
+    }
+
+    #[test]
+    fn tty_flag_is_dropped_only_on_container_exec() {
+        assert_eq!(
+            drop_tty_flag("docker exec -it web sh").as_deref(),
+            Some("docker exec -i web sh")
+        );
+        assert_eq!(
+            drop_tty_flag("kubectl -n prod exec -ti pod -- bash").as_deref(),
+            Some("kubectl -n prod exec -i pod -- bash")
+        );
+        assert_eq!(
+            drop_tty_flag("docker run --rm -it alpine").as_deref(),
+            Some("docker run --rm -i alpine")
+        );
+        assert_eq!(drop_tty_flag("docker ps"), None);
+        assert_eq!(drop_tty_flag("grep -it foo file"), None);
+    }
+
+    #[test]
+    fn finds_interactive_tools_anywhere_in_a_chain() {
+        let tools = config::UiConfig::default().interactive_tools;
+        assert_eq!(
+            interactive_tool("git diff | less", &tools).as_deref(),
+            Some("less")
+        );
+        assert_eq!(
+            interactive_tool("cd src && sudo vim main.rs", &tools).as_deref(),
+            Some("vim")
+        );
+        assert_eq!(interactive_tool("grep -rn vim .", &tools), None);
+
+        let tools = vec!["ssh".to_string()];
+        assert_eq!(interactive_tool("ssh prod", &tools).as_deref(), Some("ssh"));
+        assert_eq!(interactive_tool("git diff | less", &tools), None);
+    }
+
+    /// Provider set to `structured_output`, giving `json` for structured
+    /// requests and `ls -la` as text
+    struct StructuredProvider {
+        json: Result<&'static str, &'static str>,
+    }
+
+    impl Provider for StructuredProvider {
+        fn name(&self) -> &str {
+            "structured"
+        }
+
+        fn model(&self) -> &str {
+            "structured-test"
+        }
+
+        fn generate_with_meta(&self, _: &[Message], _: u32) -> Result<Generation> {
+            Ok(Generation {
+                text: "ls -la".into(),
+                ..Default::default()
+            })
+        }
+
+        fn supports_structured_output(&self) -> bool {
+            true
+        }
+
+        fn generate_json(
+            &self,
+            _: &[Message],
+            _: u32,
+            _: &serde_json::Value,
+        ) -> Result<Generation> {
+            match self.json {
+                Ok(text) => Ok(Generation {
+                    text: text.into(),
+                    ..Default::default()
+                }),
+                Err(e) => bail!("{}", e),
+            }
+        }
+
+        fn is_available(&self) -> bool {
+            true
+        }
+
+        fn list_models(&self) -> Result<Vec<ModelInfo>> {
+            Ok(Vec::new())
+        }
+    }
+
+    #[test]
+    fn structured_answers_skip_extraction_and_fall_back_to_text() {
+        let messages = build_messages(&prompt::gather_context(), "disk usage", false);
+        let generate = |json| generate_command(&StructuredProvider { json }, &messages).unwrap();
+
+        let generation = generate(Ok(
+            r#"{"command": "du -sh * | sort -h", "risk_note": " none "}"#,
+        ));
+        assert_eq!(generation.text, "du -sh * | sort -h");
+        assert_eq!(generation.note.as_deref(), Some("none"));
+
+        let generation = generate(Ok(
+            r#"{"command": "ls\u001b[2J -la", "risk_note": "\u001b]0;hi\u0007safe"}"#,
+        ));
+        assert_eq!(generation.text, "ls -la");
+        assert_eq!(generation.note.as_deref(), Some("safe"));
+
+        let generation = generate(Ok(r#"{"command": "", "risk_note": ""}"#));
+        assert_eq!(generation.text, "ls -la");
+        let generation = generate(Err("400: response_format is not supported"));
+        assert_eq!(generation.text, "ls -la");
+        assert_eq!(generation.note, None);
+    }
+
+    #[test]
+    fn expansion_keeps_the_first_paragraph_unquoted() {
+        assert_eq!(
+            clean_expansion("\"Find the 10 largest files\nunder this directory.\"\n\nThis helps.")
+                .as_deref(),
+            Some("Find the 10 largest files under this directory.")
+        );
+        assert_eq!(
+            clean_expansion("Instruction: list hidden files").as_deref(),
+            Some("list hidden files")
+        );
+        assert_eq!(clean_expansion("  \n "), None);
+    }
+
+    #[test]
+    fn placeholder_values_are_assessed_before_running() {
+        let template = "cat <file>";
+        let shown = safety::assess(template);
+        let values = vec![("file".to_string(), "x; rm -rf /".to_string())];
+        let filled = placeholders::fill(template, &values);
+
+        let rechecked = recheck(&filled, &shown);
+        assert!(rechecked.level > shown.level);
+        assert_eq!(rechecked.level, safety::RiskLevel::Critical);
+        assert_eq!(recheck(template, &shown).level, shown.level);
+    }
+
+    #[test]
+    fn unfilled_placeholders_are_never_run() {
+        let err = check_filled("sort <file> > <output>").unwrap_err();
+        assert!(err.to_string().contains("<file>, <output>"));
+        assert!(check_filled("sort names.txt > sorted.txt").is_ok());
+        assert!(check_filled("sort < names.txt").is_ok());
+    }
+
+    #[test]
+    fn uncommitted_note_counts_what_the_git_command_loses() {
+        let status = " M src/main.rs\nA  new.rs\n?? scratch.txt\n";
+        assert_eq!(
+            uncommitted_note(safety::GitLoss::Changes, status).as_deref(),
+            Some("you have uncommitted changes that will be lost (2 files)")
+        );
+        assert_eq!(
+            uncommitted_note(safety::GitLoss::Untracked, status).as_deref(),
+            Some("you have untracked files that will be deleted (1 file)")
+        );
+        assert_eq!(uncommitted_note(safety::GitLoss::Changes, "?? a\n"), None);
+        assert_eq!(uncommitted_note(safety::GitLoss::Changes, ""), None);
+    }
+
+    #[test]
+    fn ssh_wraps_the_command_as_one_quoted_argument() {
+        assert_eq!(over_ssh(None, "ls -la"), "ls -la");
+        assert_eq!(
+            over_ssh(Some("deploy@web1"), "grep 'a b' log | wc -l"),
+            r"ssh -- deploy@web1 'grep '\''a b'\'' log | wc -l'"
+        );
+
+        assert!(check_destination("deploy@web1.example.com").is_ok());
+        assert!(check_destination("web1").is_ok());
+        assert!(check_destination("-oProxyCommand=sh").is_err());
+        assert!(check_destination("web1; rm -rf /").is_err());
+        assert!(check_destination("").is_err());
+    }
+
+    #[test]
+    fn what_if_prompt_carries_command_and_matched_rules() {
+        let assessment = safety::assess_with("git reset --hard HEAD~3", &[]);
+        let messages = what_if_messages(
+            &prompt::gather_context(),
+            "git reset --hard HEAD~3",
+            &assessment,
+        );
+
+        assert_eq!(messages[0].role, Role::System);
+        assert!(messages[0].content.contains("Do not run"));
+        assert!(messages[1].content.contains("git reset --hard HEAD~3"));
+        assert!(messages[1]
+            .content
+            .contains("dangerous: discards uncommitted git changes"));
+    }
+
+    #[test]
+    fn describes_model_tokens_and_latency() {
+        let generation = Generation {
+            text: "ls".into(),
+            model: "gpt-4o-mini".into(),
+            prompt_tokens: Some(412),
+            completion_tokens: Some(9),
+            latency: std::time::Duration::from_millis(1300),
+            note: None,
+            forced: false,
+        };
+        assert_eq!(
+            describe_generation(&generation),
+            "gpt-4o-mini · 412→9 tokens · 1.3s"
+        );
+    }
+
+    #[test]
+    fn candidates_respect_concurrency_limit() {
+        struct Counting {
+            in_flight: AtomicUsize,
+            peak: AtomicUsize,
+        }
+
+        impl Provider for Counting {
+            fn name(&self) -> &str {
+                "openai"
+            }
+
+            fn model(&self) -> &str {
+                "test-model"
+            }
+
+            fn generate_with_meta(
+                &self,
+                _messages: &[Message],
+                _max_tokens: u32,
+            ) -> Result<Generation> {
+                let now = self.in_flight.fetch_add(1, Ordering::SeqCst) + 1;
+                self.peak.fetch_max(now, Ordering::SeqCst);
+                thread::sleep(std::time::Duration::from_millis(20));
+                self.in_flight.fetch_sub(1, Ordering::SeqCst);
+                Ok(Generation {
+                    text: "ls".into(),
+                    ..Default::default()
+                })
+            }
+
+            fn is_available(&self) -> bool {
+                true
+            }
+
+            fn list_models(&self) -> Result<Vec<ModelInfo>> {
+                Ok(Vec::new())
+            }
+        }
+
+        let provider = Counting {
+            in_flight: AtomicUsize::new(0),
+            peak: AtomicUsize::new(0),
+        };
+        let messages = [Message {
+            role: Role::User,
+            content: "list files".into(),
+        }];
+
+        let results = generate_candidates(&provider, &messages, 5, 2);
+        assert_eq!(results.len(), 5);
+        assert!(results.iter().all(|r| r.as_ref().unwrap().text == "ls"));
+        assert!(provider.peak.load(Ordering::SeqCst) <= 2);
+    }
+
+    #[test]
+    fn reminder_is_appended_to_last_user_turn() {
+        let messages = [
+            Message {
+                role: Role::System,
+                content: "system".into(),
+            },
+            Message {
+                role: Role::User,
+                content: "list files".into(),
+            },
+        ];
+        let retry = with_reminder(&messages, TERSE_REMINDER);
+        assert_eq!(retry[0].content, "system");
+        assert!(retry[1].content.ends_with(TERSE_REMINDER));
+    }
+
+    #[test]
+    fn prompt_is_printed_under_role_rules() {
+        let messages = [
+            Message {
+                role: Role::System,
+                content: "You are Niko.\n".into(),
+            },
+            Message {
+                role: Role::User,
+                content: "list files".into(),
+            },
+        ];
+        assert_eq!(
+            format_prompt(&messages),
+            "── system ──\nYou are Niko.\n\n── user ──\nlist files\n"
+        );
+    }
+
+    #[test]
+    fn oversized_prompt_drops_the_tools_list() {
+        let ctx = prompt::SystemContext {
+            os: "linux".into(),
+            arch: "x86_64".into(),
+            shell: "bash".into(),
+            working_dir: "/tmp".into(),
+            available_tools: (0..2000).map(|i| format!("tool{:04}", i)).collect(),
+            hints: Vec::new(),
+            examples: Vec::new(),
+            template: None,
+        };
+
+        let full = fit_context(&ctx, "zzqq", false, None);
+        assert!(full[0].content.contains("tool1999"));
+        let roomy = fit_context(&ctx, "zzqq", false, Some(16384));
+        assert_eq!(roomy[0].content, full[0].content);
+
+        let trimmed = fit_context(&ctx, "zzqq", false, Some(2048));
+        assert!(!trimmed[0].content.contains("tool0000"));
+        assert!(estimate_tokens(&trimmed) <= 2048 - CMD_MAX_TOKENS as usize);
+        assert_eq!(trimmed[1].content, "zzqq");
+    }
+
+    #[test]
+    fn fix_prompt_carries_the_failure_and_a_bounded_stderr() {
+        let stderr = format!("{}\ntar: archive.tgz: Cannot open", "x".repeat(5000));
+        let messages = fix_messages(
+            &prompt::gather_context(),
+            "extract the archive",
+            "tar xzf archive.tar.gz",
+            2,
+            &stderr,
+        );
+
+        let user = &messages[1].content;
+        assert!(user.starts_with("extract the archive"));
+        assert!(user.contains("exit code 2:\ntar xzf archive.tar.gz"));
+        assert!(user.contains("Cannot open"));
+        assert!(user.len() < 2500);
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn a_vetoing_hook_stops_fixes_and_drops_candidates() {
+        let generated = |text: &str| Generation {
+            text: text.into(),
+            ..Default::default()
+        };
+
+        let err = corrected_command("ls -la", "false", "list files", "mock").unwrap_err();
+        assert!(err.to_string().contains("hooks.post_generate rejected"));
+        let err = candidate_commands(
+            vec![Ok(generated("ls")), Ok(generated("ls -a"))],
+            "false",
+            "list files",
+            "mock",
+        )
+        .unwrap_err();
+        assert!(err.to_string().contains("hooks.post_generate rejected"));
+
+        // A veto only drops the candidate it's about
+        let hook = std::env::temp_dir().join(format!("niko-no-rm-{}", std::process::id()));
+        std::fs::write(&hook, "#!/bin/sh\n! grep -q rm\n").unwrap();
+        {
+            use std::os::unix::fs::PermissionsExt;
+            std::fs::set_permissions(&hook, std::fs::Permissions::from_mode(0o755)).unwrap();
+        }
+        let survivors = candidate_commands(
+            vec![Ok(generated("rm -r build")), Ok(generated("trash build"))],
+            hook.to_str().unwrap(),
+            "remove build",
+            "mock",
+        )
+        .unwrap();
+        assert_eq!(survivors, vec!["trash build"]);
+        std::fs::remove_file(&hook).unwrap();
+
+        // Without a hook both go through as before
+        assert_eq!(
+            corrected_command("ls -la", "", "list files", "mock")
+                .unwrap()
+                .0,
+            "ls -la"
+        );
+        assert_eq!(
+            candidate_commands(
+                vec![Ok(generated("ls")), Ok(generated("ls"))],
+                "",
+                "list files",
+                "mock"
+            )
+            .unwrap(),
+            vec!["ls"]
+        );
+    }
+
+    #[test]
+    fn aliases_match_whole_query_ignoring_case() {
+        let aliases = HashMap::from([(
+            "Deploy Status".to_string(),
+            "kubectl rollout status deploy/web".to_string(),
+        )]);
+        assert_eq!(
+            alias_for(&aliases, "  deploy status "),
+            Some("kubectl rollout status deploy/web")
+        );
+        assert_eq!(alias_for(&aliases, "deploy status now"), None);
+        assert_eq!(alias_for(&HashMap::new(), "deploy status"), None);
+    }
+
+    #[test]
+    fn variants_are_labelled_only_when_they_differ() {
+        let same = vec![
+            ("macOS", "ls -la".to_string()),
+            ("Linux", "ls -la".to_string()),
+        ];
+        assert_eq!(label_variants(&same), "ls -la\n");
+
+        let differ = vec![
+            ("macOS", "stat -f %z f".to_string()),
+            ("Linux", "stat -c %s f".to_string()),
+        ];
+        assert_eq!(
+            label_variants(&differ),
+            "# macOS\nstat -f %z f\n# Linux\nstat -c %s f\n"
+        );
+        assert_eq!(label_variants(&differ[1..]), "# Linux\nstat -c %s f\n");
+    }
+
+    #[test]
+    fn missing_tools_skips_builtins_and_installed_programs() {
+        assert!(missing_tools("cd src && ls | sort && ./niko-no-such-script", "bash").is_empty());
+        assert!(missing_tools("pushd src && declare -a x; time make; popd", "bash").is_empty());
+        assert_eq!(
+            missing_tools("niko-no-such-tool --x | ls; niko-no-such-tool", "zsh"),
+            vec!["'niko-no-such-tool' is not installed (or not on PATH)"]
+        );
+        assert!(missing_tools("Get-ChildItem | Sort-Object Length", "powershell").is_empty());
+    }
+}
@@ -0,0 +1,89 @@
+use anyhow::{bail, Result};
+
+use crate::cancel;
+use crate::llm::{self, Message, Role};
+use crate::progress::Progress;
+use crate::prompt;
+
+/// One phrase; a little headroom for models that think out loud first
+const DESCRIBE_MAX_TOKENS: u32 = 60;
+
+/// Run `niko describe <COMMAND>`: print a one-line summary of what the
+/// command does, terse enough for a changelog entry or commit message.
+/// Only the phrase goes to stdout, so it can be captured directly.
+pub fn run(command: &str, provider_name: Option<&str>) -> Result<()> {
+    let command = command.trim();
+    if command.is_empty() {
+        bail!("Nothing to describe (pass the command, quoted)");
+    }
+
+    let provider = llm::get_provider(provider_name)?;
+    let messages = describe_messages(&prompt::gather_context(), command);
+
+    let answer = cancel::run_cancellable(move || {
+        let mut progress = Progress::start(false);
+        let answer = llm::generate_with_retry(provider.as_ref(), &messages, DESCRIBE_MAX_TOKENS);
+        progress.finish();
+        answer
+    })?;
+
+    match one_line(&answer) {
+        Some(summary) => {
+            println!("{}", summary);
+            Ok(())
+        }
+        None => bail!("The model gave no summary:\n{}", answer),
+    }
+}
+
+fn describe_messages(ctx: &prompt::SystemContext, command: &str) -> Vec<Message> {
+    vec![
+        Message {
+            role: Role::System,
+            content: prompt::describe_system_prompt(ctx),
+        },
+        Message {
+            role: Role::User,
+            content: command.to_string(),
+        },
+    ]
+}
+
+/// The first real line of the answer, without the fences, quotes, label
+/// or trailing period models add despite being asked not to
+fn one_line(answer: &str) -> Option<String> {
+    let line = answer
+        .lines()
+        .map(str::trim)
+        .find(|line| !line.is_empty() && !line.starts_with("```"))?;
+    let line = line
+        .strip_prefix("Summary:")
+        .unwrap_or(line)
+        .trim()
+        .trim_matches(|c| matches!(c, '"' | '\'' | '`'))
+        .trim_end_matches('.')
+        .trim();
+    (!line.is_empty()).then(|| line.to_string())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn one_line_strips_decoration() {
+        assert_eq!(
+            one_line("Delete compiled Python files").as_deref(),
+            Some("Delete compiled Python files")
+        );
+        assert_eq!(
+            one_line("\n\"Archive the logs directory.\"\nIt uses tar.").as_deref(),
+            Some("Archive the logs directory")
+        );
+        assert_eq!(
+            one_line("```\nSummary: `Count lines in Rust files`\n```").as_deref(),
+            Some("Count lines in Rust files")
+        );
+        assert_eq!(one_line("```\n\n```"), None);
+    }
+}
@@ -0,0 +1,217 @@
+use std::io::{self, IsTerminal, Write};
+
+use anyhow::{bail, Result};
+use colored::Colorize;
+
+use crate::cancel;
+use crate::llm::{self, Message, Provider, Role};
+use crate::progress::Progress;
+use crate::prompt;
+use crate::safety::{self, Assessment, RiskLevel};
+
+/// Enough for a few short paragraphs or bullets about one command
+const EXPLAIN_MAX_TOKENS: u32 = 800;
+
+/// Run `niko explain <COMMAND>`: ask the model what an existing command
+/// does and print that, followed by niko's own risk assessment. The
+/// command is never run. On a terminal, providers that stream print the
+/// explanation as it arrives.
+pub fn run(command: &str, provider_name: Option<&str>) -> Result<()> {
+    let command = command.trim();
+    if command.is_empty() {
+        bail!("Nothing to explain (pass the command, quoted)");
+    }
+
+    let assessment = safety::assess(command);
+    let provider = llm::get_provider(provider_name)?;
+    let messages = explain_messages(&prompt::gather_context(), command);
+
+    let stream = provider.supports_streaming() && io::stdout().is_terminal();
+    let (explanation, printed) = cancel::run_cancellable(move || {
+        let mut progress = Progress::start(false);
+        let explanation = if stream {
+            stream_to_stdout(provider.as_ref(), &messages, &mut progress)
+        } else {
+            llm::generate_with_retry(provider.as_ref(), &messages, EXPLAIN_MAX_TOKENS)
+                .map(|text| (text, false))
+        };
+        progress.finish();
+        explanation
+    })?;
+
+    if printed {
+        println!("\n");
+    } else {
+        println!("{}\n", explanation.trim());
+    }
+    println!("{}", risk_line(&assessment));
+    Ok(())
+}
+
+/// Print the explanation to stdout token by token, once the spinner is
+/// cleared. Also says whether anything was printed: a stream that fails
+/// before its first token is retried without streaming, and that answer
+/// is left to the caller to print. One that fails midway is an error.
+fn stream_to_stdout(
+    provider: &dyn Provider,
+    messages: &[Message],
+    progress: &mut Progress,
+) -> Result<(String, bool)> {
+    let mut printed = false;
+    let text = llm::generate_streaming(provider, messages, EXPLAIN_MAX_TOKENS, &mut |token| {
+        let token = if printed { token } else { token.trim_start() };
+        if token.is_empty() {
+            return;
+        }
+        if !printed {
+            progress.finish();
+            printed = true;
+        }
+        // The terminal may be in raw mode, where a bare newline doesn't
+        // return to the start of the line
+        let mut stdout = io::stdout().lock();
+        let _ = write!(stdout, "{}", token.replace('\n', "\r\n"));
+        let _ = stdout.flush();
+    })?;
+    Ok((text, printed))
+}
+
+fn explain_messages(ctx: &prompt::SystemContext, command: &str) -> Vec<Message> {
+    vec![
+        Message {
+            role: Role::System,
+            content: prompt::chat_system_prompt(ctx),
+        },
+        Message {
+            role: Role::User,
+            content: format!(
+                "Explain concisely what this shell command does, part by part \
+                 (program, flags, pipes, redirects). Say if anything in it is unusual \
+                 or risky. Do not run it.\n\n```\n{}\n```",
+                command
+            ),
+        },
+    ]
+}
+
+/// `Risk: dangerous (recursive delete)`, coloured by level
+fn risk_line(assessment: &Assessment) -> String {
+    let level = assessment.level.as_str();
+    let level = match assessment.level {
+        RiskLevel::Safe => level.green(),
+        RiskLevel::Moderate => level.normal(),
+        RiskLevel::Dangerous => level.yellow().bold(),
+        RiskLevel::Critical => level.red().bold(),
+    };
+    let mut line = format!("{} {}", "Risk:".bold(), level);
+    if !assessment.reasons.is_empty() {
+        line.push_str(&format!(" ({})", assessment.reasons.join(", ")));
+    }
+    if assessment.blocked {
+        line.push_str(&format!(
+            " {}",
+            "[blocked by safety.blocked_commands]".red()
+        ));
+    }
+    line
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::llm::{Generation, ModelInfo};
+
+    /// Streams its answer a token at a time. With `drops`, the connection
+    /// is lost after the first token, and asking again without streaming
+    /// would answer in full.
+    struct Streaming {
+        drops: bool,
+    }
+
+    impl Provider for Streaming {
+        fn name(&self) -> &str {
+            "streaming"
+        }
+
+        fn model(&self) -> &str {
+            "streaming-test"
+        }
+
+        fn generate_with_meta(&self, _: &[Message], _: u32) -> Result<Generation> {
+            if !self.drops {
+                bail!("only streams");
+            }
+            Ok(Generation {
+                text: "Lists files.".into(),
+                ..Default::default()
+            })
+        }
+
+        fn generate_stream(
+            &self,
+            _: &[Message],
+            _: u32,
+            on_token: &mut dyn FnMut(&str),
+        ) -> Result<String> {
+            if self.drops {
+                on_token("Lists");
+                bail!("connection reset by peer");
+            }
+            for token in ["\n ", "Lists", " files."] {
+                on_token(token);
+            }
+            Ok("\n Lists files.".into())
+        }
+
+        fn supports_streaming(&self) -> bool {
+            true
+        }
+
+        fn is_available(&self) -> bool {
+            true
+        }
+
+        fn list_models(&self) -> Result<Vec<ModelInfo>> {
+            Ok(Vec::new())
+        }
+    }
+
+    #[test]
+    fn streamed_explanations_are_printed_as_they_arrive() {
+        let messages = explain_messages(&prompt::gather_context(), "ls");
+        let streaming = Streaming { drops: false };
+        let (text, printed) = stream_to_stdout(&streaming, &messages, &mut Progress::Off).unwrap();
+        assert_eq!(text, "Lists files.");
+        assert!(printed);
+    }
+
+    #[test]
+    fn a_stream_cut_off_midway_is_not_retried() {
+        let messages = explain_messages(&prompt::gather_context(), "ls");
+        let streaming = Streaming { drops: true };
+        let err = stream_to_stdout(&streaming, &messages, &mut Progress::Off).unwrap_err();
+        assert!(err.to_string().contains("connection reset"));
+    }
+
+    #[test]
+    fn messages_quote_the_command_under_the_chat_prompt() {
+        let ctx = prompt::gather_context();
+        let messages = explain_messages(&ctx, "tar -xzf a.tgz -C /tmp");
+        assert_eq!(messages.len(), 2);
+        assert_eq!(messages[0].content, prompt::chat_system_prompt(&ctx));
+        assert!(messages[1]
+            .content
+            .contains("```\ntar -xzf a.tgz -C /tmp\n```"));
+    }
+
+    #[test]
+    fn risk_line_names_level_and_reasons() {
+        let line = risk_line(&safety::assess("rm -rf ./build"));
+        assert!(line.contains("Risk:"));
+        assert!(line.contains(safety::assess("rm -rf ./build").level.as_str()));
+
+        let safe = risk_line(&safety::assess("ls -la"));
+        assert!(safe.contains("safe"));
+        assert!(!safe.contains('('));
+    }
+}
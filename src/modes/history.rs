@@ -0,0 +1,94 @@
+use anyhow::Result;
+use colored::Colorize;
+
+use crate::date::{civil_from_days, SECS_PER_DAY};
+use crate::history::{self, Entry};
+
+/// What `niko history` was asked to do
+pub enum Action {
+    /// Attach a note to an entry, or clear it with an empty note
+    Annotate { id: usize, note: String },
+}
+
+/// Run `niko history`: list the last `limit` entries, numbered the way
+/// `annotate` expects, or change a note
+pub fn run(action: Option<Action>, limit: usize) -> Result<()> {
+    if let Some(Action::Annotate { id, note }) = action {
+        let entry = history::annotate(id, &note)?;
+        match &entry.note {
+            Some(note) => println!("{} #{} {}: {}", "✓".green(), id, entry.command, note),
+            None => println!("{} #{} {}: note removed", "✓".green(), id, entry.command),
+        }
+        return Ok(());
+    }
+
+    let entries = history::load()?;
+    if entries.is_empty() {
+        eprintln!("{}", "No history yet.".dimmed());
+        return Ok(());
+    }
+
+    let start = entries.len().saturating_sub(limit);
+    for (i, entry) in entries.iter().enumerate().skip(start) {
+        println!("{}", format_entry(i + 1, entry));
+    }
+    Ok(())
+}
+
+/// `  12  2026-10-14 09:31  du -sh *  # note` with the query underneath
+fn format_entry(id: usize, entry: &Entry) -> String {
+    let mut line = format!(
+        "{:>4}  {}  {}",
+        id,
+        format_time(entry.timestamp).dimmed(),
+        entry.command.bold()
+    );
+    if let Some(note) = &entry.note {
+        line.push_str(&format!("  {}", format!("# {}", note).cyan()));
+    }
+    line.push_str(&format!("\n{:>4}  {}", "", entry.query.dimmed()));
+    line
+}
+
+/// `YYYY-MM-DD HH:MM` in UTC
+fn format_time(timestamp: u64) -> String {
+    let (y, m, d) = civil_from_days((timestamp / SECS_PER_DAY) as i64);
+    let secs = timestamp % SECS_PER_DAY;
+    format!(
+        "{:04}-{:02}-{:02} {:02}:{:02}",
+        y,
+        m,
+        d,
+        secs / 3600,
+        secs % 3600 / 60
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn formats_utc_timestamps() {
+        assert_eq!(format_time(0), "1970-01-01 00:00");
+        assert_eq!(
+            format_time(11_017 * SECS_PER_DAY + 3_660),
+            "2000-03-01 01:01"
+        );
+        assert_eq!(format_time(1_709_164_800), "2024-02-29 00:00");
+    }
+
+    #[test]
+    fn entries_show_their_note() {
+        let entry = Entry {
+            query: "free up disk".into(),
+            command: "docker system prune".into(),
+            note: Some("cleaning up CI".into()),
+            ..Default::default()
+        };
+        let text = format_entry(3, &entry);
+        assert!(text.starts_with("   3  "));
+        assert!(text.contains("# cleaning up CI"));
+        assert!(text.lines().nth(1).unwrap().contains("free up disk"));
+    }
+}
@@ -0,0 +1,178 @@
+use anyhow::{bail, Result};
+use colored::Colorize;
+
+use crate::cancel;
+use crate::config;
+use crate::llm::{self, ollama};
+use crate::modes::cmd;
+use crate::progress::{self, Progress};
+
+/// Requests any usable model should get right, each with the programs a
+/// plausible answer would run
+const TEST_QUERIES: &[(&str, &[&str])] = &[
+    ("list all files including hidden ones", &["ls"]),
+    ("show disk usage of the current directory", &["du", "df"]),
+    ("find files larger than 100MB", &["find"]),
+    (
+        "search for TODO in all files recursively",
+        &["grep", "rg", "ag"],
+    ),
+    ("show the last 10 git commits", &["git"]),
+    (
+        "count the lines in every .py file",
+        &["wc", "find", "xargs", "cat"],
+    ),
+    ("compress the logs directory into logs.tar.gz", &["tar"]),
+    (
+        "show which process is listening on port 8080",
+        &["lsof", "ss", "netstat", "fuser"],
+    ),
+];
+
+/// Below this share of passes, suggest another model
+const GOOD_PASS_RATE: f64 = 0.75;
+
+/// One test query's outcome: the command, or why there wasn't one
+struct Outcome {
+    query: &'static str,
+    result: Result<String>,
+    passed: bool,
+}
+
+/// Run `niko local test`: put the configured local model through a few
+/// well-known queries and report how many came back as plausible commands,
+/// suggesting a bigger model or a cloud provider when too few do
+pub fn test() -> Result<()> {
+    let name = local_provider_name()?;
+    let provider = llm::get_provider(Some(&name))?;
+    let model = config::get().providers[&name].model.clone();
+    eprintln!(
+        "Testing {} ({}) with {} queries...\n",
+        model.cyan(),
+        name,
+        TEST_QUERIES.len()
+    );
+
+    let mut ctx = cmd::command_context(&[]);
+    ctx.template = config::system_template(config::get(), &name);
+    let outcomes = cancel::run_cancellable(move || {
+        let mut spinner = Progress::start(false);
+        let outcomes: Vec<Outcome> = TEST_QUERIES
+            .iter()
+            .enumerate()
+            .map(|(i, (query, tools))| {
+                progress::set_message(&format!("[{}/{}] {}", i + 1, TEST_QUERIES.len(), query));
+                let messages = cmd::build_messages(&ctx, query, false);
+                let result = cmd::generate_command(provider.as_ref(), &messages).map(|g| g.text);
+                let passed = result.as_deref().is_ok_and(|c| plausible(c, tools));
+                Outcome {
+                    query,
+                    result,
+                    passed,
+                }
+            })
+            .collect();
+        spinner.finish();
+        outcomes
+    });
+
+    for outcome in &outcomes {
+        let mark = if outcome.passed {
+            "✓".green()
+        } else {
+            "✗".red()
+        };
+        let detail = match &outcome.result {
+            Ok(command) => command.lines().next().unwrap_or_default().to_string(),
+            Err(e) => format!("{}", e)
+                .lines()
+                .next()
+                .unwrap_or_default()
+                .to_string(),
+        };
+        eprintln!("  {} {}", mark, outcome.query);
+        eprintln!("    {}", detail.dimmed());
+    }
+
+    let passed = outcomes.iter().filter(|o| o.passed).count();
+    let rate = passed as f64 / outcomes.len() as f64;
+    eprintln!(
+        "\n{} of {} plausible ({:.0}%)",
+        passed,
+        outcomes.len(),
+        rate * 100.0
+    );
+    if rate >= GOOD_PASS_RATE {
+        eprintln!("{}", "This model looks usable for niko.".green());
+    } else {
+        eprintln!("{}", suggestion(&model).yellow());
+    }
+    Ok(())
+}
+
+/// The active provider if it's an Ollama one, else the first that is
+fn local_provider_name() -> Result<String> {
+    let cfg = config::get();
+    let is_local = |name: &str| cfg.providers.get(name).is_some_and(|p| p.kind == "ollama");
+    if is_local(&cfg.active_provider) {
+        return Ok(cfg.active_provider.clone());
+    }
+    let mut names: Vec<&String> = cfg.providers.keys().filter(|n| is_local(n)).collect();
+    names.sort();
+    match names.first() {
+        Some(name) => Ok(name.to_string()),
+        None => bail!(
+            "No local provider configured.\n\
+             Run 'niko settings init --local' to set up Ollama with a model."
+        ),
+    }
+}
+
+/// Whether `command` runs one of the programs expected for its query, in
+/// any step of a pipeline or chain
+fn plausible(command: &str, tools: &[&str]) -> bool {
+    command
+        .split(['|', ';', '&', '\n'])
+        .filter_map(cmd::first_tool)
+        .any(|tool| tools.contains(&tool.as_str()))
+}
+
+/// What to try when `model` scores poorly
+fn suggestion(model: &str) -> String {
+    let recommended = ollama::recommended_model();
+    let bigger = if recommended != model {
+        format!(
+            "try '{}', the largest recommended model that fits this machine \
+             (niko settings init --local), or ",
+            recommended
+        )
+    } else {
+        String::new()
+    };
+    format!(
+        "Too few answers were usable commands: {}switch to a cloud provider \
+         (niko settings configure).",
+        bigger
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn plausible_commands_use_an_expected_tool_anywhere() {
+        assert!(plausible("ls -la", &["ls"]));
+        assert!(plausible("sudo lsof -i :8080", &["lsof", "ss"]));
+        assert!(plausible("cat app.log | grep -i error", &["grep", "rg"]));
+        assert!(!plausible("echo 'use ls -la'", &["ls"]));
+        assert!(!plausible("Here is the command", &["ls"]));
+    }
+
+    #[test]
+    fn suggestion_names_a_bigger_model_unless_already_on_it() {
+        assert!(suggestion("tiny:0.1b").contains(ollama::recommended_model()));
+        assert!(!suggestion(ollama::recommended_model()).contains("try '"));
+        assert!(suggestion(ollama::recommended_model()).contains("cloud provider"));
+    }
+}
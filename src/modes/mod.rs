@@ -1,3 +1,12 @@
+pub mod batch;
+pub mod bookmarks;
 pub mod cmd;
+pub mod describe;
 pub mod explain;
+pub mod history;
+pub mod local;
+pub mod providers;
+pub mod reset;
 pub mod settings;
+pub mod stats;
+pub mod version;
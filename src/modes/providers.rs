@@ -0,0 +1,79 @@
+use anyhow::Result;
+use colored::{ColoredString, Colorize};
+
+use crate::config;
+use crate::llm;
+
+/// Run `niko providers`: what can actually be used right now
+pub fn run() -> Result<()> {
+    let cfg = config::load()?;
+
+    let mut names: Vec<&String> = cfg.providers.keys().collect();
+    names.sort();
+
+    for name in names {
+        let pcfg = &cfg.providers[name];
+        let default = if *name == cfg.active_provider {
+            " (default)".green()
+        } else {
+            "".normal()
+        };
+        let model = if pcfg.model.is_empty() {
+            "(no model)".yellow()
+        } else {
+            pcfg.model.cyan()
+        };
+
+        println!(
+            "  {:<12} {:<28} {}{}",
+            name.bold(),
+            status(name, pcfg),
+            model,
+            default
+        );
+    }
+
+    // Well-known providers that could be set up
+    for (name, _, _, env_var) in config::known_provider_templates() {
+        if cfg.providers.contains_key(name) {
+            continue;
+        }
+        let hint = if env_var.is_empty() {
+            "not configured".to_string()
+        } else {
+            format!("not configured (or set {})", env_var)
+        };
+        println!("  {:<12} {}", name.dimmed(), hint.dimmed());
+    }
+
+    Ok(())
+}
+
+/// Status cell, kept as a `ColoredString` so `{:<28}` pads the visible
+/// text rather than the escape codes
+fn status(name: &str, pcfg: &config::ProviderConfig) -> ColoredString {
+    let provider = match llm::from_config(name, pcfg) {
+        Ok(p) => p,
+        Err(e) => return format!("✗ {}", first_line(&e.to_string())).red(),
+    };
+
+    match (provider.is_local(), provider.is_available()) {
+        (_, true) if pcfg.model.is_empty() => "● ready, pick a model".yellow(),
+        (true, true) => "● running".green(),
+        (false, true) => "● API key set".green(),
+        (true, false) => format!("○ not reachable at {}", base_url(pcfg)).yellow(),
+        (false, false) => "✗ no API key".red(),
+    }
+}
+
+fn base_url(pcfg: &config::ProviderConfig) -> &str {
+    if pcfg.base_url.is_empty() {
+        "http://127.0.0.1:11434"
+    } else {
+        &pcfg.base_url
+    }
+}
+
+fn first_line(s: &str) -> &str {
+    s.lines().next().unwrap_or(s)
+}
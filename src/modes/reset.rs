@@ -0,0 +1,133 @@
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use anyhow::{bail, Context, Result};
+use colored::Colorize;
+
+use crate::audit;
+use crate::config;
+use crate::exec;
+
+/// Run `niko reset`: delete everything under `~/.niko` (config, history,
+/// caches), optionally keeping the config file. The audit log stays: it
+/// records overridden safety stops, and a reset shouldn't erase them.
+/// Models belong to Ollama, which may be shared with other tools, so they
+/// are left alone too.
+pub fn run(yes: bool, keep_config: bool) -> Result<()> {
+    let dir = config::config_dir();
+    let mut keep = vec![audit::audit_path()];
+    keep.extend(keep_config.then(config::config_path));
+    let targets = targets(&dir, &keep)?;
+
+    if targets.is_empty() {
+        println!("Nothing to remove in {}", dir.display());
+        return Ok(());
+    }
+
+    let total: u64 = targets.iter().map(|p| disk_size(p)).sum();
+    for path in &targets {
+        eprintln!("  {} {}", "✗".red(), path.display());
+    }
+    if !yes && !exec::confirm(&format!("Remove these ({})?", human_size(total)))? {
+        bail!("Aborted");
+    }
+
+    for path in &targets {
+        let removed = if path.is_dir() {
+            fs::remove_dir_all(path)
+        } else {
+            fs::remove_file(path)
+        };
+        removed.with_context(|| format!("Failed to remove {}", path.display()))?;
+    }
+
+    println!(
+        "{} Removed {} item(s), reclaimed {}",
+        "✓".green(),
+        targets.len(),
+        human_size(total)
+    );
+    eprintln!(
+        "{}",
+        "  Ollama models are untouched; remove them with `ollama rm <model>`.".dimmed()
+    );
+    Ok(())
+}
+
+/// Entries of `dir` to delete, sorted, skipping those in `keep`
+fn targets(dir: &Path, keep: &[PathBuf]) -> Result<Vec<PathBuf>> {
+    if !dir.exists() {
+        return Ok(Vec::new());
+    }
+
+    let mut paths: Vec<PathBuf> = fs::read_dir(dir)
+        .with_context(|| format!("Failed to read {}", dir.display()))?
+        .filter_map(|entry| entry.ok().map(|e| e.path()))
+        .filter(|path| !keep.contains(path))
+        .collect();
+    paths.sort();
+    Ok(paths)
+}
+
+/// Bytes used by a file or directory tree (symlinks aren't followed)
+fn disk_size(path: &Path) -> u64 {
+    let Ok(meta) = fs::symlink_metadata(path) else {
+        return 0;
+    };
+    if !meta.is_dir() {
+        return meta.len();
+    }
+    fs::read_dir(path)
+        .map(|entries| entries.flatten().map(|e| disk_size(&e.path())).sum())
+        .unwrap_or(0)
+}
+
+fn human_size(bytes: u64) -> String {
+    const UNITS: &[&str] = &["B", "KB", "MB", "GB"];
+
+    let mut size = bytes as f64;
+    let mut unit = 0;
+    while size >= 1024.0 && unit < UNITS.len() - 1 {
+        size /= 1024.0;
+        unit += 1;
+    }
+    if unit == 0 {
+        format!("{} B", bytes)
+    } else {
+        format!("{:.1} {}", size, UNITS[unit])
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn targets_everything_but_the_kept_files() {
+        let dir = std::env::temp_dir().join(format!("niko-reset-{}", std::process::id()));
+        fs::create_dir_all(dir.join("cache")).unwrap();
+        fs::write(dir.join("cache/models.json"), "x".repeat(100)).unwrap();
+        fs::write(dir.join("config.yaml"), "active_provider: ollama\n").unwrap();
+        fs::write(dir.join("history.jsonl"), "{}\n").unwrap();
+        fs::write(dir.join("audit.jsonl"), "{}\n").unwrap();
+
+        let audit = dir.join("audit.jsonl");
+        let all = targets(&dir, std::slice::from_ref(&audit)).unwrap();
+        assert_eq!(all.len(), 3);
+        assert!(!all.contains(&audit));
+        assert_eq!(disk_size(&dir.join("cache")), 100);
+
+        let kept = targets(&dir, &[audit, dir.join("config.yaml")]).unwrap();
+        assert_eq!(kept, vec![dir.join("cache"), dir.join("history.jsonl")]);
+
+        fs::remove_dir_all(&dir).unwrap();
+        assert!(targets(&dir, &[]).unwrap().is_empty());
+    }
+
+    #[test]
+    fn sizes_are_human_readable() {
+        assert_eq!(human_size(512), "512 B");
+        assert_eq!(human_size(1536), "1.5 KB");
+        assert_eq!(human_size(3 * 1024 * 1024 * 1024), "3.0 GB");
+    }
+}
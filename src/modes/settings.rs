@@ -3,7 +3,9 @@ use std::io::{self, Write};
 use anyhow::Result;
 use colored::*;
 
+use crate::cancel;
 use crate::config::{self, ProviderConfig};
+use crate::exec;
 use crate::llm;
 use crate::llm::ollama;
 use crate::llm::Provider;
@@ -57,20 +59,24 @@ mod ui {
 }
 /// Settings action types
 pub enum Action {
-    Show,
+    Show { sources: bool },
     Configure,
     Set { key: String, value: String },
-    Init,
+    Init { local: bool },
+    Upgrade,
     Path,
 }
 
 /// Run the /settings mode
 pub fn run(action: Option<Action>) -> Result<()> {
     match action {
-        Some(Action::Show) | None => show_config(),
+        Some(Action::Show { sources: true }) => show_sources(),
+        Some(Action::Show { sources: false }) | None => show_config(),
         Some(Action::Configure) => run_configure_wizard(),
         Some(Action::Set { key, value }) => set_config(&key, &value),
-        Some(Action::Init) => init_config(),
+        Some(Action::Init { local: true }) => init_local(),
+        Some(Action::Init { local: false }) => init_config(),
+        Some(Action::Upgrade) => upgrade_config(),
         Some(Action::Path) => {
             println!("{}", config::config_path().display());
             Ok(())
@@ -80,6 +86,32 @@ pub fn run(action: Option<Action>) -> Result<()> {
 
 // ─── Show ───────────────────────────────────────────────────────────────────
 
+/// `show --sources`: every resolved setting and where its value came from,
+/// to debug which of the file, a default or an environment variable won.
+/// Secrets are masked as in `show`.
+fn show_sources() -> Result<()> {
+    let sources = config::sources()?;
+    let width = sources.iter().map(|s| s.key.len()).max().unwrap_or(0);
+
+    ui::print_dim(&format!("# {}", config::config_path().display()));
+    for setting in &sources {
+        let value = match &setting.value {
+            serde_json::Value::String(s) if setting.key.ends_with(".api_key") => format_key(s),
+            _ if setting.key.contains(".headers.") => "••••".to_string(),
+            serde_json::Value::String(s) if !s.is_empty() => s.clone(),
+            other => other.to_string(),
+        };
+        println!(
+            "{:<width$}  {}  {}",
+            setting.key,
+            value,
+            format!("({})", setting.source).dimmed(),
+            width = width
+        );
+    }
+    Ok(())
+}
+
 fn show_config() -> Result<()> {
     let cfg = config::load()?;
 
@@ -106,6 +138,9 @@ fn show_config() -> Result<()> {
 
     // Active provider
     ui::box_kv_bold("  Active", &cfg.active_provider.cyan().bold().to_string());
+    if !cfg.prompt.context_tools.is_empty() {
+        ui::box_kv("  Tools ", &cfg.prompt.context_tools.join(", "));
+    }
 
     ui::box_sep();
 
@@ -149,6 +184,11 @@ fn show_config() -> Result<()> {
         } else {
             ui::box_kv("    Key   ", &format_key(&pcfg.api_key));
             ui::box_kv("    URL   ", &pcfg.base_url.dimmed().to_string());
+            if !pcfg.headers.is_empty() {
+                // Names only: gateway headers often carry tokens
+                let names: Vec<&str> = pcfg.headers.keys().map(String::as_str).collect();
+                ui::box_kv("    Header", &names.join(", "));
+            }
         }
 
         if pcfg.model.is_empty() {
@@ -240,6 +280,12 @@ fn configure_ollama(name: &str, default_url: &str) -> Result<()> {
         ui::box_bottom();
         eprintln!();
 
+        if !config::auto_install_allowed(config::get(), |var| std::env::var(var).ok()) {
+            ui::print_dim(
+                "  Automatic install is disabled; install from: https://ollama.com/download",
+            );
+            return Ok(());
+        }
         let install = prompt_input("  Install Ollama now? [Y/n]: ")?;
         if install.trim().is_empty() || install.trim().to_lowercase().starts_with('y') {
             ollama::install_ollama()?;
@@ -593,11 +639,27 @@ fn configure_custom() -> Result<()> {
 fn set_config(key: &str, value: &str) -> Result<()> {
     let parts: Vec<&str> = key.splitn(2, '.').collect();
 
-    if parts.len() == 1 {
+    if parts[0] == "prompt" && parts.len() == 2 {
+        config::set_prompt_field(parts[1], value)?;
+        ui::print_success(&format!("{} → {}", key, value.cyan()));
+    } else if parts[0] == "safety" && parts.len() == 2 {
+        config::set_safety_field(parts[1], value)?;
+        ui::print_success(&format!("{} → {}", key, value.cyan()));
+    } else if parts[0] == "ui" && parts.len() == 2 {
+        config::set_ui_field(parts[1], value)?;
+        ui::print_success(&format!("{} → {}", key, value.cyan()));
+    } else if parts[0] == "generation" && parts.len() == 2 {
+        config::set_generation_field(parts[1], value)?;
+        ui::print_success(&format!("{} → {}", key, value.cyan()));
+    } else if parts[0] == "hooks" && parts.len() == 2 {
+        config::set_hooks_field(parts[1], value)?;
+        ui::print_success(&format!("{} → {}", key, value.cyan()));
+    } else if parts.len() == 1 {
         match key {
             "active_provider" | "provider" => {
                 config::set_active_provider(value)?;
                 ui::print_success(&format!("Active provider → {}", value.cyan()));
+                warn_if_unavailable(value);
             }
             _ => {
                 anyhow::bail!(
@@ -611,7 +673,7 @@ fn set_config(key: &str, value: &str) -> Result<()> {
         let field = parts[1];
         config::set_provider_field(provider, field, value)?;
 
-        if field.contains("key") {
+        if field.contains("key") || field.starts_with("headers.") {
             ui::print_success(&format!(
                 "{}.{} → {}",
                 provider,
@@ -621,11 +683,54 @@ fn set_config(key: &str, value: &str) -> Result<()> {
         } else {
             ui::print_success(&format!("{}.{} → {}", provider, field, value.cyan()));
         }
+        if field == "base_url" {
+            warn_if_foreign_endpoint(provider, value);
+        }
     }
 
     Ok(())
 }
 
+/// Warn when a well-known provider is pointed at another one's endpoint
+fn warn_if_foreign_endpoint(name: &str, base_url: &str) {
+    if let Some(owner) = config::endpoint_owner(name, base_url) {
+        ui::print_warning(&format!(
+            "{} is {}'s endpoint, but requests will use {}'s model and API key",
+            base_url, owner, name
+        ));
+        ui::print_dim(&format!(
+            "  Use the dedicated provider instead: niko settings set active_provider {}",
+            owner
+        ));
+    }
+}
+
+/// Warn (without failing) when a newly selected provider can't serve
+/// requests yet, so the problem shows up now rather than at query time
+fn warn_if_unavailable(name: &str) {
+    let provider = match llm::get_provider(Some(name)) {
+        Ok(p) => p,
+        Err(e) => {
+            ui::print_warning(&format!("'{}' isn't usable yet: {:#}", name, e));
+            return;
+        }
+    };
+    if provider.is_available() {
+        return;
+    }
+
+    if provider.is_local() {
+        ui::print_warning(&format!("'{}' is not running", name));
+        ui::print_dim("  Start it with: ollama serve");
+    } else {
+        ui::print_warning(&format!("'{}' has no API key configured", name));
+        ui::print_dim(&format!(
+            "  Set one with: niko settings set {}.api_key <key>  (or run 'niko settings configure')",
+            name
+        ));
+    }
+}
+
 // ─── Init ───────────────────────────────────────────────────────────────────
 
 fn init_config() -> Result<()> {
@@ -641,6 +746,121 @@ fn init_config() -> Result<()> {
     Ok(())
 }
 
+fn upgrade_config() -> Result<()> {
+    let added = config::upgrade()?;
+    let path = config::config_path();
+    if added.is_empty() {
+        ui::print_success(&format!("Config is up to date: {}", path.display()));
+        return Ok(());
+    }
+
+    ui::print_success(&format!(
+        "Added {} missing setting{} to {}",
+        added.len(),
+        if added.len() == 1 { "" } else { "s" },
+        path.display()
+    ));
+    for key in &added {
+        ui::print_dim(&format!("  + {}", key));
+    }
+    ui::print_dim(&format!(
+        "  Previous file kept as {}",
+        path.with_extension("yaml.bak").display()
+    ));
+    Ok(())
+}
+
+/// Install Ollama and download a model sized for this machine up front, so
+/// the first real query doesn't block on a multi-GB download. Other
+/// providers and settings are left alone.
+fn init_local() -> Result<()> {
+    if !ollama::is_ollama_installed() {
+        ollama::install_ollama()?;
+    }
+    if !ollama::is_ollama_running() {
+        anyhow::bail!(
+            "Ollama is installed but not running.\n\
+             Start it with: ollama serve\n\
+             Then re-run: niko settings init --local"
+        );
+    }
+
+    let cfg = config::load()?;
+    let base_url = cfg
+        .providers
+        .get("ollama")
+        .map(|p| p.base_url.clone())
+        .filter(|url| !url.is_empty())
+        .unwrap_or_else(|| "http://127.0.0.1:11434".into());
+
+    let model = choose_local_model(ollama::recommended_model())?;
+    let model = model.as_str();
+
+    let provider = ollama::OllamaProvider::new(&base_url, model, std::collections::HashMap::new())?;
+    let local_models = provider.list_models().unwrap_or_default();
+    if local_models.iter().any(|m| m.id == model) {
+        ui::print_dim("  Already downloaded");
+    } else {
+        let name = model.to_string();
+        cancel::run_cancellable(move || provider.pull_model(&name))?;
+    }
+
+    config::set_provider_field("ollama", "kind", "ollama")?;
+    config::set_provider_field("ollama", "base_url", &base_url)?;
+    config::set_provider_field("ollama", "model", model)?;
+    config::set_active_provider("ollama")?;
+
+    ui::print_success(&format!("Local model ready: {}", model.cyan()));
+    Ok(())
+}
+
+/// List the recommended models and ask which to download. Enter, or no
+/// terminal to ask on, takes `recommended` (the largest that fits in RAM).
+fn choose_local_model(recommended: &str) -> Result<String> {
+    let ram = config::system_ram_gb();
+    if !exec::is_interactive() {
+        ui::print_dim(&format!("  {}GB RAM → {}", ram, recommended));
+        return Ok(recommended.to_string());
+    }
+
+    eprintln!();
+    for (i, (name, params)) in ollama::RECOMMENDED_MODELS.iter().enumerate() {
+        let mark = if *name == recommended {
+            format!("  ← fits {}GB RAM", ram).green().to_string()
+        } else if !llm::model_fits_in_ram(*params) {
+            " ⚠ may not fit in RAM".yellow().to_string()
+        } else {
+            String::new()
+        };
+        eprintln!("  {}  {}{}", format!("{:>2}.", i + 1).dimmed(), name, mark);
+    }
+    eprintln!();
+
+    let names: Vec<&str> = ollama::RECOMMENDED_MODELS.iter().map(|(n, _)| *n).collect();
+    let answer = exec::ask(&format!(
+        "  Model [1-{}, or any Ollama model name; Enter for {}]: ",
+        names.len(),
+        recommended
+    ))?;
+    pick_model(&answer, &names, recommended)
+}
+
+/// The model an answer to `choose_local_model` names: a 1-based number
+/// from `names`, any other model name as typed, or `default` when empty
+fn pick_model(answer: &str, names: &[&str], default: &str) -> Result<String> {
+    let answer = answer.trim();
+    if answer.is_empty() {
+        return Ok(default.to_string());
+    }
+    if let Ok(n) = answer.parse::<usize>() {
+        return match n.checked_sub(1).and_then(|i| names.get(i)) {
+            Some(name) => Ok(name.to_string()),
+            None => anyhow::bail!("No model {} (choose 1-{})", n, names.len()),
+        };
+    }
+    Ok(answer.to_string())
+}
+
 // ─── Helpers ────────────────────────────────────────────────────────────────
 
 fn format_key(key: &str) -> String {
@@ -663,3 +883,20 @@ fn prompt_input(prompt: &str) -> Result<String> {
         .trim_end_matches('\r')
         .to_string())
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn model_answers_take_numbers_names_or_the_default() {
+        let names = ["qwen2.5-coder:1.5b", "qwen2.5-coder:3b", "qwen2.5-coder:7b"];
+        let pick = |answer| pick_model(answer, &names, "qwen2.5-coder:3b");
+
+        assert_eq!(pick("").unwrap(), "qwen2.5-coder:3b");
+        assert_eq!(pick(" 3 ").unwrap(), "qwen2.5-coder:7b");
+        assert_eq!(pick("llama3.2:1b").unwrap(), "llama3.2:1b");
+        assert!(pick("0").is_err());
+        assert!(pick("4").is_err());
+    }
+}
@@ -0,0 +1,177 @@
+use std::collections::HashMap;
+
+use anyhow::{anyhow, Result};
+use colored::Colorize;
+
+use crate::date::{days_from_civil, SECS_PER_DAY};
+use crate::history::{self, Entry};
+use crate::modes::cmd::first_tool;
+use crate::safety::RiskLevel;
+
+const TOP_TOOLS: usize = 10;
+
+/// Aggregated view of the history log
+pub struct Summary {
+    pub total: usize,
+    pub by_provider: Vec<(String, usize)>,
+    pub top_tools: Vec<(String, usize)>,
+    pub by_risk: Vec<(RiskLevel, usize)>,
+    pub avg_latency_ms: Option<u64>,
+}
+
+/// Run `niko stats`. Dates are `YYYY-MM-DD` (UTC); `until` is inclusive.
+pub fn run(since: Option<&str>, until: Option<&str>) -> Result<()> {
+    let since = since.map(parse_date).transpose()?;
+    let until = until.map(parse_date).transpose()?.map(|t| t + SECS_PER_DAY);
+
+    let entries: Vec<Entry> = history::load()?
+        .into_iter()
+        .filter(|e| since.is_none_or(|s| e.timestamp >= s))
+        .filter(|e| until.is_none_or(|u| e.timestamp < u))
+        .collect();
+
+    if entries.is_empty() {
+        eprintln!("{}", "No history in this range yet.".dimmed());
+        return Ok(());
+    }
+
+    let summary = summarize(&entries);
+
+    println!("{} {}", "Queries:".bold(), summary.total);
+    if let Some(ms) = summary.avg_latency_ms {
+        println!("{} {:.1}s", "Avg response:".bold(), ms as f64 / 1000.0);
+    }
+
+    print_section("By provider", &summary.by_provider);
+    print_section("Top tools", &summary.top_tools);
+
+    let risks: Vec<(String, usize)> = summary
+        .by_risk
+        .iter()
+        .map(|(level, n)| (level.to_string(), *n))
+        .collect();
+    print_section("Risk levels", &risks);
+
+    Ok(())
+}
+
+fn print_section(title: &str, rows: &[(String, usize)]) {
+    println!();
+    println!("{}", title.cyan().bold());
+    for (name, count) in rows {
+        println!("  {:<16} {}", name, count);
+    }
+}
+
+pub fn summarize(entries: &[Entry]) -> Summary {
+    let mut providers: HashMap<String, usize> = HashMap::new();
+    let mut tools: HashMap<String, usize> = HashMap::new();
+    let mut risks: HashMap<RiskLevel, usize> = HashMap::new();
+    let mut latency_total = 0u64;
+    let mut latency_count = 0u64;
+
+    for e in entries {
+        *providers.entry(e.provider.clone()).or_default() += 1;
+        if let Some(tool) = first_tool(&e.command) {
+            *tools.entry(tool).or_default() += 1;
+        }
+        *risks.entry(e.risk).or_default() += 1;
+        if let Some(ms) = e.latency_ms {
+            latency_total += ms;
+            latency_count += 1;
+        }
+    }
+
+    let mut top_tools = sorted_by_count(tools);
+    top_tools.truncate(TOP_TOOLS);
+
+    let mut by_risk: Vec<(RiskLevel, usize)> = risks.into_iter().collect();
+    by_risk.sort_by_key(|(level, _)| *level);
+
+    Summary {
+        total: entries.len(),
+        by_provider: sorted_by_count(providers),
+        top_tools,
+        by_risk,
+        avg_latency_ms: (latency_count > 0).then(|| latency_total / latency_count),
+    }
+}
+
+/// Most frequent first, ties broken alphabetically
+fn sorted_by_count(counts: HashMap<String, usize>) -> Vec<(String, usize)> {
+    let mut rows: Vec<(String, usize)> = counts.into_iter().collect();
+    rows.sort_by(|a, b| b.1.cmp(&a.1).then_with(|| a.0.cmp(&b.0)));
+    rows
+}
+
+/// Parse `YYYY-MM-DD` into a Unix timestamp at UTC midnight
+fn parse_date(s: &str) -> Result<u64> {
+    let invalid = || anyhow!("Invalid date '{}': expected YYYY-MM-DD", s);
+
+    let mut parts = s.trim().splitn(3, '-');
+    let mut next = || -> Result<i64> {
+        parts
+            .next()
+            .and_then(|p| p.parse().ok())
+            .ok_or_else(invalid)
+    };
+    let (y, m, d) = (next()?, next()?, next()?);
+
+    if y < 1970 || !(1..=12).contains(&m) || !(1..=31).contains(&d) {
+        return Err(invalid());
+    }
+
+    Ok(days_from_civil(y, m, d) as u64 * SECS_PER_DAY)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn entry(provider: &str, command: &str, risk: RiskLevel, latency_ms: Option<u64>) -> Entry {
+        Entry {
+            provider: provider.into(),
+            command: command.into(),
+            risk,
+            latency_ms,
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn parses_dates_as_utc_midnight() {
+        assert_eq!(parse_date("1970-01-01").unwrap(), 0);
+        assert_eq!(parse_date("2000-03-01").unwrap(), 11_017 * SECS_PER_DAY);
+        assert!(parse_date("2024-13-01").is_err());
+        assert!(parse_date("yesterday").is_err());
+    }
+
+    #[test]
+    fn summarizes_providers_tools_risk_and_latency() {
+        let entries = vec![
+            entry(
+                "ollama",
+                "find . -name '*.log'",
+                RiskLevel::Safe,
+                Some(1000),
+            ),
+            entry(
+                "ollama",
+                "sudo find / -size +1G",
+                RiskLevel::Dangerous,
+                None,
+            ),
+            entry("openai", "du -sh *", RiskLevel::Safe, Some(3000)),
+        ];
+
+        let s = summarize(&entries);
+        assert_eq!(s.total, 3);
+        assert_eq!(s.by_provider[0], ("ollama".to_string(), 2));
+        assert_eq!(s.top_tools[0], ("find".to_string(), 2));
+        assert_eq!(
+            s.by_risk,
+            vec![(RiskLevel::Safe, 2), (RiskLevel::Dangerous, 1)]
+        );
+        assert_eq!(s.avg_latency_ms, Some(2000));
+    }
+}
@@ -0,0 +1,67 @@
+use anyhow::Result;
+use serde::Serialize;
+
+/// What `niko version --json` prints. Fields the build couldn't learn
+/// (no git checkout, say) are null.
+#[derive(Debug, Serialize)]
+struct Info {
+    version: &'static str,
+    commit: Option<&'static str>,
+    build_date: Option<&'static str>,
+    rust_version: Option<&'static str>,
+    os: &'static str,
+    arch: &'static str,
+}
+
+fn info() -> Info {
+    Info {
+        version: env!("CARGO_PKG_VERSION"),
+        commit: option_env!("NIKO_COMMIT"),
+        build_date: option_env!("NIKO_BUILD_DATE"),
+        rust_version: option_env!("NIKO_RUSTC_VERSION"),
+        os: std::env::consts::OS,
+        arch: std::env::consts::ARCH,
+    }
+}
+
+/// Run `niko version`: one line for people, or a JSON object for scripts
+pub fn run(json: bool) -> Result<()> {
+    let info = info();
+    if json {
+        println!("{}", serde_json::to_string(&info)?);
+        return Ok(());
+    }
+
+    let mut line = format!("niko {}", info.version);
+    let build: Vec<&str> = [info.commit, info.build_date]
+        .into_iter()
+        .flatten()
+        .collect();
+    if !build.is_empty() {
+        line.push_str(&format!(" ({})", build.join(" ")));
+    }
+    println!("{}", line);
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn json_has_every_field() {
+        let value = serde_json::to_value(info()).unwrap();
+        for key in [
+            "version",
+            "commit",
+            "build_date",
+            "rust_version",
+            "os",
+            "arch",
+        ] {
+            assert!(value.get(key).is_some(), "missing {}", key);
+        }
+        assert_eq!(value["version"], env!("CARGO_PKG_VERSION"));
+        assert_eq!(value["os"], std::env::consts::OS);
+    }
+}
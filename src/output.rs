@@ -0,0 +1,269 @@
+use std::io::{self, Write};
+
+use clap::ValueEnum;
+use colored::Colorize;
+use serde::Serialize;
+
+use crate::safety::{Assessment, RiskLevel};
+
+/// How command mode reports its result (`--output`)
+#[derive(Debug, Clone, Copy, PartialEq, Eq, ValueEnum)]
+pub enum Format {
+    /// The command on stdout, warnings on stderr
+    Text,
+    /// One JSON object on stdout with the command, risk and warnings
+    Json,
+    /// The command in a ``` fenced block tagged for the shell
+    Markdown,
+    /// Only the command, no warnings
+    Quiet,
+    /// A runnable script: shebang, warnings as comments, then the command
+    Script,
+}
+
+/// Everything command mode has to say about one generated command
+pub struct Report<'a> {
+    pub command: &'a str,
+    /// Changes made by the `safety.rewrite` policy, and paths the command
+    /// names that aren't where it will run
+    pub notes: &'a [String],
+    /// shellcheck warnings
+    pub lints: &'a [String],
+    pub assessment: &'a Assessment,
+}
+
+/// Writes a [`Report`]: the result goes to `out` (stdout), diagnostics to
+/// `err` (stderr), so `$(niko ...)` only ever captures the result
+pub trait Formatter {
+    fn write(&self, report: &Report, out: &mut dyn Write, err: &mut dyn Write) -> io::Result<()>;
+}
+
+/// The formatter for `format`. Under `--exec` the command is about to run,
+/// so it is echoed to stderr and stdout is left to the command itself.
+pub fn formatter(format: Format, shell: &str, exec: bool) -> Box<dyn Formatter> {
+    if exec {
+        return Box::new(Text { echo: true });
+    }
+    match format {
+        Format::Text => Box::new(Text { echo: false }),
+        Format::Json => Box::new(Json),
+        Format::Markdown => Box::new(Markdown {
+            shell: shell.to_string(),
+        }),
+        Format::Quiet => Box::new(Quiet),
+        Format::Script => Box::new(Script {
+            shell: shell.to_string(),
+        }),
+    }
+}
+
+/// Wrap a command in a fenced code block tagged for `shell`
+pub fn fenced(command: &str, shell: &str) -> String {
+    let lang = match shell {
+        "powershell" | "fish" => shell,
+        "cmd" => "bat",
+        _ => "bash",
+    };
+    format!("```{}\n{}\n```", lang, command)
+}
+
+/// Notes, lint warnings and a dangerous-or-worse risk, as stderr shows them
+fn write_diagnostics(report: &Report, err: &mut dyn Write) -> io::Result<()> {
+    for note in report.notes {
+        writeln!(err, "{}", format!("  note: {}", note).dimmed())?;
+    }
+    for warning in report.lints {
+        writeln!(err, "{} shellcheck {}", "⚠".yellow(), warning)?;
+    }
+    let assessment = report.assessment;
+    if assessment.level >= RiskLevel::Dangerous {
+        writeln!(
+            err,
+            "{} {}: {}",
+            "⚠".yellow().bold(),
+            assessment.level.as_str().yellow().bold(),
+            assessment.reasons.join(", ")
+        )?;
+    }
+    Ok(())
+}
+
+struct Text {
+    /// Show the command as `$ command` on stderr instead of printing it
+    echo: bool,
+}
+
+impl Formatter for Text {
+    fn write(&self, report: &Report, out: &mut dyn Write, err: &mut dyn Write) -> io::Result<()> {
+        if self.echo {
+            writeln!(err, "{} {}", "$".dimmed(), report.command.bold())?;
+        } else {
+            writeln!(out, "{}", report.command)?;
+        }
+        write_diagnostics(report, err)
+    }
+}
+
+struct Markdown {
+    shell: String,
+}
+
+impl Formatter for Markdown {
+    fn write(&self, report: &Report, out: &mut dyn Write, err: &mut dyn Write) -> io::Result<()> {
+        writeln!(out, "{}", fenced(report.command, &self.shell))?;
+        write_diagnostics(report, err)
+    }
+}
+
+struct Quiet;
+
+impl Formatter for Quiet {
+    fn write(&self, report: &Report, out: &mut dyn Write, _err: &mut dyn Write) -> io::Result<()> {
+        writeln!(out, "{}", report.command)
+    }
+}
+
+#[derive(Serialize)]
+struct JsonReport<'a> {
+    command: &'a str,
+    risk: RiskLevel,
+    reasons: &'a [String],
+    blocked: bool,
+    lint: &'a [String],
+    notes: &'a [String],
+}
+
+struct Json;
+
+impl Formatter for Json {
+    fn write(&self, report: &Report, out: &mut dyn Write, _err: &mut dyn Write) -> io::Result<()> {
+        let json = JsonReport {
+            command: report.command,
+            risk: report.assessment.level,
+            reasons: &report.assessment.reasons,
+            blocked: report.assessment.blocked,
+            lint: report.lints,
+            notes: report.notes,
+        };
+        serde_json::to_writer(&mut *out, &json)?;
+        writeln!(out)
+    }
+}
+
+struct Script {
+    shell: String,
+}
+
+impl Formatter for Script {
+    fn write(&self, report: &Report, out: &mut dyn Write, _err: &mut dyn Write) -> io::Result<()> {
+        // Only the POSIX-style shells can run a script via a shebang
+        if matches!(
+            self.shell.as_str(),
+            "sh" | "bash" | "zsh" | "dash" | "ksh" | "fish"
+        ) {
+            writeln!(out, "#!/usr/bin/env {}", self.shell)?;
+        }
+        for note in report.notes {
+            writeln!(out, "# note: {}", note)?;
+        }
+        for warning in report.lints {
+            writeln!(out, "# shellcheck: {}", warning)?;
+        }
+        let assessment = report.assessment;
+        if assessment.level >= RiskLevel::Dangerous {
+            writeln!(
+                out,
+                "# WARNING ({}): {}",
+                assessment.level,
+                assessment.reasons.join(", ")
+            )?;
+        }
+        writeln!(out, "{}", report.command)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::safety;
+
+    /// Render a dangerous command with one note and one lint warning,
+    /// returning (stdout, stderr)
+    fn render(format: Format, exec: bool) -> (String, String) {
+        let assessment = safety::assess_with("rm -rf build", &[]);
+        let report = Report {
+            command: "rm -rf build",
+            notes: &["removed leading sudo".to_string()],
+            lints: &["1:1: warning: example [SC0000]".to_string()],
+            assessment: &assessment,
+        };
+
+        let (mut out, mut err) = (Vec::new(), Vec::new());
+        formatter(format, "bash", exec)
+            .write(&report, &mut out, &mut err)
+            .unwrap();
+        (
+            String::from_utf8(out).unwrap(),
+            String::from_utf8(err).unwrap(),
+        )
+    }
+
+    #[test]
+    fn text_prints_command_and_warns_on_stderr() {
+        let (out, err) = render(Format::Text, false);
+        assert_eq!(out, "rm -rf build\n");
+        assert!(err.contains("removed leading sudo"));
+        assert!(err.contains("SC0000"));
+        assert!(err.contains("dangerous"));
+    }
+
+    #[test]
+    fn exec_echoes_the_command_on_stderr_only() {
+        for format in [Format::Text, Format::Json, Format::Markdown] {
+            let (out, err) = render(format, true);
+            assert_eq!(out, "");
+            assert!(err.contains("rm -rf build"));
+        }
+    }
+
+    #[test]
+    fn markdown_fences_the_command() {
+        let (out, err) = render(Format::Markdown, false);
+        assert_eq!(out, "```bash\nrm -rf build\n```\n");
+        assert!(err.contains("dangerous"));
+    }
+
+    #[test]
+    fn quiet_prints_only_the_command() {
+        assert_eq!(
+            render(Format::Quiet, false),
+            ("rm -rf build\n".to_string(), String::new())
+        );
+    }
+
+    #[test]
+    fn json_puts_everything_on_stdout() {
+        let (out, err) = render(Format::Json, false);
+        assert_eq!(err, "");
+        assert_eq!(out.lines().count(), 1);
+
+        let value: serde_json::Value = serde_json::from_str(&out).unwrap();
+        assert_eq!(value["command"], "rm -rf build");
+        assert_eq!(value["risk"], "dangerous");
+        assert_eq!(value["blocked"], false);
+        assert_eq!(value["lint"].as_array().unwrap().len(), 1);
+        assert_eq!(value["notes"][0], "removed leading sudo");
+    }
+
+    #[test]
+    fn script_comments_warnings_above_the_command() {
+        let (out, err) = render(Format::Script, false);
+        assert_eq!(err, "");
+
+        let lines: Vec<&str> = out.lines().collect();
+        assert_eq!(lines[0], "#!/usr/bin/env bash");
+        assert!(lines[1..lines.len() - 1].iter().all(|l| l.starts_with('#')));
+        assert!(out.contains("# WARNING (dangerous)"));
+        assert_eq!(lines.last(), Some(&"rm -rf build"));
+    }
+}
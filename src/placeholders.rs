@@ -0,0 +1,63 @@
+use std::sync::OnceLock;
+
+use regex::Regex;
+
+/// `<name>`-style blanks the model leaves for values it can't know, e.g.
+/// `docker exec -it <container_name> sh`. Redirections (`< file`),
+/// heredocs and process substitution don't match.
+fn pattern() -> &'static Regex {
+    static RE: OnceLock<Regex> = OnceLock::new();
+    RE.get_or_init(|| {
+        Regex::new(r"<([A-Za-z][A-Za-z0-9_.\-]*)>").expect("invalid placeholder pattern")
+    })
+}
+
+/// Distinct placeholders in order of first appearance, without brackets
+pub fn find(command: &str) -> Vec<String> {
+    let mut names: Vec<String> = Vec::new();
+    for cap in pattern().captures_iter(command) {
+        let name = cap[1].to_string();
+        if !names.contains(&name) {
+            names.push(name);
+        }
+    }
+    names
+}
+
+/// Replace every `<name>` with its value; unknown names are left as-is
+pub fn fill(command: &str, values: &[(String, String)]) -> String {
+    pattern()
+        .replace_all(command, |cap: &regex::Captures| {
+            values
+                .iter()
+                .find(|(name, _)| name == &cap[1])
+                .map(|(_, value)| value.clone())
+                .unwrap_or_else(|| cap[0].to_string())
+        })
+        .into_owned()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn finds_distinct_placeholders_but_not_redirections() {
+        assert_eq!(
+            find("docker cp <container>:/app/<file> ./<file>"),
+            vec!["container", "file"]
+        );
+        assert!(find("sort < input.txt > out.txt").is_empty());
+        assert!(find("diff <(ls a) <(ls b)").is_empty());
+        assert!(find("cat <<EOF").is_empty());
+    }
+
+    #[test]
+    fn fills_known_values_and_keeps_the_rest() {
+        let values = vec![("container".to_string(), "web".to_string())];
+        assert_eq!(
+            fill("docker exec -it <container> <shell>", &values),
+            "docker exec -it web <shell>"
+        );
+    }
+}
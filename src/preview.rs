@@ -0,0 +1,629 @@
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+use anyhow::{bail, Context, Result};
+
+use crate::config;
+
+/// What a file-editing command would change in one file
+pub struct FileDiff {
+    pub path: PathBuf,
+    /// `diff -u` output; empty when the file would be left as it is
+    pub diff: String,
+}
+
+/// Preview the edits `command` would make, without touching any file.
+///
+/// Best-effort: only a single `sed -i` over plain file names, or a
+/// command whose output is redirected with `>` / `>>`, is recognized.
+/// Anything else returns `None`. Producing the new content means running
+/// part of the command, so sed scripts that could run or write anything
+/// besides stdout (`e`, `w`, `r` and the like) aren't previewed, and a
+/// redirect only is when every stage of its pipeline is a read-only tool.
+pub fn preview(command: &str, cwd: Option<&Path>) -> Result<Option<Vec<FileDiff>>> {
+    if cfg!(target_os = "windows") {
+        return Ok(None);
+    }
+    let Some(tokens) = tokenize(command) else {
+        return Ok(None);
+    };
+
+    let edits = match sed_in_place(&tokens).or_else(|| redirect(command, &tokens)) {
+        Some(edits) => edits,
+        None => return Ok(None),
+    };
+
+    let dir = cwd.map(Path::to_path_buf).unwrap_or_default();
+    let mut diffs = Vec::new();
+    for edit in edits {
+        let path = dir.join(&edit.file);
+        let before = match fs::read(&path) {
+            Ok(bytes) => bytes,
+            Err(_) if edit.append || edit.truncate => Vec::new(),
+            Err(_) => return Ok(None),
+        };
+        let output = run_capture(&edit.producer, cwd)?;
+        let after = if edit.append {
+            [before.as_slice(), output.as_slice()].concat()
+        } else {
+            output
+        };
+        diffs.push(FileDiff {
+            diff: unified_diff(&edit.file, &before, &after)?,
+            path,
+        });
+    }
+    Ok(Some(diffs))
+}
+
+/// One file edit: the file as written in the command, and a command
+/// printing its new content (or, with `append`, what gets added)
+struct Edit {
+    file: String,
+    producer: String,
+    append: bool,
+    /// `>` creates the file, so a missing one previews as empty
+    truncate: bool,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+enum Token<'a> {
+    /// A word as written (quotes included) and its unquoted value
+    Word(&'a str, String),
+    /// `|`, `||`, `&`, `&&`, `;`, `>`, `>>`, `<`, or an `N>` style redirect
+    Op(&'a str),
+}
+
+/// Split a command line into words and operators. Returns `None` for
+/// anything too clever to handle safely: unbalanced quotes, command
+/// substitution, globs, variables or here-docs.
+fn tokenize(command: &str) -> Option<Vec<Token<'_>>> {
+    let bytes = command.as_bytes();
+    let mut tokens = Vec::new();
+    let mut i = 0;
+
+    while i < bytes.len() {
+        let c = bytes[i];
+        if c.is_ascii_whitespace() {
+            i += 1;
+            continue;
+        }
+
+        // `2>` is a file-descriptor redirect, not a word
+        let digits = bytes[i..].iter().take_while(|b| b.is_ascii_digit()).count();
+        if digits > 0 && bytes.get(i + digits) == Some(&b'>') {
+            let start = i;
+            i += digits + 1;
+            if matches!(bytes.get(i), Some(b'>' | b'&')) {
+                i += 1;
+            }
+            tokens.push(Token::Op(&command[start..i]));
+            continue;
+        }
+
+        if matches!(c, b'|' | b'&' | b';' | b'<' | b'>') {
+            let start = i;
+            i += 1;
+            if i < bytes.len() && (bytes[i] == c || (c == b'>' && bytes[i] == b'&')) {
+                i += 1;
+            }
+            if &command[start..i] == "<<" {
+                return None;
+            }
+            tokens.push(Token::Op(&command[start..i]));
+            continue;
+        }
+
+        let start = i;
+        let mut value = String::new();
+        while i < bytes.len() {
+            let c = bytes[i];
+            match c {
+                b'\'' => {
+                    let end = command[i + 1..].find('\'')? + i + 1;
+                    value.push_str(&command[i + 1..end]);
+                    i = end + 1;
+                }
+                b'"' => {
+                    let end = command[i + 1..].find('"')? + i + 1;
+                    let inner = &command[i + 1..end];
+                    if inner.contains(['$', '`', '\\']) {
+                        return None;
+                    }
+                    value.push_str(inner);
+                    i = end + 1;
+                }
+                b'$' | b'`' | b'\\' | b'*' | b'?' | b'[' | b'~' => return None,
+                _ if c.is_ascii_whitespace() => break,
+                b'|' | b'&' | b';' | b'<' | b'>' => break,
+                _ => {
+                    let len = command[i..].chars().next()?.len_utf8();
+                    value.push_str(&command[i..i + len]);
+                    i += len;
+                }
+            }
+        }
+        tokens.push(Token::Word(&command[start..i], value));
+    }
+    Some(tokens)
+}
+
+/// Short `sed` flags that take no argument, so `-i` may follow them in a
+/// cluster like `-Ei`
+const SED_FLAGS: &str = "nrEsuz";
+
+/// `sed -i ... FILE...` → one `sed ... FILE` per file, printing to stdout
+fn sed_in_place(tokens: &[Token]) -> Option<Vec<Edit>> {
+    let mut words = Vec::new();
+    for token in tokens {
+        match token {
+            Token::Word(raw, value) => words.push((*raw, value.as_str())),
+            Token::Op(_) => return None,
+        }
+    }
+    if words.first()?.1 != "sed" {
+        return None;
+    }
+
+    let mut keep = vec!["sed".to_string()];
+    let mut positional = Vec::new();
+    let mut in_place = false;
+    let mut scripts = Vec::new();
+    let mut rest = words[1..].iter();
+
+    while let Some(&(raw, value)) = rest.next() {
+        if value == "--" {
+            positional.extend(rest.by_ref().copied());
+            break;
+        }
+        if value.starts_with("--in-place") {
+            in_place = true;
+        } else if value.starts_with("--file") {
+            // A script file can't be vetted from here
+            return None;
+        } else if value.starts_with("--expression") {
+            keep.push(raw.to_string());
+            match value.split_once('=') {
+                Some((_, script)) => scripts.push(script),
+                None => {
+                    let (raw, script) = rest.next()?;
+                    keep.push(raw.to_string());
+                    scripts.push(script);
+                }
+            }
+        } else if let Some(flags) = value.strip_prefix('-').filter(|f| !f.is_empty()) {
+            let plain = flags
+                .find(|c| !SED_FLAGS.contains(c))
+                .unwrap_or(flags.len());
+            match flags[plain..].chars().next() {
+                Some('i') => {
+                    in_place = true;
+                    if plain > 0 {
+                        keep.push(format!("-{}", &flags[..plain]));
+                    }
+                    // BSD sed: `-i ''` for no backup suffix
+                    if flags.len() == plain + 1
+                        && rest.clone().next().is_some_and(|(_, v)| v.is_empty())
+                    {
+                        rest.next();
+                    }
+                }
+                Some('f') => return None,
+                Some(flag @ ('e' | 'l')) => {
+                    keep.push(raw.to_string());
+                    let argument = if flags.len() == plain + 1 {
+                        let (raw, value) = rest.next()?;
+                        keep.push(raw.to_string());
+                        *value
+                    } else {
+                        &flags[plain + 1..]
+                    };
+                    if flag == 'e' {
+                        scripts.push(argument);
+                    }
+                }
+                _ => keep.push(raw.to_string()),
+            }
+        } else {
+            positional.push((raw, value));
+        }
+    }
+
+    if !in_place {
+        return None;
+    }
+    let mut positional = positional.into_iter();
+    if scripts.is_empty() {
+        let (raw, script) = positional.next()?;
+        keep.push(raw.to_string());
+        scripts.push(script);
+    }
+    if !scripts.iter().all(|script| sed_script_is_safe(script)) {
+        return None;
+    }
+    let files: Vec<_> = positional.collect();
+    if files.is_empty() {
+        return None;
+    }
+
+    let base = keep.join(" ");
+    Some(
+        files
+            .into_iter()
+            .map(|(raw, value)| Edit {
+                file: value.to_string(),
+                producer: format!("{} {}", base, raw),
+                append: false,
+                truncate: false,
+            })
+            .collect(),
+    )
+}
+
+/// sed commands without side effects beyond printing. Everything else is
+/// refused, notably `e` (runs a command), `w`/`W` (write a file) and
+/// `r`/`R` (read one).
+const SED_PLAIN_COMMANDS: &str = "=dDgGhHlnNpPqQxzF";
+
+/// Flags of `s` that only change the substitution; `e` and `w` are left out
+const SED_SUBSTITUTE_FLAGS: &str = "gpiImM0123456789";
+
+/// Whether a sed script only ever prints. Parsed just far enough to find
+/// each command; anything not understood counts as unsafe.
+fn sed_script_is_safe(script: &str) -> bool {
+    let chars: Vec<char> = script.chars().collect();
+    let mut i = 0;
+
+    while let Some(&c) = chars.get(i) {
+        i = match c {
+            _ if c.is_whitespace() => i + 1,
+            ';' | '{' | '}' | '!' => i + 1,
+            // Addresses: `3`, `$`, `1,5`, `0~2`, `/re/I`, `\%re%`
+            '0'..='9' | '$' | ',' | '~' | '+' => i + 1,
+            '/' | '\\' => {
+                let (delimiter, start) = match c {
+                    '/' => ('/', i + 1),
+                    _ => match chars.get(i + 1) {
+                        Some(&d) if d != '\n' && d != '\\' => (d, i + 2),
+                        _ => return false,
+                    },
+                };
+                let Some(mut end) = skip_part(&chars, start, delimiter, true) else {
+                    return false;
+                };
+                while matches!(chars.get(end), Some('I' | 'M')) {
+                    end += 1;
+                }
+                end
+            }
+            's' | 'y' => {
+                let delimiter = match chars.get(i + 1) {
+                    Some(&d) if d != '\n' && d != '\\' => d,
+                    _ => return false,
+                };
+                let Some(end) = skip_part(&chars, i + 2, delimiter, c == 's')
+                    .and_then(|end| skip_part(&chars, end, delimiter, false))
+                else {
+                    return false;
+                };
+                let flags = chars[end..]
+                    .iter()
+                    .take_while(|f| !matches!(f, ';' | '\n' | '}'))
+                    .count();
+                let allowed = if c == 's' { SED_SUBSTITUTE_FLAGS } else { "" };
+                if !chars[end..end + flags]
+                    .iter()
+                    .all(|f| f.is_whitespace() || allowed.contains(*f))
+                {
+                    return false;
+                }
+                end + flags
+            }
+            // Text up to the end of the line, `\` continuing it
+            'a' | 'i' | 'c' | '#' => {
+                let mut end = i + 1;
+                while let Some(&t) = chars.get(end) {
+                    if t == '\n' {
+                        break;
+                    }
+                    end += if t == '\\' { 2 } else { 1 };
+                }
+                end
+            }
+            // A label, up to `;` or the end of the line
+            ':' | 'b' | 't' | 'T' => {
+                i + 1
+                    + chars[i + 1..]
+                        .iter()
+                        .take_while(|t| !matches!(t, ';' | '\n'))
+                        .count()
+            }
+            _ if SED_PLAIN_COMMANDS.contains(c) => i + 1,
+            _ => return false,
+        };
+    }
+    true
+}
+
+/// The index just past the `delimiter` closing a regex (`regex`, where
+/// `[...]` may contain the delimiter) or a replacement starting at `start`
+fn skip_part(chars: &[char], start: usize, delimiter: char, regex: bool) -> Option<usize> {
+    let mut i = start;
+    loop {
+        let c = *chars.get(i)?;
+        if c == delimiter {
+            return Some(i + 1);
+        }
+        i = match c {
+            '\\' => i + 2,
+            '[' if regex => {
+                // `[]...]` and `[^]...]` start with a literal `]`
+                let mut end = i + 1;
+                if chars.get(end) == Some(&'^') {
+                    end += 1;
+                }
+                if chars.get(end) == Some(&']') {
+                    end += 1;
+                }
+                end + chars.get(end..)?.iter().position(|&b| b == ']')? + 1
+            }
+            _ => i + 1,
+        };
+    }
+}
+
+/// Tools that only read their input and write to stdout, so running them
+/// for a redirect preview changes nothing. `sort -o`, `tail -f` and
+/// `uniq IN OUT` are the exceptions `read_only_stage` rules out.
+const READ_ONLY_TOOLS: &[&str] = &[
+    "cat", "column", "cut", "echo", "grep", "head", "jq", "nl", "paste", "printf", "rev", "seq",
+    "sort", "tac", "tail", "tr", "uniq", "wc",
+];
+
+/// Whether one pipeline stage, as unquoted words, is a read-only tool
+fn read_only_stage(words: &[&str]) -> bool {
+    let Some((tool, args)) = words.split_first() else {
+        return false;
+    };
+    if !READ_ONLY_TOOLS.contains(tool) {
+        return false;
+    }
+    let short = |flags: &[char]| {
+        args.iter()
+            .any(|a| a.starts_with('-') && !a.starts_with("--") && a.contains(flags))
+    };
+    match *tool {
+        "sort" => !short(&['o']) && !args.iter().any(|a| a.starts_with("--output")),
+        "tail" => !short(&['f', 'F']) && !args.iter().any(|a| a.starts_with("--follow")),
+        "uniq" => args.iter().filter(|a| !a.starts_with('-')).count() <= 1,
+        _ => true,
+    }
+}
+
+/// `PRODUCER > FILE` or `PRODUCER >> FILE`, with the redirect last and
+/// only pipes of read-only tools in the producer
+fn redirect(command: &str, tokens: &[Token]) -> Option<Vec<Edit>> {
+    let [before @ .., Token::Op(op @ (">" | ">>")), Token::Word(_, file)] = tokens else {
+        return None;
+    };
+    if before.is_empty()
+        || before
+            .iter()
+            .any(|t| matches!(t, Token::Op(o) if *o != "|"))
+    {
+        return None;
+    }
+
+    let read_only = before.split(|t| matches!(t, Token::Op(_))).all(|stage| {
+        let words: Vec<&str> = stage
+            .iter()
+            .filter_map(|t| match t {
+                Token::Word(_, value) => Some(value.as_str()),
+                Token::Op(_) => None,
+            })
+            .collect();
+        read_only_stage(&words)
+    });
+    if !read_only {
+        return None;
+    }
+
+    let op_at = op.as_ptr() as usize - command.as_ptr() as usize;
+    let producer = command[..op_at].trim();
+    Some(vec![Edit {
+        file: file.clone(),
+        producer: producer.to_string(),
+        append: *op == ">>",
+        truncate: true,
+    }])
+}
+
+/// Run a read-only command through `sh` and return its stdout
+fn run_capture(command: &str, cwd: Option<&Path>) -> Result<Vec<u8>> {
+    let mut shell = Command::new("sh");
+    shell.args(["-c", command]);
+    if let Some(dir) = cwd {
+        shell.current_dir(dir);
+    }
+    let output = shell
+        .output()
+        .with_context(|| format!("Failed to run preview: {}", command))?;
+    if !output.status.success() {
+        bail!(
+            "Preview failed: {}\n{}",
+            command,
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(output.stdout)
+}
+
+/// `diff -u` between two versions of `name`, labelled like git's
+fn unified_diff(name: &str, before: &[u8], after: &[u8]) -> Result<String> {
+    if before == after {
+        return Ok(String::new());
+    }
+
+    let dir = config::private_temp_dir("niko-diff")?;
+    let (old, new) = (dir.join("old"), dir.join("new"));
+    let written =
+        config::create_private(&old, before).and_then(|()| config::create_private(&new, after));
+    if let Err(e) = written {
+        let _ = fs::remove_dir_all(&dir);
+        return Err(e);
+    }
+
+    let output = Command::new("diff")
+        .args([
+            "-u",
+            "-L",
+            &format!("a/{}", name),
+            "-L",
+            &format!("b/{}", name),
+        ])
+        .arg(&old)
+        .arg(&new)
+        .output();
+    let _ = fs::remove_dir_all(&dir);
+
+    let output = output.context("Failed to run diff (is it installed?)")?;
+    // diff exits 1 when the files differ, 2 on trouble
+    if output.status.code() == Some(2) {
+        bail!(
+            "diff failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(String::from_utf8_lossy(&output.stdout).into_owned())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn producers(command: &str) -> Option<Vec<(String, String, bool)>> {
+        let tokens = tokenize(command)?;
+        let edits = sed_in_place(&tokens).or_else(|| redirect(command, &tokens))?;
+        Some(
+            edits
+                .into_iter()
+                .map(|e| (e.file, e.producer, e.append))
+                .collect(),
+        )
+    }
+
+    #[test]
+    fn sed_in_place_previews_each_file_on_stdout() {
+        assert_eq!(
+            producers("sed -i 's/foo/bar/g' a.txt 'b c.txt'").unwrap(),
+            vec![
+                ("a.txt".into(), "sed 's/foo/bar/g' a.txt".into(), false),
+                (
+                    "b c.txt".into(),
+                    "sed 's/foo/bar/g' 'b c.txt'".into(),
+                    false
+                ),
+            ]
+        );
+        assert_eq!(
+            producers("sed -Ei '' -e 's/a/b/' notes.md").unwrap(),
+            vec![(
+                "notes.md".into(),
+                "sed -E -e 's/a/b/' notes.md".into(),
+                false
+            )]
+        );
+        assert_eq!(
+            producers("sed --in-place=.bak 's/x/y/' f").unwrap()[0].1,
+            "sed 's/x/y/' f"
+        );
+    }
+
+    #[test]
+    fn redirects_preview_the_producer() {
+        assert_eq!(
+            producers("sort names.txt | uniq >> all.txt").unwrap(),
+            vec![("all.txt".into(), "sort names.txt | uniq".into(), true)]
+        );
+        assert_eq!(
+            producers("echo 'done' > status").unwrap(),
+            vec![("status".into(), "echo 'done'".into(), false)]
+        );
+    }
+
+    #[test]
+    fn anything_else_has_no_preview() {
+        for command in [
+            "sed 's/a/b/' f",
+            "sed -i 's/a/b/' *.txt",
+            "sed -i 's/a/b/' f && ls",
+            "make 2> errors.log",
+            "echo $HOME > f",
+            "cat <<EOF > f",
+            "rm -rf build > log",
+            "ls > a > b",
+            "find . -name '*.o' -delete > log",
+            "sort -o names.txt names.txt > log",
+            "tail -f app.log > copy",
+            "uniq in.txt out.txt > log",
+            "sed -i '1e touch x' f",
+            "sed -i 's/a/b/w /tmp/out' f",
+            "sed -i 's/a/b/e' f",
+            "sed -i -e 'p' -e '$r /etc/passwd' f",
+            "sed -i '/x/W copy' f",
+            "sed -i 's/[/]/x/;w out' f",
+            "sed -i -f script.sed f",
+            "sed -i --expression='1R other' f",
+        ] {
+            assert!(producers(command).is_none(), "{}", command);
+        }
+    }
+
+    #[test]
+    fn sed_scripts_that_only_print_are_previewed() {
+        for script in [
+            "s/a/b/g",
+            "s|/usr|/opt|2p",
+            "s/[/]/x/w",
+            "/^#/d;$!N",
+            "\\%tmp%,+3s/x/y/I",
+            "1i header",
+            ":a;N;$!ba;s/\\n/ /g",
+            "y/abc/xyz/",
+            "2{p;q}",
+        ] {
+            assert_eq!(
+                sed_script_is_safe(script),
+                script != "s/[/]/x/w",
+                "{}",
+                script
+            );
+        }
+    }
+
+    #[test]
+    fn previews_without_touching_the_file() {
+        let dir = std::env::temp_dir().join(format!("niko-preview-{}", std::process::id()));
+        fs::create_dir_all(&dir).unwrap();
+        fs::write(dir.join("greeting"), "hello world\n").unwrap();
+
+        let diffs = preview("sed -i 's/world/there/' greeting", Some(&dir))
+            .unwrap()
+            .unwrap();
+        assert_eq!(diffs.len(), 1);
+        assert!(diffs[0].diff.contains("-hello world"));
+        assert!(diffs[0].diff.contains("+hello there"));
+        assert_eq!(
+            fs::read_to_string(dir.join("greeting")).unwrap(),
+            "hello world\n"
+        );
+
+        let diffs = preview("echo bye >> greeting", Some(&dir))
+            .unwrap()
+            .unwrap();
+        assert!(diffs[0].diff.contains("+bye"));
+
+        fs::remove_dir_all(&dir).unwrap();
+    }
+}
@@ -0,0 +1,301 @@
+use std::cell::RefCell;
+use std::io::{self, IsTerminal, Write};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, Mutex};
+use std::thread::{self, JoinHandle};
+use std::time::{Duration, Instant};
+
+use anyhow::Result;
+use colored::Colorize;
+
+use crate::llm::{self, Generation, Message, Provider};
+
+const SPINNER_FRAMES: &[char] = &['⠋', '⠙', '⠹', '⠸', '⠼', '⠴', '⠦', '⠧', '⠇', '⠏'];
+const SPINNER_INTERVAL: Duration = Duration::from_millis(80);
+const SPINNER_TEXT: &str = "generating…";
+
+/// Set while something is drawn on the current stderr line, so an
+/// interrupt can move past it before printing
+static DRAWING: AtomicBool = AtomicBool::new(false);
+
+/// Set while the spinner thread is animating
+static SPINNING: AtomicBool = AtomicBool::new(false);
+
+/// Set while a status line drawn by `status` is on screen
+static STATUS: AtomicBool = AtomicBool::new(false);
+
+/// What the spinner says next to its frame; `None` is the default text
+static MESSAGE: Mutex<Option<String>> = Mutex::new(None);
+
+thread_local! {
+    /// Set by `abandon_when` on a thread whose result may stop mattering
+    static ABANDONED: RefCell<Option<Arc<AtomicBool>>> = const { RefCell::new(None) };
+}
+
+/// Treat the current thread's work as unwanted once `flag` is set, e.g.
+/// the providers that lost a race: from then on its messages are dropped
+/// rather than landing in the winner's prompt or output, and
+/// `llm::generate_with_retry` stops retrying for it
+pub fn abandon_when(flag: Arc<AtomicBool>) {
+    ABANDONED.with(|abandoned| *abandoned.borrow_mut() = Some(flag));
+}
+
+/// Whether the current thread's work was abandoned (see `abandon_when`)
+pub fn is_abandoned() -> bool {
+    ABANDONED.with(|abandoned| {
+        abandoned
+            .borrow()
+            .as_ref()
+            .is_some_and(|flag| flag.load(Ordering::Relaxed))
+    })
+}
+
+/// Whether a progress line is on screen right now
+pub fn is_drawing() -> bool {
+    DRAWING.load(Ordering::Relaxed) || STATUS.load(Ordering::Relaxed)
+}
+
+/// Show `text` on a status line that is redrawn in place, such as a
+/// download's progress. With a spinner running it becomes the spinner's
+/// text instead, so the two don't fight over the line.
+pub fn status(text: &str) {
+    if SPINNING.load(Ordering::Relaxed) {
+        set_message(text);
+        return;
+    }
+    STATUS.store(true, Ordering::Relaxed);
+    draw(text);
+}
+
+/// Leave the last status line on screen and move below it, or put the
+/// spinner back to its usual text
+pub fn end_status() {
+    if STATUS.swap(false, Ordering::Relaxed) {
+        eprint_line("");
+    } else if SPINNING.load(Ordering::Relaxed) {
+        set_message(SPINNER_TEXT);
+    }
+}
+
+/// Replace the progress text, e.g. to say a request is being retried, from
+/// any thread. The spinner picks it up on its next frame; a streaming line
+/// shows it until the next token arrives. Returns false when nothing is
+/// drawn, so the caller can print the message itself.
+pub fn set_message(message: &str) -> bool {
+    if is_abandoned() {
+        return true;
+    }
+    if !is_drawing() {
+        return false;
+    }
+    *MESSAGE.lock().unwrap_or_else(|e| e.into_inner()) = Some(message.to_string());
+    if !SPINNING.load(Ordering::Relaxed) {
+        draw(&message.dimmed().to_string());
+    }
+    true
+}
+
+/// `eprintln!` that also lines up while `cancel` has the terminal in raw
+/// mode, where a bare newline doesn't return to the start of the line.
+/// For messages printed from worker threads during a cancellable run.
+pub fn eprint_line(message: &str) {
+    if is_abandoned() {
+        return;
+    }
+    if crossterm::terminal::is_raw_mode_enabled().unwrap_or(false) {
+        eprint!("{}\r\n", message.replace('\n', "\r\n"));
+    } else {
+        eprintln!("{}", message);
+    }
+}
+
+fn take_message() -> Option<String> {
+    MESSAGE.lock().unwrap_or_else(|e| e.into_inner()).take()
+}
+
+/// Feedback on stderr while a command generates. On a terminal, providers
+/// that stream show the command's first line as it forms; the others get
+/// a spinner. Without a terminal nothing is drawn, so piped stderr stays
+/// clean. Everything drawn is cleared again by `finish` (or on drop).
+pub enum Progress {
+    Off,
+    Spinner {
+        stop: Arc<AtomicBool>,
+        handle: Option<JoinHandle<()>>,
+    },
+    Line {
+        text: String,
+    },
+}
+
+impl Progress {
+    /// Start showing progress; `streaming` says whether tokens will arrive
+    /// incrementally
+    pub fn start(streaming: bool) -> Self {
+        if !io::stderr().is_terminal() {
+            return Progress::Off;
+        }
+        if streaming {
+            DRAWING.store(true, Ordering::Relaxed);
+            draw(&format!("{} ▌", "▸".dimmed()));
+            return Progress::Line {
+                text: String::new(),
+            };
+        }
+
+        let stop = Arc::new(AtomicBool::new(false));
+        let flag = Arc::clone(&stop);
+        take_message();
+        DRAWING.store(true, Ordering::Relaxed);
+        SPINNING.store(true, Ordering::Relaxed);
+        let handle = thread::spawn(move || {
+            let mut text = SPINNER_TEXT.to_string();
+            for frame in SPINNER_FRAMES.iter().cycle() {
+                if flag.load(Ordering::Relaxed) {
+                    break;
+                }
+                if let Some(message) = take_message() {
+                    text = message;
+                }
+                draw(&format!("{} {}", frame, text.dimmed()));
+                thread::sleep(SPINNER_INTERVAL);
+            }
+        });
+        Progress::Spinner {
+            stop,
+            handle: Some(handle),
+        }
+    }
+
+    /// Run the first generation for a command, streaming it into the line
+    /// when that's what is shown
+    pub fn generate(
+        &mut self,
+        provider: &dyn Provider,
+        messages: &[Message],
+        max_tokens: u32,
+    ) -> Result<Generation> {
+        let Progress::Line { text } = self else {
+            return llm::generate_with_retry_meta(provider, messages, max_tokens);
+        };
+
+        let started = Instant::now();
+        let output = llm::generate_streaming(provider, messages, max_tokens, &mut |token| {
+            text.push_str(token);
+            let width = crossterm::terminal::size().map_or(80, |(w, _)| w as usize);
+            let line = truncate(first_line(text), width.saturating_sub(5));
+            draw(&format!("{} {}▌", "▸".dimmed(), line));
+        })?;
+        Ok(Generation {
+            text: output,
+            model: provider.model().to_string(),
+            prompt_tokens: None,
+            completion_tokens: None,
+            latency: started.elapsed(),
+            note: None,
+            forced: false,
+        })
+    }
+
+    /// Stop the spinner and clear the line
+    pub fn finish(&mut self) {
+        self.clear();
+        // Dropping the old value clears again, which is harmless; having
+        // `drop` call `finish` would recurse through this assignment
+        *self = Progress::Off;
+    }
+
+    fn clear(&mut self) {
+        match self {
+            Progress::Off => return,
+            Progress::Spinner { stop, handle } => {
+                stop.store(true, Ordering::Relaxed);
+                if let Some(handle) = handle.take() {
+                    let _ = handle.join();
+                }
+            }
+            Progress::Line { .. } => {}
+        }
+        draw("");
+        DRAWING.store(false, Ordering::Relaxed);
+        SPINNING.store(false, Ordering::Relaxed);
+        take_message();
+    }
+}
+
+impl Drop for Progress {
+    fn drop(&mut self) {
+        self.clear();
+    }
+}
+
+/// Redraw the current stderr line. `\r` rather than a newline, since the
+/// terminal may be in raw mode while generation runs.
+fn draw(content: &str) {
+    let mut stderr = io::stderr().lock();
+    let _ = write!(stderr, "\r\x1b[2K{}", content);
+    let _ = stderr.flush();
+}
+
+/// The command's first line as far as it has arrived: fences, blank
+/// lines and a leading `$ ` prompt are skipped so the line shows what
+/// will be extracted
+fn first_line(text: &str) -> &str {
+    text.lines()
+        .map(str::trim)
+        .find(|line| !line.is_empty() && !line.starts_with("```"))
+        .map(|line| line.strip_prefix("$ ").unwrap_or(line))
+        .unwrap_or("")
+}
+
+/// At most `width` characters of `line`, with an ellipsis when cut
+fn truncate(line: &str, width: usize) -> String {
+    if line.chars().count() <= width {
+        return line.to_string();
+    }
+    let kept: String = line.chars().take(width.saturating_sub(1)).collect();
+    format!("{}…", kept)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn first_line_skips_fences_and_prompts() {
+        assert_eq!(first_line(""), "");
+        assert_eq!(first_line("```"), "");
+        assert_eq!(first_line("```bash\n"), "");
+        assert_eq!(first_line("```bash\n$ find . -na"), "find . -na");
+        assert_eq!(first_line("\n  ls -la\necho done"), "ls -la");
+    }
+
+    #[test]
+    fn abandoned_threads_go_quiet_once_flagged() {
+        let flag = Arc::new(AtomicBool::new(false));
+        let worker = Arc::clone(&flag);
+        let (started_tx, started_rx) = std::sync::mpsc::channel();
+        let handle = thread::spawn(move || {
+            abandon_when(worker);
+            started_tx.send(is_abandoned()).unwrap();
+            while !is_abandoned() {
+                thread::sleep(Duration::from_millis(1));
+            }
+            // Swallowed, as if shown, rather than printed
+            set_message("lost the race")
+        });
+
+        assert!(!started_rx.recv().unwrap());
+        flag.store(true, Ordering::Relaxed);
+        assert!(handle.join().unwrap());
+        // Other threads aren't affected
+        assert!(!is_abandoned());
+    }
+
+    #[test]
+    fn truncate_counts_characters() {
+        assert_eq!(truncate("ls -la", 10), "ls -la");
+        assert_eq!(truncate("find . -name '*.log'", 8), "find . …");
+        assert_eq!(truncate("ééééé", 3), "éé…");
+    }
+}
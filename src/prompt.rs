@@ -1,6 +1,17 @@
 use std::env;
-use std::process::Command;
+use std::fs;
+use std::io::Read;
+use std::path::Path;
+use std::process::{Command, Stdio};
 use std::sync::OnceLock;
+use std::thread;
+use std::time::{Duration, Instant};
+
+use anyhow::{anyhow, Result};
+use serde::Deserialize;
+
+use crate::config::Example;
+use crate::progress;
 
 /// System context information for prompt generation
 #[derive(Clone)]
@@ -10,22 +21,179 @@ pub struct SystemContext {
     pub shell: String,
     pub working_dir: String,
     pub available_tools: Vec<String>,
+    /// Extra rules for the command prompt, e.g. which coreutils flavour to use
+    pub hints: Vec<String>,
+    /// Worked examples for the command prompt (`prompt.examples`)
+    pub examples: Vec<Example>,
+    /// User template replacing the built-in command prompt
+    pub template: Option<String>,
 }
 
 static TOOL_CACHE: OnceLock<Vec<String>> = OnceLock::new();
+static PINNED_CONTEXT: OnceLock<PinnedContext> = OnceLock::new();
+
+/// A context file (`--context-file`): JSON pinning what the model is told
+/// about the machine, so a prompt can be reproduced elsewhere. Fields left
+/// out are detected as usual.
+#[derive(Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct PinnedContext {
+    pub os: Option<String>,
+    pub arch: Option<String>,
+    pub shell: Option<String>,
+    #[serde(alias = "working_dir")]
+    pub cwd: Option<String>,
+    #[serde(alias = "available_tools")]
+    pub tools: Option<Vec<String>>,
+}
 
-/// Gather system context (OS, shell, cwd, available tools)
+/// Use the context in `path` instead of detecting it, for the rest of the
+/// process. Must be called before the context is first gathered.
+pub fn load_context_file(path: &Path) -> Result<()> {
+    let text = fs::read_to_string(path)
+        .map_err(|e| anyhow!("Failed to read context file {}: {}", path.display(), e))?;
+    let pinned: PinnedContext = serde_json::from_str(&text)
+        .map_err(|e| anyhow!("Bad context file {}: {}", path.display(), e))?;
+    let _ = PINNED_CONTEXT.set(pinned);
+    Ok(())
+}
+
+/// Gather system context (OS, shell, cwd, available tools), or take it
+/// from the context file
 pub fn gather_context() -> SystemContext {
+    match PINNED_CONTEXT.get() {
+        Some(pinned) => context_from(pinned),
+        None => context_from(&PinnedContext::default()),
+    }
+}
+
+/// The pinned fields, with the rest detected. Tools are only probed for
+/// when the file doesn't list them.
+pub fn context_from(pinned: &PinnedContext) -> SystemContext {
     SystemContext {
-        os: std::env::consts::OS.to_string(),
-        arch: std::env::consts::ARCH.to_string(),
-        shell: detect_shell(),
-        working_dir: env::current_dir()
-            .map(|p| p.display().to_string())
-            .unwrap_or_else(|_| "unknown".into()),
-        available_tools: TOOL_CACHE.get_or_init(detect_tools).clone(),
+        os: pinned
+            .os
+            .clone()
+            .unwrap_or_else(|| std::env::consts::OS.to_string()),
+        arch: pinned
+            .arch
+            .clone()
+            .unwrap_or_else(|| std::env::consts::ARCH.to_string()),
+        shell: pinned.shell.clone().unwrap_or_else(detect_shell),
+        working_dir: pinned.cwd.clone().unwrap_or_else(|| {
+            env::current_dir()
+                .map(|p| p.display().to_string())
+                .unwrap_or_else(|_| "unknown".into())
+        }),
+        available_tools: pinned
+            .tools
+            .clone()
+            .unwrap_or_else(|| TOOL_CACHE.get_or_init(detect_tools).clone()),
+        hints: Vec::new(),
+        examples: Vec::new(),
+        template: None,
+    }
+}
+/// Keep only the detected tools that appear in `allowed`. An empty
+/// allowlist leaves the context untouched.
+pub fn restrict_tools(ctx: &mut SystemContext, allowed: &[String]) {
+    if allowed.is_empty() {
+        return;
     }
+    ctx.available_tools
+        .retain(|tool| allowed.iter().any(|a| a == tool));
+}
+
+/// The `max` tools most likely to matter for `query`: the ones it names,
+/// then the ones a hint names (`--using`), then the rest in detected order
+pub fn rank_tools(tools: &[String], query: &str, hints: &[String], max: usize) -> Vec<String> {
+    let words: Vec<&str> = query
+        .split(|c: char| !(c.is_alphanumeric() || "-_.+".contains(c)))
+        .map(|w| w.trim_matches('.'))
+        .filter(|w| !w.is_empty())
+        .collect();
+    let mut ranked: Vec<(u8, &String)> = tools
+        .iter()
+        .map(|tool| {
+            let rank = if words.iter().any(|w| w.eq_ignore_ascii_case(tool)) {
+                0
+            } else if hints.iter().any(|h| h.contains(&format!("`{}`", tool))) {
+                1
+            } else {
+                2
+            };
+            (rank, tool)
+        })
+        .collect();
+    ranked.sort_by_key(|(rank, _)| *rank);
+    ranked
+        .into_iter()
+        .take(max)
+        .map(|(_, tool)| tool.clone())
+        .collect()
 }
+
+/// Ask the model to reach for `tool` when it fits (`--using`), listing it
+/// among the available tools if it's installed but wasn't detected.
+/// Returns false when it isn't installed; the preference is added anyway.
+pub fn prefer_tool(ctx: &mut SystemContext, tool: &str) -> bool {
+    let tool = tool.trim();
+    let listed = ctx.available_tools.iter().any(|t| t == tool);
+    let installed = listed || which(tool);
+    if installed && !listed {
+        ctx.available_tools.push(tool.to_string());
+    }
+    ctx.hints
+        .push(format!("Prefer using `{}` for this if it applies.", tool));
+    installed
+}
+
+/// GNU tools Homebrew installs with a `g` prefix
+const GNU_PREFIXED: &[&str] = &["gls", "gdate", "gstat", "gcp", "gsed", "gfind", "gxargs"];
+
+/// Where Homebrew keeps coreutils on Apple Silicon and Intel Macs
+const HOMEBREW_COREUTILS: &[&str] = &["/opt/homebrew/opt/coreutils", "/usr/local/opt/coreutils"];
+
+/// On macOS with Homebrew's GNU coreutils, tell the model to write GNU-style
+/// commands instead of BSD ones (`prompt.gnu_coreutils`). No-op elsewhere.
+pub fn prefer_gnu_coreutils(ctx: &mut SystemContext) {
+    if ctx.os != "macos" {
+        return;
+    }
+    let installed = HOMEBREW_COREUTILS
+        .iter()
+        .any(|dir| std::path::Path::new(dir).is_dir());
+    let gnubin_on_path = env::var("PATH")
+        .is_ok_and(|path| env::split_paths(&path).any(|dir| dir.ends_with("libexec/gnubin")));
+    let prefixed: Vec<&str> = if installed || gnubin_on_path {
+        GNU_PREFIXED.iter().copied().filter(|t| which(t)).collect()
+    } else {
+        Vec::new()
+    };
+
+    if let Some(hint) = gnu_hint(gnubin_on_path, &prefixed) {
+        ctx.hints.push(hint);
+    }
+}
+
+fn gnu_hint(gnubin_on_path: bool, prefixed: &[&str]) -> Option<String> {
+    if gnubin_on_path {
+        return Some(
+            "GNU coreutils come first on PATH on this Mac: use GNU flags \
+             (e.g. `date -d`, `stat -c`, `ls --color`), not BSD ones."
+                .to_string(),
+        );
+    }
+    if prefixed.is_empty() {
+        return None;
+    }
+    Some(format!(
+        "GNU tools are installed with a g prefix ({}): prefer them with GNU flags \
+         over the BSD versions.",
+        prefixed.join(", ")
+    ))
+}
+
 /// Build the system prompt for the chat assistant
 pub fn chat_system_prompt(ctx: &SystemContext) -> String {
     format!(
@@ -54,6 +222,106 @@ RULES:
     )
 }
 
+/// Build the system prompt for one-shot command generation
+pub fn cmd_system_prompt(ctx: &SystemContext) -> String {
+    if let Some(template) = &ctx.template {
+        return render_template(template, ctx);
+    }
+    format!(
+        r#"You are Niko, a shell command generator running directly in the user's terminal.
+Translate the user's request into a single shell command for their system.
+
+CURRENT SYSTEM CONTEXT:
+- OS: {os}
+- Architecture: {arch}
+- Shell: {shell}
+- Working Directory: {cwd}
+- Available Tools on PATH: {tools}
+
+RULES:
+1. Output ONLY the command — no explanation, no markdown, no leading `$`.
+2. Use syntax and flags that work on {os} with {shell}.
+3. Prefer the listed available tools if applicable to the request.
+4. Chain steps with && or pipes rather than emitting multiple lines.
+5. If file paths are given, assume they are relative to the working directory.{hints}{examples}"#,
+        os = ctx.os,
+        arch = ctx.arch,
+        shell = ctx.shell,
+        cwd = ctx.working_dir,
+        tools = ctx.available_tools.join(", "),
+        hints = extra_rules(&ctx.hints, 6),
+        examples = render_examples(&ctx.examples),
+    )
+}
+
+fn render_examples(examples: &[Example]) -> String {
+    if examples.is_empty() {
+        return String::new();
+    }
+    let mut out = String::from("\n\nEXAMPLES:");
+    for example in examples {
+        out.push_str(&format!(
+            "\nRequest: {}\nCommand: {}",
+            example.query, example.command
+        ));
+    }
+    out
+}
+
+/// Fill in a user template. Hints and examples aren't placeholders; they
+/// follow the template, since it can't know how many there will be.
+fn render_template(template: &str, ctx: &SystemContext) -> String {
+    let mut prompt = template
+        .replace("{os}", &ctx.os)
+        .replace("{arch}", &ctx.arch)
+        .replace("{shell}", &ctx.shell)
+        .replace("{cwd}", &ctx.working_dir)
+        .replace("{tools}", &ctx.available_tools.join(", "));
+    for hint in &ctx.hints {
+        prompt.push_str(&format!("\n- {}", hint));
+    }
+    prompt.push_str(&render_examples(&ctx.examples));
+    prompt
+}
+
+/// `ctx.hints` as rules numbered from `first`, each on its own line
+fn extra_rules(hints: &[String], first: usize) -> String {
+    hints
+        .iter()
+        .enumerate()
+        .map(|(i, hint)| format!("\n{}. {}", first + i, hint))
+        .collect()
+}
+
+/// Build the system prompt for `--what-if`: consequences, not commands
+pub fn what_if_system_prompt(ctx: &SystemContext) -> String {
+    format!(
+        r#"You are Niko, reviewing a shell command before the user decides whether to run it.
+Do not run it and do not suggest running it. Explain in plain language what would happen if it ran on {os} with {shell} in {cwd}.
+
+Answer in at most 5 short bullet points covering:
+- which files, data or resources it changes or deletes
+- whether that can be undone, and how
+- anything to check first, or a safer alternative if there is an obvious one"#,
+        os = ctx.os,
+        shell = ctx.shell,
+        cwd = ctx.working_dir,
+    )
+}
+
+/// Build the system prompt for `niko describe`: one terse phrase per command
+pub fn describe_system_prompt(ctx: &SystemContext) -> String {
+    format!(
+        r#"You summarize shell commands for changelogs and commit messages.
+Reply with ONE line: a short imperative phrase (under 12 words) saying what the command does, as it would run on {os} with {shell}.
+No quotes, no markdown, no trailing period, no explanation.
+
+Example: `find . -name '*.pyc' -delete` -> Delete compiled Python files under the current directory"#,
+        os = ctx.os,
+        shell = ctx.shell,
+    )
+}
+
 fn detect_shell() -> String {
     if cfg!(target_os = "windows") {
         if Command::new("pwsh").arg("--version").output().is_ok() {
@@ -172,6 +440,87 @@ pub fn which(tool: &str) -> bool {
         .unwrap_or(false)
 }
 
+/// How long `shell_defines` waits for the shell and its startup files
+const SHELL_PROBE_TIMEOUT: Duration = Duration::from_secs(2);
+
+/// Prints each argument the shell knows as a command of any kind
+const SHELL_PROBE: &str =
+    r#"for t in "$@"; do type "$t" >/dev/null 2>&1 && printf '%s\n' "$t"; done"#;
+
+/// Which of `names` the user's interactive bash or zsh (`$SHELL`) defines,
+/// functions and aliases from their startup files included. Other shells,
+/// a shell that fails or one slower than `SHELL_PROBE_TIMEOUT` define none.
+/// The shell runs in a session of its own, without a controlling terminal:
+/// an interactive shell would otherwise make itself the terminal's
+/// foreground job, and if killed on the timeout leave niko in the
+/// background, stopped by SIGTTIN at its next prompt.
+pub fn shell_defines(names: &[String]) -> Vec<String> {
+    let Some(shell) = env::var("SHELL")
+        .ok()
+        .filter(|s| matches!(s.rsplit('/').next(), Some("bash" | "zsh")))
+    else {
+        return Vec::new();
+    };
+
+    let mut probe = Command::new(&shell);
+    probe
+        .args(["-ic", SHELL_PROBE, "niko"])
+        .args(names)
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::null());
+    #[cfg(unix)]
+    {
+        use std::os::unix::process::CommandExt;
+        extern "C" {
+            fn setsid() -> i32;
+        }
+        // SAFETY: setsid is async-signal-safe and touches no memory
+        unsafe {
+            probe.pre_exec(|| {
+                if setsid() < 0 {
+                    return Err(std::io::Error::last_os_error());
+                }
+                Ok(())
+            });
+        }
+    }
+    let child = probe.spawn();
+    let Ok(mut child) = child else {
+        return Vec::new();
+    };
+
+    let deadline = Instant::now() + SHELL_PROBE_TIMEOUT;
+    loop {
+        match child.try_wait() {
+            Ok(Some(_)) => break,
+            Ok(None) if Instant::now() < deadline => thread::sleep(Duration::from_millis(20)),
+            _ => {
+                let _ = child.kill();
+                let _ = child.wait();
+                return Vec::new();
+            }
+        }
+    }
+
+    let mut output = String::new();
+    if let Some(mut stdout) = child.stdout.take() {
+        let _ = stdout.read_to_string(&mut output);
+    }
+    probed_names(&output, names)
+}
+
+/// The lines of the probe's output that are one of `names`; anything else
+/// is noise from the user's startup files
+fn probed_names(output: &str, names: &[String]) -> Vec<String> {
+    output
+        .lines()
+        .map(str::trim)
+        .filter(|line| names.iter().any(|n| n == line))
+        .map(String::from)
+        .collect()
+}
+
 // ---------------------------------------------------------------------------
 // Tool Help Discovery
 // ---------------------------------------------------------------------------
@@ -250,12 +599,12 @@ pub fn discover_tool_help(query: &str, verbose: bool) -> String {
             if !seen_tools.contains(&key) && which(&base) {
                 if let Some(help_text) = get_subcommand_help(&base, &sub) {
                     if verbose {
-                        eprintln!(
+                        progress::eprint_line(&format!(
                             "  [help] captured `{} {} --help` ({} chars)",
                             base,
                             sub,
                             help_text.len()
-                        );
+                        ));
                     }
                     help_sections
                         .push(format!("TOOL REFERENCE: `{} {}`\n{}", base, sub, help_text));
@@ -282,11 +631,11 @@ pub fn discover_tool_help(query: &str, verbose: bool) -> String {
         if which(&tool) {
             if let Some(help_text) = get_tool_help(&tool) {
                 if verbose {
-                    eprintln!(
+                    progress::eprint_line(&format!(
                         "  [help] captured `{} --help` ({} chars)",
                         tool,
                         help_text.len()
-                    );
+                    ));
                 }
                 help_sections.push(format!("TOOL REFERENCE: `{}`\n{}", tool, help_text));
                 seen_tools.insert(tool);
@@ -388,3 +737,113 @@ fn truncate_help(text: &str) -> String {
         format!("{}\n[...truncated]", truncated)
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn probe_output_keeps_only_the_names_asked_about() {
+        let names = vec!["gco".to_string(), "mkcd".to_string(), "nope".to_string()];
+        let output = "Welcome back!\nmkcd\n  gco \ngco is an alias for git checkout\n";
+        assert_eq!(probed_names(output, &names), vec!["mkcd", "gco"]);
+        assert!(probed_names("", &names).is_empty());
+    }
+
+    #[test]
+    fn pinned_context_overrides_what_it_names() {
+        let pinned: PinnedContext = serde_json::from_str(
+            r#"{"os": "linux", "shell": "zsh", "cwd": "/srv/app", "tools": ["rg", "jq"]}"#,
+        )
+        .unwrap();
+        let ctx = context_from(&pinned);
+        assert_eq!(ctx.os, "linux");
+        assert_eq!(ctx.shell, "zsh");
+        assert_eq!(ctx.working_dir, "/srv/app");
+        assert_eq!(ctx.available_tools, ["rg", "jq"]);
+        assert_eq!(ctx.arch, std::env::consts::ARCH);
+
+        assert!(serde_json::from_str::<PinnedContext>(r#"{"platform": "linux"}"#).is_err());
+    }
+
+    #[test]
+    fn gnu_hint_depends_on_how_coreutils_are_installed() {
+        assert!(gnu_hint(true, &[]).unwrap().contains("GNU flags"));
+        assert!(gnu_hint(false, &["gls", "gsed"])
+            .unwrap()
+            .contains("gls, gsed"));
+        assert_eq!(gnu_hint(false, &[]), None);
+    }
+
+    #[test]
+    fn ranked_tools_put_the_named_ones_first() {
+        let tools: Vec<String> = ["git", "docker", "rg", "fd", "jq", "kubectl"]
+            .iter()
+            .map(|t| t.to_string())
+            .collect();
+        let hints = vec!["Prefer using `fd` for this if it applies.".to_string()];
+
+        assert_eq!(
+            rank_tools(
+                &tools,
+                "pretty-print with jq, then commit to Git.",
+                &hints,
+                4
+            ),
+            ["git", "jq", "fd", "docker"]
+        );
+        assert_eq!(rank_tools(&tools, "list files", &[], 2), ["git", "docker"]);
+        assert_eq!(rank_tools(&tools, "list files", &[], 10).len(), 6);
+    }
+
+    #[test]
+    fn preferred_tool_becomes_a_hint_and_is_checked() {
+        let mut ctx = gather_context();
+        ctx.available_tools = vec!["fd".into()];
+        ctx.hints.clear();
+
+        assert!(prefer_tool(&mut ctx, "fd"));
+        assert!(!prefer_tool(&mut ctx, "no-such-tool-niko"));
+        assert_eq!(ctx.available_tools, vec!["fd"]);
+        assert_eq!(
+            ctx.hints,
+            vec![
+                "Prefer using `fd` for this if it applies.",
+                "Prefer using `no-such-tool-niko` for this if it applies."
+            ]
+        );
+    }
+
+    #[test]
+    fn hints_become_numbered_rules() {
+        let mut ctx = gather_context();
+        ctx.hints = vec!["First hint.".into(), "Second hint.".into()];
+        let prompt = cmd_system_prompt(&ctx);
+        assert!(prompt.ends_with("directory.\n6. First hint.\n7. Second hint."));
+    }
+
+    #[test]
+    fn examples_follow_the_rules() {
+        let mut ctx = gather_context();
+        ctx.examples = vec![Example {
+            query: "tail the app log".into(),
+            command: "tail -f /var/log/app.log".into(),
+        }];
+        let prompt = cmd_system_prompt(&ctx);
+        assert!(prompt.ends_with(
+            "directory.\n\nEXAMPLES:\nRequest: tail the app log\nCommand: tail -f /var/log/app.log"
+        ));
+    }
+
+    #[test]
+    fn templates_replace_the_built_in_prompt() {
+        let mut ctx = gather_context();
+        ctx.shell = "zsh".into();
+        ctx.hints = vec!["Use GNU flags.".into()];
+        ctx.template = Some("Only output a {shell} command.".into());
+        assert_eq!(
+            cmd_system_prompt(&ctx),
+            "Only output a zsh command.\n- Use GNU flags."
+        );
+    }
+}
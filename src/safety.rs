@@ -0,0 +1,807 @@
+use std::collections::HashMap;
+use std::fmt;
+use std::fs;
+use std::path::Path;
+use std::sync::{Mutex, OnceLock};
+
+use anyhow::{bail, Context, Result};
+use regex::Regex;
+use serde::{Deserialize, Serialize};
+
+use crate::config;
+use crate::hooks;
+
+/// How risky a generated command is to run
+#[derive(
+    Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash, Default, Serialize, Deserialize,
+)]
+#[serde(rename_all = "lowercase")]
+pub enum RiskLevel {
+    #[default]
+    Safe,
+    Moderate,
+    Dangerous,
+    Critical,
+}
+
+impl RiskLevel {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            RiskLevel::Safe => "safe",
+            RiskLevel::Moderate => "moderate",
+            RiskLevel::Dangerous => "dangerous",
+            RiskLevel::Critical => "critical",
+        }
+    }
+}
+
+impl fmt::Display for RiskLevel {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
+
+/// Result of assessing a command
+#[derive(Debug, Clone)]
+pub struct Assessment {
+    pub level: RiskLevel,
+    /// Why the command got its level (only reasons at the final level)
+    pub reasons: Vec<String>,
+    /// Matched an entry in `safety.blocked_commands` — never run it
+    pub blocked: bool,
+}
+
+/// Git commands that throw away changes to tracked files
+const GIT_DISCARDS_CHANGES: &str = r"\bgit\s+reset\s+--hard\b|\bgit\s+(checkout|restore)\s+(--\s+)?\.(\s|$|[;&|])|\bgit\s+checkout\s+(-f|--force)\b";
+
+/// Git commands that delete untracked files
+const GIT_DELETES_UNTRACKED: &str = r"\bgit\s+clean\s+-[a-zA-Z]*f";
+
+/// (pattern, level, reason) — checked in order, highest level wins
+const PATTERNS: &[(&str, RiskLevel, &str)] = &[
+    // Critical — irreversible damage to the system
+    (
+        r"\brm\s+-[a-zA-Z]*[rRf][a-zA-Z]*\s+(/|/\*|~/?|\$HOME/?)(\s|$)",
+        RiskLevel::Critical,
+        "recursively deletes the root or home directory",
+    ),
+    (
+        r"\bmkfs(\.\w+)?\b",
+        RiskLevel::Critical,
+        "formats a filesystem",
+    ),
+    (
+        r"\bdd\b.*\bof=/dev/",
+        RiskLevel::Critical,
+        "writes directly to a block device",
+    ),
+    (
+        r">\s*/dev/(sd|hd|nvme|disk)",
+        RiskLevel::Critical,
+        "overwrites a disk device",
+    ),
+    (
+        r":\(\)\s*\{\s*:\|:&\s*\};\s*:",
+        RiskLevel::Critical,
+        "fork bomb",
+    ),
+    (
+        r"\bchmod\s+-R\s+777\s+/(\s|$)",
+        RiskLevel::Critical,
+        "makes the whole filesystem world-writable",
+    ),
+    // Dangerous — destructive or privileged, but scoped
+    (
+        r"\brm\s+-[a-zA-Z]*[rR]",
+        RiskLevel::Dangerous,
+        "recursively deletes files",
+    ),
+    (
+        r"\bsudo\b",
+        RiskLevel::Dangerous,
+        "runs with root privileges",
+    ),
+    (
+        GIT_DISCARDS_CHANGES,
+        RiskLevel::Dangerous,
+        "discards uncommitted git changes",
+    ),
+    (
+        GIT_DELETES_UNTRACKED,
+        RiskLevel::Dangerous,
+        "deletes untracked files",
+    ),
+    (
+        r"\bgit\s+push\b.*(--force\b|\s-f\b)",
+        RiskLevel::Dangerous,
+        "rewrites remote git history",
+    ),
+    (
+        r"\b(shutdown|reboot|halt|poweroff)\b",
+        RiskLevel::Dangerous,
+        "shuts down or restarts the machine",
+    ),
+    (
+        r"\b(kill|killall)\s+-9\b|\bpkill\b",
+        RiskLevel::Dangerous,
+        "force-kills processes",
+    ),
+    (
+        r"\b(curl|wget)\b[^|]*\|\s*(sudo\s+)?(sh|bash|zsh)\b",
+        RiskLevel::Dangerous,
+        "pipes a download straight into a shell",
+    ),
+    (
+        r"\bch(mod|own)\s+-R\b",
+        RiskLevel::Dangerous,
+        "recursively changes permissions or ownership",
+    ),
+    (r"\btruncate\b", RiskLevel::Dangerous, "truncates files"),
+    (
+        r"\bdocker\s+system\s+prune\b|\bkubectl\s+delete\b",
+        RiskLevel::Dangerous,
+        "deletes containers or cluster resources",
+    ),
+    (
+        r#"(>>?\s*|\btee\s+((-a|--append)\s+)?|\bsed\s+-i[^|;&]*\s)["']?([^\s"'|;&]*/)?(\.(bashrc|bash_profile|bash_login|zshrc|zprofile|zshenv|zlogin|profile)|etc/(profile(\.d/\S+)?|bash\.bashrc|zsh/zshrc|zshrc|environment)|\.config/fish/(config\.fish|conf\.d/\S+))(["'\s;|&)]|$)"#,
+        RiskLevel::Dangerous,
+        "changes a shell startup file, persistently altering your environment",
+    ),
+    (
+        r#"\b(cp|mv|ln|install)\s[^|;&]*\s["']?([^\s"'|;&]*/)?(\.(bashrc|bash_profile|bash_login|zshrc|zprofile|zshenv|zlogin|profile)|etc/(profile(\.d/\S+)?|bash\.bashrc|zsh/zshrc|zshrc|environment)|\.config/fish/(config\.fish|conf\.d/\S+))["']?\s*($|[;&|)])"#,
+        RiskLevel::Dangerous,
+        "changes a shell startup file, persistently altering your environment",
+    ),
+    // Moderate — modifies state in a recoverable way
+    (
+        r"\b(rm|rmdir|unlink)\b",
+        RiskLevel::Moderate,
+        "deletes files",
+    ),
+    (r"\bmv\b", RiskLevel::Moderate, "moves or renames files"),
+    (r"\bsed\s+-i", RiskLevel::Moderate, "edits files in place"),
+    (
+        r"(^|\s)>>?\s*[^&\s]",
+        RiskLevel::Moderate,
+        "redirects output into a file",
+    ),
+    (
+        r"\b(npm|pnpm|yarn|pip3?|cargo|brew|gem)\s+(install|add|uninstall|remove)\b",
+        RiskLevel::Moderate,
+        "installs or removes packages",
+    ),
+    (
+        r"\b(apt|apt-get|dnf|yum|pacman)\s+\S",
+        RiskLevel::Moderate,
+        "uses the system package manager",
+    ),
+    (
+        r"\bgit\s+(commit|push|merge|rebase|checkout|stash|rm)\b",
+        RiskLevel::Moderate,
+        "changes git state",
+    ),
+    (
+        r"\bdocker\s+(rm|rmi|stop|kill)\b|\bkubectl\s+(apply|scale|rollout)\b",
+        RiskLevel::Moderate,
+        "changes containers or cluster resources",
+    ),
+    (
+        r"\b(chmod|chown|kill)\b",
+        RiskLevel::Moderate,
+        "changes permissions or processes",
+    ),
+];
+
+fn compiled_patterns() -> &'static Vec<(Regex, RiskLevel, &'static str)> {
+    static COMPILED: OnceLock<Vec<(Regex, RiskLevel, &'static str)>> = OnceLock::new();
+    COMPILED.get_or_init(|| {
+        PATTERNS
+            .iter()
+            .map(|(pattern, level, reason)| {
+                (
+                    Regex::new(pattern).expect("invalid safety pattern"),
+                    *level,
+                    *reason,
+                )
+            })
+            .collect()
+    })
+}
+
+/// Decides how risky a command is. Everything that asks (`assess`) goes
+/// through one registered assessor: the built-in patterns unless
+/// `set_assessor` installed another, wrapped by `hooks.assess` when that
+/// is configured.
+pub trait RiskAssessor: Send + Sync {
+    fn assess(&self, command: &str) -> Assessment;
+}
+
+/// The built-in patterns plus a block list
+pub struct PatternAssessor {
+    pub blocked_commands: Vec<String>,
+}
+
+impl RiskAssessor for PatternAssessor {
+    fn assess(&self, command: &str) -> Assessment {
+        assess_with(command, &self.blocked_commands)
+    }
+}
+
+/// `hooks.assess`: asks an external program (a policy service client, say)
+/// about each command, on top of `inner`. The program can only make an
+/// assessment stricter, and one that fails makes the command at least
+/// dangerous rather than letting it through unchecked.
+pub struct HookAssessor {
+    pub program: String,
+    pub inner: Box<dyn RiskAssessor>,
+    /// A command is assessed several times on its way to running
+    seen: Mutex<HashMap<String, Assessment>>,
+}
+
+impl HookAssessor {
+    pub fn new(program: &str, inner: Box<dyn RiskAssessor>) -> Self {
+        HookAssessor {
+            program: program.to_string(),
+            inner,
+            seen: Mutex::new(HashMap::new()),
+        }
+    }
+}
+
+impl RiskAssessor for HookAssessor {
+    fn assess(&self, command: &str) -> Assessment {
+        let seen = || self.seen.lock().unwrap_or_else(|e| e.into_inner());
+        if let Some(assessment) = seen().get(command) {
+            return assessment.clone();
+        }
+        // Not under the lock: other threads' commands needn't wait on this hook
+        let base = self.inner.assess(command);
+        let assessment = match hooks::assess(&self.program, command) {
+            Ok(Some((level, reasons))) => stricter(base, level, reasons),
+            Ok(None) => base,
+            Err(e) => stricter(
+                base,
+                RiskLevel::Dangerous,
+                vec![format!("hooks.assess failed: {:#}", e)],
+            ),
+        };
+        seen().insert(command.to_string(), assessment.clone());
+        assessment
+    }
+}
+
+/// `base`, raised to `level` with `reasons` if that's higher; at the same
+/// level the reasons are added
+fn stricter(mut base: Assessment, level: RiskLevel, reasons: Vec<String>) -> Assessment {
+    if level > base.level {
+        base.level = level;
+        base.reasons.clear();
+    }
+    if level == base.level && level != RiskLevel::Safe {
+        for reason in reasons {
+            if !base.reasons.contains(&reason) {
+                base.reasons.push(reason);
+            }
+        }
+    }
+    base
+}
+
+static ASSESSOR: OnceLock<Box<dyn RiskAssessor>> = OnceLock::new();
+
+/// Assess with `assessor` from now on, e.g. when embedding niko with a
+/// team's own policy. It must be set before the first assessment; returns
+/// false (and changes nothing) once one is in use. `hooks.assess` is not
+/// applied on top of it.
+#[allow(dead_code)] // The niko binary itself only uses `hooks.assess`
+pub fn set_assessor(assessor: Box<dyn RiskAssessor>) -> bool {
+    ASSESSOR.set(assessor).is_ok()
+}
+
+fn assessor() -> &'static dyn RiskAssessor {
+    ASSESSOR
+        .get_or_init(|| {
+            let cfg = config::get();
+            let patterns = Box::new(PatternAssessor {
+                blocked_commands: cfg.safety.blocked_commands.clone(),
+            });
+            match cfg.hooks.assess.trim() {
+                "" => patterns,
+                program => Box::new(HookAssessor::new(program, patterns)),
+            }
+        })
+        .as_ref()
+}
+
+/// Assess a command with the registered assessor: by default the built-in
+/// patterns and the configured `safety.blocked_commands`
+pub fn assess(command: &str) -> Assessment {
+    assessor().assess(command)
+}
+
+/// Assess a command against the built-in patterns and an explicit block list
+pub fn assess_with(command: &str, blocked_commands: &[String]) -> Assessment {
+    let mut level = RiskLevel::Safe;
+    let mut reasons: Vec<String> = Vec::new();
+
+    let mut raise = |found: RiskLevel, reason: String| {
+        if found > level {
+            level = found;
+            reasons.clear();
+        }
+        if found == level && found != RiskLevel::Safe && !reasons.contains(&reason) {
+            reasons.push(reason);
+        }
+    };
+
+    let mut is_blocked = false;
+    let lowered = command.to_lowercase();
+    for blocked in blocked_commands {
+        if !blocked.is_empty() && lowered.contains(&blocked.to_lowercase()) {
+            is_blocked = true;
+            raise(
+                RiskLevel::Critical,
+                format!("matches blocked command '{}'", blocked),
+            );
+        }
+    }
+
+    for (re, found, reason) in compiled_patterns() {
+        if re.is_match(command) {
+            raise(*found, reason.to_string());
+        }
+    }
+
+    Assessment {
+        level,
+        reasons,
+        blocked: is_blocked,
+    }
+}
+
+/// Tools that delete or move away the paths they're given
+const DESTRUCTIVE_TOOLS: &[&str] = &["rm", "rmdir", "unlink", "shred", "mv"];
+
+/// Relative paths that a destructive command names but that don't exist
+/// under `dir`. `rm -rf build` run outside the project root is the case
+/// this catches: harmless if nothing matches, but a sign the command may
+/// be aimed at the wrong place. Absolute, home-relative and glob paths are
+/// left alone, as is `mv`'s destination.
+pub fn missing_paths(command: &str, dir: &Path) -> Vec<String> {
+    let mut missing = Vec::new();
+    for segment in command.split(['&', '|', ';', '\n']) {
+        let words: Vec<&str> = segment.split_whitespace().collect();
+        let words = match words.split_first() {
+            Some((&"sudo", rest)) => rest,
+            _ => &words[..],
+        };
+        let Some((tool, args)) = words.split_first() else {
+            continue;
+        };
+        if !DESTRUCTIVE_TOOLS.contains(tool) {
+            continue;
+        }
+
+        let mut paths: Vec<&str> = args
+            .iter()
+            .copied()
+            .filter(|a| !a.starts_with('-'))
+            .collect();
+        if *tool == "mv" {
+            paths.pop();
+        }
+        for path in paths {
+            let path = path
+                .strip_prefix(['\'', '"'])
+                .and_then(|p| p.strip_suffix(['\'', '"']))
+                .unwrap_or(path);
+            if path.is_empty()
+                || path.starts_with(['/', '~'])
+                || path.contains(['*', '?', '[', '{', '$', '`', '\'', '"'])
+            {
+                continue;
+            }
+            // symlink_metadata, so a dangling link still counts as there
+            if fs::symlink_metadata(dir.join(path)).is_err() && !missing.iter().any(|m| m == path) {
+                missing.push(path.to_string());
+            }
+        }
+    }
+    missing
+}
+
+/// What a git command throws away that no commit protects
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum GitLoss {
+    /// Changes to tracked files (`reset --hard`, `checkout .`)
+    Changes,
+    /// Untracked files (`clean -f`)
+    Untracked,
+}
+
+/// Whether `command` discards uncommitted git work, and which kind
+pub fn git_loss(command: &str) -> Option<GitLoss> {
+    static CHANGES: OnceLock<Regex> = OnceLock::new();
+    static UNTRACKED: OnceLock<Regex> = OnceLock::new();
+    let changes = CHANGES.get_or_init(|| Regex::new(GIT_DISCARDS_CHANGES).unwrap());
+    let untracked = UNTRACKED.get_or_init(|| Regex::new(GIT_DELETES_UNTRACKED).unwrap());
+    if changes.is_match(command) {
+        Some(GitLoss::Changes)
+    } else if untracked.is_match(command) {
+        Some(GitLoss::Untracked)
+    } else {
+        None
+    }
+}
+
+/// A hint for each package install in `command` that changes global state,
+/// naming the project- or user-scoped alternative. `pip` installs only
+/// count outside a virtualenv (`in_venv`), and ones that are already
+/// user-scoped or aimed at a target or prefix directory are left alone.
+pub fn global_install_hints(command: &str, in_venv: bool) -> Vec<String> {
+    let mut hints = Vec::new();
+    for segment in command.split(['&', '|', ';', '\n']) {
+        let words: Vec<&str> = segment.split_whitespace().collect();
+        let words = match words.split_first() {
+            Some((&"sudo", rest)) => rest,
+            _ => &words[..],
+        };
+        let (tool, args) = match words {
+            [python, "-m", "pip", rest @ ..] if python.starts_with("python") => ("pip", rest),
+            [tool, rest @ ..] => (*tool, rest),
+            [] => continue,
+        };
+        let has = |flags: &[&str]| args.iter().any(|a| flags.contains(a));
+        let sub = args.first().copied();
+
+        let hint = match tool {
+            "npm" | "pnpm"
+                if matches!(sub, Some("install" | "i" | "add")) && has(&["-g", "--global"]) =>
+            {
+                Some(format!(
+                    "`{} {} -g` changes global packages; drop -g to install into this \
+                     project, or run one-off tools with npx",
+                    tool,
+                    sub.unwrap_or("install")
+                ))
+            }
+            "yarn" if sub == Some("global") && args.get(1) == Some(&"add") => Some(
+                "`yarn global add` changes global packages; `yarn add` installs into this \
+                 project, `yarn dlx` runs a tool once"
+                    .to_string(),
+            ),
+            "pip" | "pip3"
+                if sub == Some("install")
+                    && !in_venv
+                    && !has(&["--user", "-t", "--target", "--prefix", "--root"]) =>
+            {
+                Some(
+                    "`pip install` outside a virtualenv changes the system Python; create \
+                     one first (`python3 -m venv .venv && . .venv/bin/activate`), or use \
+                     pipx for command-line tools"
+                        .to_string(),
+                )
+            }
+            "gem" if sub == Some("install") && !has(&["--user-install", "-i", "--install-dir"]) => {
+                Some(
+                    "`gem install` changes the system gems; add --user-install, or list it \
+                     in a Gemfile and run `bundle install`"
+                        .to_string(),
+                )
+            }
+            _ => None,
+        };
+        if let Some(hint) = hint {
+            if !hints.contains(&hint) {
+                hints.push(hint);
+            }
+        }
+    }
+    hints
+}
+
+/// A generated command after the `safety.strip_sudo` / `safety.rewrite`
+/// policy, with a note for each change so the user knows it was altered
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Rewritten {
+    pub command: String,
+    pub notes: Vec<String>,
+}
+
+/// Apply the configured rewrite policy to a generated command
+pub fn rewrite(command: &str) -> Result<Rewritten> {
+    let cfg = &config::get().safety;
+    rewrite_with(command, cfg.strip_sudo, &cfg.rewrite)
+}
+
+/// Strip a leading `sudo` (if asked) and then apply `pattern -> replacement`
+/// rules in order. Replacements may use `$1`-style capture groups.
+pub fn rewrite_with(command: &str, strip_sudo: bool, rules: &[String]) -> Result<Rewritten> {
+    static SUDO: OnceLock<Regex> = OnceLock::new();
+
+    let mut command = command.to_string();
+    let mut notes = Vec::new();
+
+    if strip_sudo {
+        let sudo = SUDO.get_or_init(|| Regex::new(r"^\s*sudo\s+").expect("invalid sudo pattern"));
+        if sudo.is_match(&command) {
+            command = sudo.replace(&command, "").into_owned();
+            notes.push("removed leading sudo (safety.strip_sudo)".to_string());
+        }
+    }
+
+    for rule in rules {
+        let Some((pattern, replacement)) = rule.split_once("->") else {
+            bail!(
+                "Invalid safety.rewrite rule '{}': expected 'pattern -> replacement'",
+                rule
+            );
+        };
+        let re = Regex::new(pattern.trim())
+            .with_context(|| format!("Invalid pattern in safety.rewrite rule '{}'", rule))?;
+        let replaced = re.replace_all(&command, replacement.trim()).into_owned();
+        if replaced != command {
+            command = replaced;
+            notes.push(format!("rewrote with '{}'", rule.trim()));
+        }
+    }
+
+    Ok(Rewritten { command, notes })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn level(command: &str) -> RiskLevel {
+        assess_with(command, &[]).level
+    }
+
+    /// `src/safety_corpus.txt`: `<level> <command>` per line
+    const CORPUS: &str = include_str!("safety_corpus.txt");
+
+    #[test]
+    fn corpus_levels_hold() {
+        let mut wrong = Vec::new();
+        let mut seen = Vec::new();
+        for line in CORPUS.lines().map(str::trim) {
+            if line.is_empty() || line.starts_with('#') {
+                continue;
+            }
+            let (label, command) = line.split_once(char::is_whitespace).unwrap();
+            let expected: RiskLevel = serde_json::from_value(label.into())
+                .unwrap_or_else(|_| panic!("bad level '{}' in the corpus", label));
+            let got = assess_with(command.trim(), &[]);
+            if got.level != expected {
+                wrong.push(format!(
+                    "  {}: expected {}, got {} {:?}",
+                    command.trim(),
+                    expected,
+                    got.level,
+                    got.reasons
+                ));
+            }
+            if !seen.contains(&expected) {
+                seen.push(expected);
+            }
+        }
+
+        assert_eq!(seen.len(), 4, "the corpus should cover every level");
+        assert!(
+            wrong.is_empty(),
+            "{} corpus commands changed level:\n{}",
+            wrong.len(),
+            wrong.join("\n")
+        );
+    }
+
+    #[test]
+    fn read_only_commands_are_safe() {
+        assert_eq!(level("ls -la"), RiskLevel::Safe);
+        assert_eq!(level("find . -name '*.py' 2>/dev/null"), RiskLevel::Safe);
+        assert_eq!(level("git log --oneline | head"), RiskLevel::Safe);
+    }
+
+    #[test]
+    fn levels_escalate_with_destructiveness() {
+        assert_eq!(level("mv a.txt b.txt"), RiskLevel::Moderate);
+        assert_eq!(level("rm -rf build"), RiskLevel::Dangerous);
+        assert_eq!(level("sudo rm -rf /"), RiskLevel::Critical);
+    }
+
+    #[test]
+    fn writes_to_shell_startup_files_are_dangerous() {
+        for command in [
+            "echo 'alias x=y' >> ~/.zshrc",
+            "echo 'export PATH=$HOME/bin:$PATH' >>~/.bashrc",
+            r#"printf 'eval "$(direnv hook bash)"\n' >> "$HOME/.bash_profile""#,
+            "echo 'umask 027' | sudo tee -a /etc/profile",
+            "sed -i 's/^plugins=.*/plugins=(git)/' ~/.zshrc",
+            "echo 'set -gx EDITOR vim' >> ~/.config/fish/config.fish",
+            "cp dotfiles/zshrc ~/.zshrc",
+        ] {
+            let a = assess_with(command, &[]);
+            assert!(
+                a.level >= RiskLevel::Dangerous,
+                "{}: {:?}",
+                command,
+                a.level
+            );
+            assert!(
+                a.reasons.iter().any(|r| r.contains("shell startup file")),
+                "{}: {:?}",
+                command,
+                a.reasons
+            );
+        }
+
+        // Reading them, or writing somewhere else, is not flagged
+        for command in [
+            "source ~/.bashrc",
+            "cat ~/.zshrc > zshrc.backup",
+            "cp ~/.bashrc ~/.bashrc.bak",
+            "grep alias ~/.profile",
+        ] {
+            let a = assess_with(command, &[]);
+            assert!(
+                !a.reasons.iter().any(|r| r.contains("shell startup file")),
+                "{}: {:?}",
+                command,
+                a.reasons
+            );
+        }
+    }
+
+    #[test]
+    fn blocked_commands_are_critical() {
+        let blocked = vec!["kubectl delete namespace".to_string()];
+        let a = assess_with("kubectl delete namespace prod", &blocked);
+        assert_eq!(a.level, RiskLevel::Critical);
+        assert!(a.blocked);
+        assert!(a.reasons[0].contains("blocked"));
+    }
+
+    #[test]
+    fn strip_sudo_only_touches_a_leading_sudo() {
+        let r = rewrite_with("sudo apt install jq", true, &[]).unwrap();
+        assert_eq!(r.command, "apt install jq");
+        assert_eq!(r.notes.len(), 1);
+
+        let r = rewrite_with("echo sudo", true, &[]).unwrap();
+        assert_eq!(r.command, "echo sudo");
+        assert!(r.notes.is_empty());
+
+        let r = rewrite_with("sudo ls", false, &[]).unwrap();
+        assert_eq!(r.command, "sudo ls");
+    }
+
+    #[test]
+    fn rewrite_rules_apply_in_order() {
+        let rules = vec![
+            r"\brm -rf\b -> rm -rI".to_string(),
+            r"^docker (\w+) -> podman $1".to_string(),
+        ];
+        let r = rewrite_with("docker run x && rm -rf tmp", false, &rules).unwrap();
+        assert_eq!(r.command, "podman run x && rm -rI tmp");
+        assert_eq!(r.notes.len(), 2);
+
+        assert!(rewrite_with("ls", false, &["no arrow".to_string()]).is_err());
+        assert!(rewrite_with("ls", false, &["( -> x".to_string()]).is_err());
+    }
+
+    #[test]
+    fn only_reasons_at_final_level_are_kept() {
+        let a = assess_with("sudo rm -rf ./cache", &[]);
+        assert_eq!(a.level, RiskLevel::Dangerous);
+        assert!(a.reasons.iter().all(|r| r != "deletes files"));
+    }
+
+    #[test]
+    fn flags_destructive_paths_missing_from_the_directory() {
+        let dir = std::env::temp_dir().join(format!("niko-paths-{}", std::process::id()));
+        fs::create_dir_all(dir.join("dist")).unwrap();
+
+        assert_eq!(missing_paths("rm -rf build", &dir), vec!["build"]);
+        assert!(missing_paths("rm -rf dist", &dir).is_empty());
+        assert_eq!(
+            missing_paths("sudo rm -rf 'build' dist && mv cache dist/", &dir),
+            vec!["build", "cache"]
+        );
+        // destinations, absolute paths, globs and other tools are left alone
+        for command in [
+            "mv dist out",
+            "rm -rf /tmp/x ~/y *.o",
+            "ls build",
+            "mkdir build",
+        ] {
+            assert!(missing_paths(command, &dir).is_empty(), "{}", command);
+        }
+
+        fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn hook_assessments_only_make_things_stricter() {
+        let base = assess_with("rm -rf ./build", &[]);
+        assert_eq!(base.level, RiskLevel::Dangerous);
+
+        let raised = stricter(base.clone(), RiskLevel::Critical, vec!["prod box".into()]);
+        assert_eq!(raised.level, RiskLevel::Critical);
+        assert_eq!(raised.reasons, vec!["prod box"]);
+
+        let lower = stricter(base.clone(), RiskLevel::Safe, vec!["fine".into()]);
+        assert_eq!(lower.level, RiskLevel::Dangerous);
+        assert_eq!(lower.reasons, base.reasons);
+
+        let same = stricter(base.clone(), RiskLevel::Dangerous, vec!["policy 12".into()]);
+        assert_eq!(same.reasons.last().map(String::as_str), Some("policy 12"));
+    }
+
+    #[test]
+    fn a_failing_hook_makes_the_command_dangerous() {
+        let hook = HookAssessor::new(
+            "/nonexistent/niko-assess",
+            Box::new(PatternAssessor {
+                blocked_commands: Vec::new(),
+            }),
+        );
+        let a = hook.assess("ls -la");
+        assert_eq!(a.level, RiskLevel::Dangerous);
+        assert!(a.reasons[0].starts_with("hooks.assess failed"));
+        assert!(!a.blocked);
+    }
+
+    #[test]
+    fn git_loss_tells_changes_from_untracked_files() {
+        for command in [
+            "git reset --hard",
+            "git checkout .",
+            "git checkout -- . && ls",
+        ] {
+            assert_eq!(git_loss(command), Some(GitLoss::Changes), "{}", command);
+        }
+        assert_eq!(git_loss("git clean -fdx"), Some(GitLoss::Untracked));
+        assert_eq!(git_loss("git checkout -b feature"), None);
+        assert_eq!(git_loss("git checkout ./src/main.rs"), None);
+        assert_eq!(git_loss("git status"), None);
+    }
+
+    #[test]
+    fn global_installs_get_a_scoped_alternative() {
+        let hints = global_install_hints(
+            "sudo npm install -g typescript && pip3 install requests",
+            false,
+        );
+        assert_eq!(hints.len(), 2);
+        assert!(hints[0].contains("drop -g"));
+        assert!(hints[1].contains("virtualenv"));
+
+        assert_eq!(
+            global_install_hints("python3 -m pip install black", false).len(),
+            1
+        );
+        assert_eq!(
+            global_install_hints("yarn global add serve", false).len(),
+            1
+        );
+        assert_eq!(global_install_hints("gem install rails", false).len(), 1);
+
+        for command in [
+            "npm install express",
+            "npm i -D vitest",
+            "pip install -t vendor requests",
+            "pip install --user httpie",
+            "yarn global remove serve",
+            "yarn global list",
+            "gem install --user-install rails",
+            "cargo install ripgrep",
+        ] {
+            assert!(
+                global_install_hints(command, false).is_empty(),
+                "{}",
+                command
+            );
+        }
+        assert!(global_install_hints("pip install requests", true).is_empty());
+    }
+}
@@ -347,6 +347,15 @@ pub fn handle_slash_command(app: &mut App, input: &str, sender: &mpsc::Sender<Ev
                 return true;
             }
 
+            if crate::config::get().safety.print_only {
+                app.history.push(HistoryEntry {
+                    is_user: false,
+                    text: "Running commands is disabled by policy (`safety.print_only`)."
+                        .to_string(),
+                });
+                return true;
+            }
+
             app.pending_command = Some(command.clone());
             app.history.push(HistoryEntry {
                 is_user: false,
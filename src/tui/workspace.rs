@@ -5,6 +5,8 @@ use std::time::{SystemTime, UNIX_EPOCH};
 
 use serde::{Deserialize, Serialize};
 
+use crate::config;
+
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct IndexedFile {
     pub path: String,
@@ -56,11 +58,13 @@ impl WorkspaceIndex {
 
     pub fn save_cache(&self, cache_path: &Path) -> Result<(), String> {
         if let Some(parent) = cache_path.parent() {
-            fs::create_dir_all(parent).map_err(|e| format!("failed to create cache dir: {}", e))?;
+            config::create_private_dir(parent)
+                .map_err(|e| format!("failed to create cache dir: {:#}", e))?;
         }
         let raw =
             serde_json::to_string(self).map_err(|e| format!("failed to encode cache: {}", e))?;
-        fs::write(cache_path, raw).map_err(|e| format!("failed to write cache: {}", e))
+        config::write_private(cache_path, raw.as_bytes())
+            .map_err(|e| format!("failed to write cache: {:#}", e))
     }
 
     pub fn retrieve(&self, query: &str, top_k: usize, max_chars: usize) -> Vec<(String, String)> {